@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"time"
 
 	"github.com/hothuongtin/smartproxy/internal/config"
 	"github.com/hothuongtin/smartproxy/internal/logger"
 	"github.com/hothuongtin/smartproxy/internal/proxy"
+	"github.com/hothuongtin/smartproxy/internal/tracing"
 )
 
 var (
@@ -46,21 +50,26 @@ func main() {
 	yamlConfig.SetDefaults()
 
 	// Setup logger with config
-	loggerConfig := &logger.Config{
-		Level: yamlConfig.Logging.Level,
+	log, err := logger.SetupLogger(loggerConfigFrom(yamlConfig.Logging))
+	if err != nil {
+		fmt.Printf("Failed to setup logging: %v\n", err)
+		os.Exit(1)
 	}
-	log := logger.SetupLogger(loggerConfig)
 
 	log.Info("Starting SmartProxy",
 		"version", Version,
 		"build_time", BuildTime,
 		"git_commit", GitCommit,
 		"config", configFile,
-		"log_level", yamlConfig.Logging.Level)
+		"log_level", yamlConfig.Logging.Level,
+		"log_format", yamlConfig.Logging.Format,
+		"log_output", yamlConfig.Logging.Output,
+		"log_sinks", len(yamlConfig.Logging.Sinks))
 
 	// Log configuration details in debug mode
 	log.Debug("Configuration details",
 		"http_port", yamlConfig.Server.HTTPPort,
+		"listeners", len(yamlConfig.Server.Listen),
 		"https_mitm", yamlConfig.Server.HTTPSMitm,
 		"max_idle_conns", yamlConfig.Server.MaxIdleConns,
 		"max_idle_conns_per_host", yamlConfig.Server.MaxIdleConnsPerHost,
@@ -70,29 +79,32 @@ func main() {
 		"direct_domains", len(yamlConfig.DirectDomains),
 		"ad_blocking_enabled", yamlConfig.AdBlocking.Enabled)
 
-	// Load ad domains if ad blocking is enabled
-	var adDomainsMap map[string]bool
-	if yamlConfig.AdBlocking.Enabled {
-		log.Debug("Loading ad domains", "file", yamlConfig.AdBlocking.DomainsFile)
-		adDomainsConfig, err := config.LoadAdDomains(yamlConfig.AdBlocking.DomainsFile)
-		if err != nil {
-			log.Warn("Failed to load ad domains", "error", err, "file", yamlConfig.AdBlocking.DomainsFile)
-		} else {
-			adDomainsMap = config.CreateAdDomainsMap(adDomainsConfig.AdDomains)
-			proxy.SetAdDomainsMap(adDomainsMap)
-			log.Info("Loaded ad domains", "count", len(adDomainsConfig.AdDomains))
-
-			// Log sample domains in debug mode
-			if len(adDomainsConfig.AdDomains) > 0 {
-				sampleSize := 5
-				if len(adDomainsConfig.AdDomains) < sampleSize {
-					sampleSize = len(adDomainsConfig.AdDomains)
-				}
-				log.Debug("Sample ad domains",
-					"samples", adDomainsConfig.AdDomains[:sampleSize],
-					"total", len(adDomainsConfig.AdDomains))
-			}
-		}
+	// Setup tracing before any request is handled
+	shutdownTracing, err := tracing.Setup(context.Background(), &tracing.Config{
+		Enabled:     yamlConfig.Tracing.Enabled,
+		Endpoint:    yamlConfig.Tracing.Endpoint,
+		URLPath:     yamlConfig.Tracing.URLPath,
+		Insecure:    yamlConfig.Tracing.Insecure,
+		Headers:     yamlConfig.Tracing.Headers,
+		ServiceName: yamlConfig.Tracing.ServiceName,
+		SampleRatio: *yamlConfig.Tracing.SampleRatio,
+	}, nil)
+	if err != nil {
+		log.Error("Failed to setup tracing", "error", err)
+		os.Exit(1)
+	}
+	if yamlConfig.Tracing.Enabled {
+		log.Info("OpenTelemetry tracing enabled",
+			"endpoint", yamlConfig.Tracing.Endpoint,
+			"sample_ratio", *yamlConfig.Tracing.SampleRatio)
+	}
+
+	// Load ad domains and block lists if ad blocking is enabled
+	if err := applyAdBlocking(yamlConfig, log); err != nil {
+		log.Warn("Failed to load ad block lists", "error", err)
+	}
+	if err := applyAdStats(yamlConfig, log); err != nil {
+		log.Warn("Failed to load ad blocking statistics", "error", err)
 	}
 
 	// Smart proxy mode - upstream will be determined by auth credentials
@@ -101,13 +113,36 @@ func main() {
 		"username", "schema (http or socks5)",
 		"password", "base64(host:port) or base64(host:port:user:pass)")
 
+	listeners, err := listenersFrom(yamlConfig)
+	if err != nil {
+		log.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
 	// Create server configurations
 	serverConfig := &proxy.Config{
 		HTTPPort:   yamlConfig.Server.HTTPPort,
 		HTTPSMitm:  yamlConfig.Server.HTTPSMitm,
 		CACert:     yamlConfig.Server.CACert,
 		CAKey:      yamlConfig.Server.CAKey,
+		MITMCerts:  mitmCertsFrom(yamlConfig),
 		ListenAddr: yamlConfig.GetListenAddr(),
+		Listeners:  listeners,
+	}
+	if yamlConfig.DNS.Server.Enabled {
+		if len(yamlConfig.DNS.Servers) == 0 {
+			log.Error("Invalid configuration", "error", "dns server needs dns servers to forward queries to")
+			os.Exit(1)
+		}
+		if len(yamlConfig.DNS.Server.Allow) == 0 {
+			log.Error("Invalid configuration", "error", "dns server needs dns.server.allow to limit the clients it answers")
+			os.Exit(1)
+		}
+		serverConfig.DNSServer = &proxy.DNSServerConfig{
+			Listen:        yamlConfig.DNS.Server.Listen,
+			BlockResponse: yamlConfig.DNS.Server.BlockResponse,
+			Allow:         yamlConfig.DNS.Server.Allow,
+		}
 	}
 
 	routingConfig := &proxy.RoutingConfig{
@@ -130,9 +165,12 @@ func main() {
 		WriteBufferSize:       yamlConfig.Server.WriteBufferSize,
 	}
 
-	// Initialize static extensions map for O(1) lookup
-	proxy.InitStaticExtensions(yamlConfig.DirectExtensions)
-	log.Debug("Initialized static extensions map", "count", len(yamlConfig.DirectExtensions))
+	// Apply settings that can also change at runtime, then reload them on SIGHUP
+	if err := applyRuntimeConfig(yamlConfig, log); err != nil {
+		log.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	watchReloadSignal(configFile, log)
 
 	// Create and start the proxy server
 	server := proxy.NewServer(serverConfig, routingConfig, transportConfig, log)
@@ -142,10 +180,6 @@ func main() {
 		"cdnDomains", len(yamlConfig.DirectDomains),
 		"adBlockingEnabled", yamlConfig.AdBlocking.Enabled)
 
-	if yamlConfig.AdBlocking.Enabled {
-		log.Info("Ad blocking active", "domains", len(adDomainsMap))
-	}
-
 	log.Info("Performance settings",
 		"maxIdleConns", yamlConfig.Server.MaxIdleConns,
 		"maxIdleConnsPerHost", yamlConfig.Server.MaxIdleConnsPerHost)
@@ -159,14 +193,194 @@ func main() {
 		"example_socks5", "curl -x http://socks5:$(echo -n 'socks.example.com:1080:user:pass' | base64)@localhost:8888")
 
 	log.Debug("Routing rules",
+		"configured_rules", len(yamlConfig.Routing.Rules),
 		"static_files", "direct connection",
 		"cdn_domains", "direct connection",
-		"ad_domains", "blocked (204)",
+		"ad_domains", "blocked (block_response, 403 for tunnels)",
 		"other", "upstream proxy (via auth)")
 
 	// Start the server
-	if err := server.Start(); err != nil {
+	err = server.Start()
+
+	// Flush pending spans before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if shutdownErr := shutdownTracing(ctx); shutdownErr != nil {
+		log.Warn("Failed to flush traces", "error", shutdownErr)
+	}
+
+	if err != nil {
 		log.Error("Failed to start server", "error", err)
 		os.Exit(1)
 	}
 }
+
+// applyAdBlocking loads the ad domains file and block lists when ad blocking
+// is enabled. The domains file may be missing when block lists are set.
+func applyAdBlocking(yamlConfig *config.Config, log *slog.Logger) error {
+	if !yamlConfig.AdBlocking.Enabled {
+		return proxy.SetAdBlockConfig(nil, log)
+	}
+
+	adBlockConfig := &proxy.AdBlockConfig{
+		CacheDir:      yamlConfig.AdBlocking.CacheDir,
+		Allowlist:     yamlConfig.AdBlocking.Allowlist,
+		BlockResponse: yamlConfig.AdBlocking.BlockResponse,
+		BlockStatus:   yamlConfig.AdBlocking.BlockStatus,
+	}
+	for _, policy := range yamlConfig.AdBlocking.Policies {
+		adBlockConfig.Policies = append(adBlockConfig.Policies, proxy.AdPolicy{
+			Name:      policy.Name,
+			Users:     policy.Users,
+			ClientIPs: policy.ClientIPs,
+			Disabled:  policy.Disabled,
+			Allowlist: policy.Allowlist,
+			Block:     policy.Block,
+
+			BlockResponse: policy.BlockResponse,
+			BlockStatus:   policy.BlockStatus,
+		})
+	}
+	for _, list := range yamlConfig.AdBlocking.Lists {
+		adBlockConfig.Lists = append(adBlockConfig.Lists, proxy.AdListConfig{
+			Path:    list.Path,
+			URL:     list.URL,
+			Format:  list.Format,
+			Refresh: time.Duration(list.Refresh) * time.Second,
+		})
+	}
+
+	log.Debug("Loading ad domains", "file", yamlConfig.AdBlocking.DomainsFile)
+	adDomainsConfig, err := config.LoadAdDomains(yamlConfig.AdBlocking.DomainsFile)
+	if err != nil {
+		if len(adBlockConfig.Lists) == 0 {
+			return err
+		}
+		log.Warn("Failed to load ad domains, using block lists only", "error", err, "file", yamlConfig.AdBlocking.DomainsFile)
+		return proxy.SetAdBlockConfig(adBlockConfig, log)
+	}
+
+	adBlockConfig.Domains = adDomainsConfig.AdDomains
+	log.Info("Loaded ad domains", "count", len(adDomainsConfig.AdDomains))
+
+	// Log sample domains in debug mode
+	if len(adDomainsConfig.AdDomains) > 0 {
+		sampleSize := 5
+		if len(adDomainsConfig.AdDomains) < sampleSize {
+			sampleSize = len(adDomainsConfig.AdDomains)
+		}
+		log.Debug("Sample ad domains",
+			"samples", adDomainsConfig.AdDomains[:sampleSize],
+			"total", len(adDomainsConfig.AdDomains))
+	}
+	return proxy.SetAdBlockConfig(adBlockConfig, log)
+}
+
+// applyAdStats starts ad blocking statistics when they and ad blocking are
+// enabled
+func applyAdStats(yamlConfig *config.Config, log *slog.Logger) error {
+	stats := yamlConfig.AdBlocking.Stats
+	if !yamlConfig.AdBlocking.Enabled || !stats.Enabled {
+		return proxy.SetAdStatsConfig(nil, log)
+	}
+	return proxy.SetAdStatsConfig(&proxy.AdStatsConfig{
+		Path:          stats.Path,
+		File:          stats.File,
+		SaveInterval:  time.Duration(stats.SaveInterval) * time.Second,
+		BytesPerBlock: stats.BytesPerBlock,
+		Allow:         stats.Allow,
+	}, log)
+}
+
+// mitmCertsFrom converts the MITM certificate settings
+func mitmCertsFrom(yamlConfig *config.Config) proxy.MITMCertConfig {
+	certs := yamlConfig.Server.MITM.Certs
+	return proxy.MITMCertConfig{
+		KeyType:   certs.KeyType,
+		Validity:  time.Duration(certs.ValidityDays) * 24 * time.Hour,
+		CacheSize: certs.CacheSize,
+		Wildcard:  certs.Wildcard == nil || *certs.Wildcard,
+		CacheDir:  certs.CacheDir,
+	}
+}
+
+// listenersFrom converts the listen section, resolving named upstreams of
+// listeners that skip authentication
+func listenersFrom(yamlConfig *config.Config) ([]proxy.ListenerConfig, error) {
+	upstreams := upstreamsFrom(yamlConfig.Upstreams)
+
+	var listeners []proxy.ListenerConfig
+	for _, l := range yamlConfig.Server.Listen {
+		if l.Address == "" {
+			return nil, fmt.Errorf("listener without address")
+		}
+		if (l.TLS.CertFile == "") != (l.TLS.KeyFile == "") {
+			return nil, fmt.Errorf("listener %s: tls needs both cert_file and key_file", l.Address)
+		}
+		if l.TLS.CertFile == "" && (l.TLS.ClientCA != "" || l.TLS.RequireClientCert || len(l.TLS.ClientUpstreams) > 0) {
+			return nil, fmt.Errorf("listener %s: client certificates need cert_file and key_file", l.Address)
+		}
+		if l.TLS.ClientCA == "" && (l.TLS.RequireClientCert || len(l.TLS.ClientUpstreams) > 0) {
+			return nil, fmt.Errorf("listener %s: client certificates need client_ca", l.Address)
+		}
+
+		listener := proxy.ListenerConfig{
+			Address:           l.Address,
+			TLSCert:           l.TLS.CertFile,
+			TLSKey:            l.TLS.KeyFile,
+			SkipAuth:          l.SkipAuth,
+			ClientCA:          l.TLS.ClientCA,
+			RequireClientCert: l.TLS.RequireClientCert,
+			Transparent:       l.Transparent,
+		}
+		for subject, name := range l.TLS.ClientUpstreams {
+			upstream, ok := upstreams[name]
+			if !ok {
+				return nil, fmt.Errorf("listener %s: unknown upstream %q for client %q", l.Address, name, subject)
+			}
+			if listener.ClientUpstreams == nil {
+				listener.ClientUpstreams = make(map[string]*proxy.UpstreamInfo)
+			}
+			listener.ClientUpstreams[subject] = upstream
+		}
+		switch {
+		case l.Transparent && l.Upstream == "":
+			return nil, fmt.Errorf("listener %s: transparent listeners need a default upstream", l.Address)
+		case l.SkipAuth && l.Upstream == "":
+			return nil, fmt.Errorf("listener %s: skip_auth needs an upstream", l.Address)
+		case !l.SkipAuth && !l.Transparent && l.Upstream != "":
+			return nil, fmt.Errorf("listener %s: upstream is only used with skip_auth or transparent", l.Address)
+		case l.SkipAuth || l.Transparent:
+			upstream, ok := upstreams[l.Upstream]
+			if !ok {
+				return nil, fmt.Errorf("listener %s: unknown upstream %q", l.Address, l.Upstream)
+			}
+			listener.Upstream = upstream
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// loggerConfigFrom converts the YAML logging section to the logger configuration
+func loggerConfigFrom(c config.LoggingConfig) *logger.Config {
+	loggerConfig := &logger.Config{
+		Level:  c.Level,
+		Format: c.Format,
+		Output: c.Output,
+		File:   logger.FileConfig(c.File),
+		Syslog: logger.SyslogConfig(c.Syslog),
+
+		Unredacted: c.Unredacted,
+	}
+	for _, sink := range c.Sinks {
+		loggerConfig.Sinks = append(loggerConfig.Sinks, logger.SinkConfig{
+			Level:  sink.Level,
+			Format: sink.Format,
+			Output: sink.Output,
+			File:   logger.FileConfig(sink.File),
+			Syslog: logger.SyslogConfig(sink.Syslog),
+		})
+	}
+	return loggerConfig
+}
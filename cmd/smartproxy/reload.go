@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hothuongtin/smartproxy/internal/config"
+	"github.com/hothuongtin/smartproxy/internal/proxy"
+)
+
+// watchReloadSignal reloads runtime-adjustable settings on SIGHUP
+func watchReloadSignal(configFile string, log *slog.Logger) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			reloadConfig(configFile, log)
+		}
+	}()
+}
+
+// reloadConfig re-reads the configuration file and applies runtime settings
+func reloadConfig(configFile string, log *slog.Logger) {
+	log.Info("Reloading configuration", "config", configFile)
+
+	yamlConfig, err := config.LoadConfig(configFile)
+	if err != nil {
+		log.Error("Failed to reload configuration, keeping current settings", "error", err)
+		return
+	}
+	yamlConfig.SetDefaults()
+
+	if err := applyRuntimeConfig(yamlConfig, log); err != nil {
+		log.Error("Failed to apply configuration, keeping current settings", "error", err)
+		return
+	}
+
+	// Keep the current ad block lists if they fail to load
+	if err := applyAdBlocking(yamlConfig, log); err != nil {
+		log.Error("Failed to reload ad block lists, keeping current lists", "error", err)
+	}
+	if err := applyAdStats(yamlConfig, log); err != nil {
+		log.Error("Failed to reload ad blocking statistics, keeping current counters", "error", err)
+	}
+	log.Info("Configuration reloaded", "config", configFile)
+}
+
+// applyRuntimeConfig applies settings that can change without a restart.
+// Direct domains, resolver settings, GeoIP databases, destination lists,
+// routing rules, MITM host selection and client ACLs are all validated
+// before any of them is applied, so an error leaves the current settings in
+// place.
+func applyRuntimeConfig(yamlConfig *config.Config, log *slog.Logger) error {
+	rules := make([]proxy.RoutingRule, 0, len(yamlConfig.Routing.Rules))
+	for _, rule := range yamlConfig.Routing.Rules {
+		rules = append(rules, proxy.RoutingRule(rule))
+	}
+
+	mitm := yamlConfig.Server.MITM
+	acl := yamlConfig.Server.ClientACL
+	aclConfig := &proxy.ClientACLConfig{Allow: acl.Allow, Deny: acl.Deny}
+	for _, policy := range acl.Policies {
+		aclConfig.Policies = append(aclConfig.Policies, proxy.ClientPolicy(policy))
+	}
+
+	if err := proxy.ApplyRuntimeConfig(&proxy.RuntimeConfig{
+		DirectDomains: yamlConfig.DirectDomains,
+		Resolver: &proxy.ResolverConfig{
+			Servers:            yamlConfig.DNS.Servers,
+			Timeout:            time.Duration(yamlConfig.DNS.Timeout) * time.Second,
+			CacheSize:          yamlConfig.DNS.CacheSize,
+			CacheTTL:           time.Duration(yamlConfig.DNS.CacheTTL) * time.Second,
+			UpstreamResolution: yamlConfig.DNS.UpstreamResolution,
+		},
+		GeoIP: &proxy.GeoIPConfig{
+			CountryDatabase: yamlConfig.GeoIP.CountryDatabase,
+			ASNDatabase:     yamlConfig.GeoIP.ASNDatabase,
+		},
+		Destinations: (*proxy.DestinationConfig)(&yamlConfig.Destinations),
+		RoutingRules: rules,
+		Upstreams:    upstreamsFrom(yamlConfig.Upstreams),
+		MITMSelect: &proxy.MITMSelectConfig{
+			Hosts:          mitm.Hosts,
+			Exclude:        mitm.Exclude,
+			AutoBypass:     mitm.AutoBypass.Enabled,
+			BypassFailures: mitm.AutoBypass.Failures,
+			BypassDuration: time.Duration(mitm.AutoBypass.Duration) * time.Second,
+		},
+		ClientACL: aclConfig,
+	}, log); err != nil {
+		return err
+	}
+	log.Debug("Applied resolver settings",
+		"servers", len(yamlConfig.DNS.Servers),
+		"cache_size", yamlConfig.DNS.CacheSize,
+		"upstream_resolution", yamlConfig.DNS.UpstreamResolution)
+	log.Debug("Applied destination lists",
+		"direct", len(yamlConfig.Destinations.Direct),
+		"upstream", len(yamlConfig.Destinations.Upstream),
+		"deny", len(yamlConfig.Destinations.Deny))
+	log.Debug("Applied routing rules",
+		"rules", len(rules),
+		"named_upstreams", len(yamlConfig.Upstreams))
+	log.Debug("Applied MITM host selection",
+		"hosts", len(mitm.Hosts),
+		"exclude", len(mitm.Exclude),
+		"auto_bypass", mitm.AutoBypass.Enabled)
+	log.Debug("Applied client ACL",
+		"allow", len(acl.Allow),
+		"deny", len(acl.Deny),
+		"policies", len(acl.Policies))
+
+	// Initialize static extensions map for O(1) lookup
+	proxy.InitStaticExtensions(yamlConfig.DirectExtensions)
+	log.Debug("Applied direct routing lists",
+		"extensions", len(yamlConfig.DirectExtensions),
+		"domains", len(yamlConfig.DirectDomains))
+
+	proxy.SetLearnedRoutingConfig(&proxy.LearnedRoutingConfig{
+		Enabled:      yamlConfig.Routing.Learned.Enabled,
+		ContentTypes: yamlConfig.Routing.Learned.ContentTypes,
+		TTL:          time.Duration(yamlConfig.Routing.Learned.TTL) * time.Second,
+		MaxEntries:   yamlConfig.Routing.Learned.MaxEntries,
+		PathDepth:    yamlConfig.Routing.Learned.PathDepth,
+	})
+	log.Debug("Applied learned routing",
+		"enabled", yamlConfig.Routing.Learned.Enabled,
+		"content_types", yamlConfig.Routing.Learned.ContentTypes,
+		"ttl", yamlConfig.Routing.Learned.TTL,
+		"max_entries", yamlConfig.Routing.Learned.MaxEntries)
+
+	proxy.SetBandwidthConfig(&proxy.BandwidthConfig{
+		Global:      yamlConfig.Bandwidth.Global,
+		PerClient:   yamlConfig.Bandwidth.PerClient,
+		PerUpstream: yamlConfig.Bandwidth.PerUpstream,
+		Clients:     yamlConfig.Bandwidth.Clients,
+		Upstreams:   yamlConfig.Bandwidth.Upstreams,
+	})
+	log.Debug("Applied bandwidth limits",
+		"global", yamlConfig.Bandwidth.Global,
+		"per_client", yamlConfig.Bandwidth.PerClient,
+		"per_upstream", yamlConfig.Bandwidth.PerUpstream,
+		"client_overrides", len(yamlConfig.Bandwidth.Clients),
+		"upstream_overrides", len(yamlConfig.Bandwidth.Upstreams))
+
+	proxy.SetRateLimitConfig(&proxy.RateLimitConfig{
+		Enabled:     yamlConfig.RateLimit.Enabled,
+		PerIP:       proxy.RateLimitRule(yamlConfig.RateLimit.PerIP),
+		PerIdentity: proxy.RateLimitRule(yamlConfig.RateLimit.PerIdentity),
+	})
+	log.Debug("Applied rate limits",
+		"enabled", yamlConfig.RateLimit.Enabled,
+		"per_ip_rps", yamlConfig.RateLimit.PerIP.RequestsPerSecond,
+		"per_ip_tunnels", yamlConfig.RateLimit.PerIP.MaxConcurrentTunnels,
+		"per_identity_rps", yamlConfig.RateLimit.PerIdentity.RequestsPerSecond,
+		"per_identity_tunnels", yamlConfig.RateLimit.PerIdentity.MaxConcurrentTunnels)
+
+	// Regenerate the PAC file last, from the lists applied above
+	proxy.SetPACConfig(&proxy.PACConfig{
+		Enabled:      yamlConfig.PAC.Enabled,
+		Path:         yamlConfig.PAC.Path,
+		ProxyAddress: yamlConfig.PAC.ProxyAddress,
+	})
+	if yamlConfig.PAC.Enabled {
+		log.Debug("Generated PAC file", "path", yamlConfig.PAC.Path)
+	}
+
+	return nil
+}
+
+// upstreamsFrom converts the named upstreams of the configuration
+func upstreamsFrom(upstreams map[string]config.UpstreamConfig) map[string]*proxy.UpstreamInfo {
+	named := make(map[string]*proxy.UpstreamInfo, len(upstreams))
+	for name, upstream := range upstreams {
+		named[name] = &proxy.UpstreamInfo{
+			Type:     strings.ToLower(upstream.Type),
+			Host:     upstream.Host,
+			Port:     strconv.Itoa(upstream.Port),
+			Username: upstream.Username,
+			Password: upstream.Password,
+			Named:    true,
+		}
+	}
+	return named
+}
@@ -3,18 +3,26 @@ package config
 import (
 	"fmt"
 	"os"
-	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the complete configuration structure
 type Config struct {
-	Server           ServerConfig  `yaml:"server"`
-	AdBlocking       AdBlockConfig `yaml:"ad_blocking"`
-	DirectExtensions []string      `yaml:"direct_extensions"`
-	DirectDomains    []string      `yaml:"direct_domains"`
-	Logging          LoggingConfig `yaml:"logging"`
+	Server           ServerConfig              `yaml:"server"`
+	AdBlocking       AdBlockConfig             `yaml:"ad_blocking"`
+	DirectExtensions []string                  `yaml:"direct_extensions"`
+	DirectDomains    []string                  `yaml:"direct_domains"`
+	Upstreams        map[string]UpstreamConfig `yaml:"upstreams"`
+	Routing          RoutingConfig             `yaml:"routing"`
+	GeoIP            GeoIPConfig               `yaml:"geoip"`
+	DNS              DNSConfig                 `yaml:"dns"`
+	Destinations     DestinationConfig         `yaml:"destinations"`
+	PAC              PACConfig                 `yaml:"pac"`
+	Logging          LoggingConfig             `yaml:"logging"`
+	Tracing          TracingConfig             `yaml:"tracing"`
+	Bandwidth        BandwidthConfig           `yaml:"bandwidth"`
+	RateLimit        RateLimitConfig           `yaml:"rate_limit"`
 }
 
 // ServerConfig represents server configuration
@@ -30,18 +38,288 @@ type ServerConfig struct {
 	ExpectContinueTimeout int    `yaml:"expect_continue_timeout"`
 	ReadBufferSize        int    `yaml:"read_buffer_size"`
 	WriteBufferSize       int    `yaml:"write_buffer_size"`
+
+	Listen    []ListenConfig  `yaml:"listen"` // defaults to all interfaces on http_port
+	ClientACL ClientACLConfig `yaml:"client_acl"`
+	MITM      MITMConfig      `yaml:"mitm"`
+}
+
+// MITMConfig represents HTTPS interception settings
+type MITMConfig struct {
+	Hosts      []string             `yaml:"hosts"`   // domain patterns to intercept, all when empty
+	Exclude    []string             `yaml:"exclude"` // domain patterns always tunneled
+	AutoBypass MITMAutoBypassConfig `yaml:"auto_bypass"`
+	Certs      MITMCertConfig       `yaml:"certs"`
+}
+
+// MITMAutoBypassConfig represents tunneling hosts whose clients refuse the
+// MITM certificate, such as apps with certificate pinning
+type MITMAutoBypassConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	Failures int  `yaml:"failures"` // failed handshakes in a row
+	Duration int  `yaml:"duration"` // seconds the host is tunneled
+}
+
+// MITMCertConfig represents the leaf certificates signed for intercepted hosts
+type MITMCertConfig struct {
+	KeyType      string `yaml:"key_type"` // ecdsa (P-256) or rsa (2048 bits)
+	ValidityDays int    `yaml:"validity_days"`
+	CacheSize    int    `yaml:"cache_size"` // certificates kept in memory
+	Wildcard     *bool  `yaml:"wildcard"`   // one *.domain certificate for subdomains
+	CacheDir     string `yaml:"cache_dir"`  // certificates kept across restarts
+}
+
+// ListenConfig represents an address to accept clients on. A plain string
+// entry is an address without TLS or auth settings.
+type ListenConfig struct {
+	Address  string          `yaml:"address"` // host:port, [ipv6]:port or unix:/path.sock
+	TLS      ListenTLSConfig `yaml:"tls"`
+	SkipAuth bool            `yaml:"skip_auth"` // accept requests without credentials
+	Upstream string          `yaml:"upstream"`  // named upstream for requests without credentials
+
+	// Transparent accepts connections redirected by iptables or nftables
+	// (Linux only). Upstream is the default for clients not matched by a
+	// client_acl policy.
+	Transparent bool `yaml:"transparent"`
+}
+
+// ListenTLSConfig represents the certificate of a TLS listener and optional
+// client certificate authentication. Files are reloaded when they change.
+type ListenTLSConfig struct {
+	CertFile          string            `yaml:"cert_file"`
+	KeyFile           string            `yaml:"key_file"`
+	ClientCA          string            `yaml:"client_ca"`           // CA bundle to verify client certificates
+	RequireClientCert bool              `yaml:"require_client_cert"` // refuse clients without a valid certificate
+	ClientUpstreams   map[string]string `yaml:"client_upstreams"`    // subject CN or full subject -> named upstream
+}
+
+// UnmarshalYAML accepts a listener as an address string or a mapping
+func (l *ListenConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		l.Address = value.Value
+		return nil
+	}
+	type plain ListenConfig
+	return value.Decode((*plain)(l))
+}
+
+// ClientACLConfig represents which clients may connect, checked when a
+// connection is accepted, and policies for client networks
+type ClientACLConfig struct {
+	Allow    []string             `yaml:"allow"` // IPs or CIDRs, empty allows all
+	Deny     []string             `yaml:"deny"`  // IPs or CIDRs, checked first
+	Policies []ClientPolicyConfig `yaml:"policies"`
+}
+
+// ClientPolicyConfig represents a policy for clients in the given networks
+type ClientPolicyConfig struct {
+	Networks []string `yaml:"networks"`
+	SkipAuth bool     `yaml:"skip_auth"` // accept requests without credentials
+	Upstream string   `yaml:"upstream"`  // named upstream for requests without credentials
 }
 
 // AdBlockConfig represents ad blocking configuration
 type AdBlockConfig struct {
-	Enabled     bool   `yaml:"enabled"`
-	DomainsFile string `yaml:"domains_file"`
+	Enabled     bool             `yaml:"enabled"`
+	DomainsFile string           `yaml:"domains_file"`
+	Lists       []AdListConfig   `yaml:"lists"`
+	CacheDir    string           `yaml:"cache_dir"` // last known good copies of subscriptions
+	Allowlist   []string         `yaml:"allowlist"` // domain patterns never blocked
+	Policies    []AdPolicyConfig `yaml:"policies"`
+
+	BlockResponse string `yaml:"block_response"` // status, page, gif, empty or reset
+	BlockStatus   int    `yaml:"block_status"`   // default 204 or 403 for the page
+
+	Stats AdStatsConfig `yaml:"stats"`
+}
+
+// AdStatsConfig controls ad blocking statistics
+type AdStatsConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	Path          string   `yaml:"path"`            // API path on the proxy port
+	File          string   `yaml:"file"`            // counters kept across restarts
+	SaveInterval  int      `yaml:"save_interval"`   // seconds between saves
+	BytesPerBlock int64    `yaml:"bytes_per_block"` // estimated size of a blocked response
+	Allow         []string `yaml:"allow"`           // client IPs or CIDRs allowed to read the API
+}
+
+// AdPolicyConfig changes ad blocking for the clients it matches
+type AdPolicyConfig struct {
+	Name      string   `yaml:"name"`
+	Users     []string `yaml:"users"`      // upstream account username
+	ClientIPs []string `yaml:"client_ips"` // IP or CIDR
+	Disabled  bool     `yaml:"disabled"`   // no ad blocking for these clients
+	Allowlist []string `yaml:"allowlist"`
+	Block     []string `yaml:"block"` // blocked in addition to the lists
+
+	BlockResponse string `yaml:"block_response"` // default from ad_blocking
+	BlockStatus   int    `yaml:"block_status"`
+}
+
+// AdListConfig represents a block list file or subscription
+type AdListConfig struct {
+	Path    string `yaml:"path"`
+	URL     string `yaml:"url"`
+	Format  string `yaml:"format"`  // auto, hosts, domains or abp
+	Refresh int    `yaml:"refresh"` // seconds between subscription downloads
+}
+
+// UpstreamConfig represents a named upstream proxy that routing rules can use
+type UpstreamConfig struct {
+	Type     string `yaml:"type"` // http or socks5
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// RoutingConfig represents the ordered routing rules
+type RoutingConfig struct {
+	Rules   []RoutingRule        `yaml:"rules"`
+	Learned LearnedRoutingConfig `yaml:"learned"`
+}
+
+// LearnedRoutingConfig represents direct routing learned from the
+// Content-Type of upstream responses in MITM mode
+type LearnedRoutingConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	ContentTypes []string `yaml:"content_types"` // image/*, font/woff2, ...
+	TTL          int      `yaml:"ttl"`           // seconds
+	MaxEntries   int      `yaml:"max_entries"`
+	PathDepth    int      `yaml:"path_depth"` // path segments kept in the learned prefix
+}
+
+// RoutingRule represents a single routing rule. All conditions that are set
+// must match; any entry of a list may match.
+type RoutingRule struct {
+	Name       string   `yaml:"name"`
+	Hosts      []string `yaml:"hosts"` // example.com, .example.com, *.example.com or regex:...
+	Paths      []string `yaml:"paths"` // path prefix, wildcard or regex:...
+	Extensions []string `yaml:"extensions"`
+	Methods    []string `yaml:"methods"`
+	Ports      []int    `yaml:"ports"`
+	ClientIPs  []string `yaml:"client_ips"`  // IP or CIDR
+	Users      []string `yaml:"users"`       // upstream account username
+	UserAgents []string `yaml:"user_agents"` // substring or regex:...
+	Countries  []string `yaml:"countries"`   // ISO country code of the target, needs geoip.country_database
+	ASNs       []uint   `yaml:"asns"`        // autonomous system number of the target, needs geoip.asn_database
+	Action     string   `yaml:"action"`      // direct, upstream, block or reject
+	Upstream   string   `yaml:"upstream"`    // named upstream for the upstream action
+	Status     int      `yaml:"status"`      // block status, default 204 or 403 for the page
+	Resolve    string   `yaml:"resolve"`     // local or remote, for the upstream action
+
+	BlockResponse string `yaml:"block_response"` // status, page, gif, empty or reset
+}
+
+// GeoIPConfig represents the GeoIP databases used by routing rules
+type GeoIPConfig struct {
+	CountryDatabase string `yaml:"country_database"` // MaxMind-format mmdb file
+	ASNDatabase     string `yaml:"asn_database"`     // MaxMind-format mmdb file
+}
+
+// DNSConfig represents the built-in resolver
+type DNSConfig struct {
+	Servers            []string `yaml:"servers"`             // udp://, tcp://, tls:// or https://; empty uses the system resolver
+	Timeout            int      `yaml:"timeout"`             // seconds per lookup
+	CacheSize          int      `yaml:"cache_size"`          // cached host names
+	CacheTTL           int      `yaml:"cache_ttl"`           // seconds, upper bound for record TTLs
+	UpstreamResolution string   `yaml:"upstream_resolution"` // remote or local
+
+	Server DNSServerConfig `yaml:"server"`
+}
+
+// DNSServerConfig represents the embedded DNS server
+type DNSServerConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	Listen        string   `yaml:"listen"`         // UDP and TCP address
+	BlockResponse string   `yaml:"block_response"` // nxdomain or zero
+	Allow         []string `yaml:"allow"`          // client IPs or CIDRs answered
+}
+
+// DestinationConfig represents CIDR lists applied to target addresses
+type DestinationConfig struct {
+	Direct   []string `yaml:"direct"`
+	Upstream []string `yaml:"upstream"`
+	Deny     []string `yaml:"deny"` // defaults to internal networks, [] disables
+}
+
+// PACConfig represents proxy auto-config file serving
+type PACConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Path         string `yaml:"path"`
+	ProxyAddress string `yaml:"proxy_address"` // host:port clients use to reach SmartProxy
 }
 
 // LoggingConfig represents logging configuration
 type LoggingConfig struct {
-	Level  string `yaml:"level"`
-	Format string `yaml:"format"`
+	Level  string          `yaml:"level"`
+	Format string          `yaml:"format"` // text, json or color
+	Output string          `yaml:"output"` // stdout, stderr, file or syslog
+	File   LogFileConfig   `yaml:"file"`
+	Syslog LogSyslogConfig `yaml:"syslog"`
+	Sinks  []LogSinkConfig `yaml:"sinks"`
+
+	// Unredacted disables masking of secrets in logs (troubleshooting only)
+	Unredacted bool `yaml:"unredacted"`
+}
+
+// LogSinkConfig represents one of several simultaneous log outputs
+type LogSinkConfig struct {
+	Level  string          `yaml:"level"`
+	Format string          `yaml:"format"`
+	Output string          `yaml:"output"`
+	File   LogFileConfig   `yaml:"file"`
+	Syslog LogSyslogConfig `yaml:"syslog"`
+}
+
+// LogFileConfig represents log file output with rotation
+type LogFileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+	MaxBackups int    `yaml:"max_backups"`
+	Compress   bool   `yaml:"compress"`
+}
+
+// LogSyslogConfig represents syslog output
+type LogSyslogConfig struct {
+	Network string `yaml:"network"` // empty for the local socket, or udp/tcp
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+// TracingConfig represents OpenTelemetry tracing configuration
+type TracingConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	Endpoint    string            `yaml:"endpoint"` // OTLP/HTTP collector host:port
+	URLPath     string            `yaml:"url_path"`
+	Insecure    bool              `yaml:"insecure"`
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	SampleRatio *float64          `yaml:"sample_ratio"`
+}
+
+// BandwidthConfig represents bandwidth limits in bytes per second (0 = unlimited)
+type BandwidthConfig struct {
+	Global      int64            `yaml:"global"`
+	PerClient   int64            `yaml:"per_client"`
+	PerUpstream int64            `yaml:"per_upstream"`
+	Clients     map[string]int64 `yaml:"clients"`   // keyed by [user@]host:port of the client's upstream account
+	Upstreams   map[string]int64 `yaml:"upstreams"` // keyed by type:host:port
+}
+
+// RateLimitConfig represents request rate and concurrent tunnel limits
+type RateLimitConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	PerIP       RateLimitRule `yaml:"per_ip"`
+	PerIdentity RateLimitRule `yaml:"per_identity"`
+}
+
+// RateLimitRule represents the limits for a single client IP or identity
+type RateLimitRule struct {
+	RequestsPerSecond    float64 `yaml:"requests_per_second"`
+	Burst                int     `yaml:"burst"`
+	MaxConcurrentTunnels int     `yaml:"max_concurrent_tunnels"`
 }
 
 // AdDomainsConfig represents the ad domains configuration
@@ -79,19 +357,25 @@ func LoadAdDomains(adDomainsPath string) (*AdDomainsConfig, error) {
 	return &adDomains, nil
 }
 
+// DefaultHTTPPort is the proxy port used when none is configured
+const DefaultHTTPPort = 8888
+
 // GetListenAddr returns the listen address based on config
 func (c *Config) GetListenAddr() string {
 	if c.Server.HTTPPort > 0 {
 		return fmt.Sprintf(":%d", c.Server.HTTPPort)
 	}
-	return ":8080" // default
+	return fmt.Sprintf(":%d", DefaultHTTPPort)
 }
 
 // SetDefaults sets default values for performance settings
 func (c *Config) SetDefaults() {
 	// Server defaults
 	if c.Server.HTTPPort == 0 {
-		c.Server.HTTPPort = 8888
+		c.Server.HTTPPort = DefaultHTTPPort
+	}
+	if len(c.Server.Listen) == 0 {
+		c.Server.Listen = []ListenConfig{{Address: c.GetListenAddr()}}
 	}
 	if c.Server.MaxIdleConns == 0 {
 		c.Server.MaxIdleConns = 10000
@@ -114,18 +398,140 @@ func (c *Config) SetDefaults() {
 	if c.Server.WriteBufferSize == 0 {
 		c.Server.WriteBufferSize = 65536
 	}
+	if c.Server.MITM.AutoBypass.Failures == 0 {
+		c.Server.MITM.AutoBypass.Failures = 3
+	}
+	if c.Server.MITM.AutoBypass.Duration == 0 {
+		c.Server.MITM.AutoBypass.Duration = 3600
+	}
+	if c.Server.MITM.Certs.KeyType == "" {
+		c.Server.MITM.Certs.KeyType = "ecdsa"
+	}
+	if c.Server.MITM.Certs.ValidityDays == 0 {
+		c.Server.MITM.Certs.ValidityDays = 30
+	}
+	if c.Server.MITM.Certs.CacheSize == 0 {
+		c.Server.MITM.Certs.CacheSize = 1000
+	}
+	if c.Server.MITM.Certs.Wildcard == nil {
+		wildcard := true
+		c.Server.MITM.Certs.Wildcard = &wildcard
+	}
 
 	// Ad blocking defaults
 	if c.AdBlocking.DomainsFile == "" {
 		c.AdBlocking.DomainsFile = "ad_domains.yaml"
 	}
+	if c.AdBlocking.CacheDir == "" {
+		c.AdBlocking.CacheDir = "cache/ad_lists"
+	}
+	if c.AdBlocking.Stats.Path == "" {
+		c.AdBlocking.Stats.Path = "/adblock/stats"
+	}
+	if c.AdBlocking.Stats.File == "" {
+		c.AdBlocking.Stats.File = "cache/ad_stats.json"
+	}
+	if c.AdBlocking.Stats.SaveInterval <= 0 {
+		c.AdBlocking.Stats.SaveInterval = 300
+	}
+	if c.AdBlocking.Stats.BytesPerBlock <= 0 {
+		c.AdBlocking.Stats.BytesPerBlock = 20480
+	}
+
+	// Learned routing defaults
+	if len(c.Routing.Learned.ContentTypes) == 0 {
+		c.Routing.Learned.ContentTypes = []string{"image/*", "font/*", "video/*"}
+	}
+	if c.Routing.Learned.TTL == 0 {
+		c.Routing.Learned.TTL = 3600
+	}
+	if c.Routing.Learned.MaxEntries == 0 {
+		c.Routing.Learned.MaxEntries = 10000
+	}
+	if c.Routing.Learned.PathDepth == 0 {
+		c.Routing.Learned.PathDepth = 1
+	}
+
+	// Resolver defaults
+	if c.DNS.Timeout == 0 {
+		c.DNS.Timeout = 5
+	}
+	if c.DNS.CacheSize == 0 {
+		c.DNS.CacheSize = 10000
+	}
+	if c.DNS.CacheTTL == 0 {
+		c.DNS.CacheTTL = 300
+	}
+	if c.DNS.UpstreamResolution == "" {
+		c.DNS.UpstreamResolution = "remote"
+	}
+	if c.DNS.Server.Listen == "" {
+		c.DNS.Server.Listen = ":53"
+	}
+	if c.DNS.Server.BlockResponse == "" {
+		c.DNS.Server.BlockResponse = "nxdomain"
+	}
+
+	// Destination defaults: keep SmartProxy from reaching internal networks
+	if c.Destinations.Deny == nil {
+		c.Destinations.Deny = []string{
+			"0.0.0.0/8",          // "this" network, reaches localhost
+			"10.0.0.0/8",         // RFC 1918
+			"172.16.0.0/12",      // RFC 1918
+			"192.168.0.0/16",     // RFC 1918
+			"127.0.0.0/8",        // loopback
+			"169.254.0.0/16",     // link-local
+			"169.254.169.254/32", // cloud metadata
+			"::/128",             // unspecified
+			"::1/128",            // loopback
+			"fc00::/7",           // unique local
+			"fe80::/10",          // link-local
+		}
+	}
+
+	// PAC defaults
+	if c.PAC.Path == "" {
+		c.PAC.Path = "/proxy.pac"
+	}
 
 	// Logging defaults
 	if c.Logging.Level == "" {
 		c.Logging.Level = "info"
 	}
-	if c.Logging.Format == "" {
-		c.Logging.Format = "text"
+	if c.Logging.Output == "" {
+		c.Logging.Output = "stdout"
+	}
+	// Sinks inherit only a format that was set explicitly
+	formatSet := c.Logging.Format != ""
+	if !formatSet {
+		c.Logging.Format = defaultLogFormat(c.Logging.Output)
+	}
+	if c.Logging.File.MaxSizeMB == 0 {
+		c.Logging.File.MaxSizeMB = 100
+	}
+	for i := range c.Logging.Sinks {
+		if c.Logging.Sinks[i].Format == "" {
+			if formatSet {
+				c.Logging.Sinks[i].Format = c.Logging.Format
+			} else {
+				c.Logging.Sinks[i].Format = defaultLogFormat(c.Logging.Sinks[i].Output)
+			}
+		}
+		if c.Logging.Sinks[i].File.MaxSizeMB == 0 {
+			c.Logging.Sinks[i].File.MaxSizeMB = 100
+		}
+	}
+
+	// Tracing defaults
+	if c.Tracing.Endpoint == "" {
+		c.Tracing.Endpoint = "localhost:4318"
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = "smartproxy"
+	}
+	if c.Tracing.SampleRatio == nil {
+		ratio := 1.0
+		c.Tracing.SampleRatio = &ratio
 	}
 
 	// Set default extensions if empty
@@ -140,18 +546,21 @@ func (c *Config) SetDefaults() {
 	// Set default CDN domains if empty
 	if len(c.DirectDomains) == 0 {
 		c.DirectDomains = []string{
-			"cdn.", "cdnjs.", "cloudflare.", "googleapis.", "gstatic.",
+			"cdn.*", "cdnjs.com", "cloudflare.com", "googleapis.com", "gstatic.com",
 			"unpkg.com", "jsdelivr.net", "bootstrapcdn.com", "jquery.com",
-			"staticfile.org", "akamai.", "fastly.", "cloudfront.",
+			"staticfile.org", "akamaihd.net", "akamaized.net", "fastly.net", "cloudfront.net",
 		}
 	}
 }
 
-// CreateAdDomainsMap creates a map for O(1) ad domain lookup
-func CreateAdDomainsMap(adDomains []string) map[string]bool {
-	adMap := make(map[string]bool, len(adDomains))
-	for _, domain := range adDomains {
-		adMap[strings.ToLower(domain)] = true
+// defaultLogFormat returns the format of an output without one: colored on
+// the console, as before formats were configurable, and plain text in files
+// and syslog
+func defaultLogFormat(output string) string {
+	switch output {
+	case "", "stdout", "stderr":
+		return "color"
+	default:
+		return "text"
 	}
-	return adMap
 }
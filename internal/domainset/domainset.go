@@ -0,0 +1,324 @@
+package domainset
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Magic number at the start of a set file
+const fileMagic = "SPDSET02"
+
+// Size of the file header: magic, domain count and hash slot count
+const headerSize = len(fileMagic) + 8
+
+// Set is an immutable set of domains stored as one table: a header, the end
+// offset of each domain in sorted order, a 16-bit tag per domain, an open
+// addressing hash index and the domains back to back. Lookups hash the
+// domain and compare it with the table without allocating. The table may be
+// a memory-mapped file.
+type Set struct {
+	table []byte
+	count int
+	slots int    // power of two, 0 for an empty set
+	tags  []byte // within table
+	index []byte // hash slots holding a domain number plus one, within table
+	data  []byte // domains, within table
+	unmap func() error
+}
+
+// Builder collects domains for a Set
+type Builder struct {
+	domains []string
+	tags    []uint16
+}
+
+// Add adds a lowercase domain
+func (b *Builder) Add(domain string) {
+	b.AddTagged(domain, 0)
+}
+
+// AddTagged adds a lowercase domain with a tag, such as the list it came
+// from. A domain added more than once keeps its first tag.
+func (b *Builder) AddTagged(domain string, tag uint16) {
+	b.domains = append(b.domains, domain)
+	b.tags = append(b.tags, tag)
+}
+
+// Build returns the set of the added domains and resets the builder
+func (b *Builder) Build() *Set {
+	order := make([]int, len(b.domains))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(i, j int) int {
+		return strings.Compare(b.domains[i], b.domains[j])
+	})
+	domains := make([]string, 0, len(order))
+	tags := make([]uint16, 0, len(order))
+	for _, i := range order {
+		if len(domains) > 0 && domains[len(domains)-1] == b.domains[i] {
+			continue
+		}
+		domains = append(domains, b.domains[i])
+		tags = append(tags, b.tags[i])
+	}
+	b.domains, b.tags = nil, nil
+
+	// Keep the hash index at most three quarters full
+	slots := 0
+	if len(domains) > 0 {
+		slots = 1
+		for slots*3 < len(domains)*4 {
+			slots <<= 1
+		}
+	}
+
+	tagsStart := headerSize + 4*len(domains)
+	indexStart := tagsStart + tagsSize(len(domains))
+	dataStart := indexStart + 4*slots
+	size := dataStart
+	for _, domain := range domains {
+		size += len(domain)
+	}
+	table := make([]byte, dataStart, size)
+	copy(table, fileMagic)
+	binary.LittleEndian.PutUint32(table[len(fileMagic):], uint32(len(domains)))
+	binary.LittleEndian.PutUint32(table[len(fileMagic)+4:], uint32(slots))
+	index := table[indexStart:dataStart]
+	end := 0
+	for i, domain := range domains {
+		end += len(domain)
+		binary.LittleEndian.PutUint32(table[headerSize+4*i:], uint32(end))
+		binary.LittleEndian.PutUint16(table[tagsStart+2*i:], tags[i])
+		table = append(table, domain...)
+
+		slot := hash(domain) & uint32(slots-1)
+		for binary.LittleEndian.Uint32(index[4*slot:]) != 0 {
+			slot = (slot + 1) & uint32(slots-1)
+		}
+		binary.LittleEndian.PutUint32(index[4*slot:], uint32(i+1))
+	}
+
+	set, _ := newSet(table)
+	return set
+}
+
+// newSet checks a table and returns the set it holds
+func newSet(table []byte) (*Set, error) {
+	if len(table) < headerSize || string(table[:len(fileMagic)]) != fileMagic {
+		return nil, errors.New("not a domain set")
+	}
+	count := int(binary.LittleEndian.Uint32(table[len(fileMagic):]))
+	slots := int(binary.LittleEndian.Uint32(table[len(fileMagic)+4:]))
+	if slots&(slots-1) != 0 || (count > 0) != (slots > count) {
+		return nil, errors.New("corrupt domain set")
+	}
+	tagsStart := headerSize + 4*count
+	indexStart := tagsStart + tagsSize(count)
+	dataStart := indexStart + 4*slots
+	if dataStart > len(table) {
+		return nil, errors.New("truncated domain set")
+	}
+	s := &Set{
+		table: table,
+		count: count,
+		slots: slots,
+		tags:  table[tagsStart:indexStart],
+		index: table[indexStart:dataStart],
+		data:  table[dataStart:],
+	}
+
+	// Offsets must be ordered and end with the data, or lookups could panic
+	previous := 0
+	for i := 0; i < count; i++ {
+		end := s.end(i)
+		if end < previous || end > len(s.data) {
+			return nil, errors.New("corrupt domain set")
+		}
+		previous = end
+	}
+	if previous != len(s.data) {
+		return nil, errors.New("truncated domain set")
+	}
+	// Each domain takes one slot. With more slots than domains, every probe
+	// then ends at an empty one, which lookups rely on to stop.
+	used := 0
+	for slot := 0; slot < slots; slot++ {
+		n := int(binary.LittleEndian.Uint32(s.index[4*slot:]))
+		if n > count {
+			return nil, errors.New("corrupt domain set")
+		}
+		if n != 0 {
+			used++
+		}
+	}
+	if used != count {
+		return nil, errors.New("corrupt domain set")
+	}
+	return s, nil
+}
+
+// Open loads a set written by Bytes. Where supported the file is mapped
+// into memory rather than read, so it stays out of the Go heap.
+func Open(path string) (*Set, error) {
+	table, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSet(table)
+	if err != nil {
+		if unmap != nil {
+			unmap()
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if unmap != nil {
+		s.unmap = unmap
+		runtime.SetFinalizer(s, (*Set).Close)
+	}
+	return s, nil
+}
+
+// Close unmaps a set opened from a file. The set must not be used after.
+func (s *Set) Close() error {
+	if s == nil || s.unmap == nil {
+		return nil
+	}
+	unmap := s.unmap
+	s.unmap = nil
+	s.table, s.tags, s.index, s.data, s.count, s.slots = nil, nil, nil, nil, 0, 0
+	runtime.SetFinalizer(s, nil)
+	return unmap()
+}
+
+// Bytes returns the table, to be written to a file for Open
+func (s *Set) Bytes() []byte {
+	return s.table
+}
+
+// Len returns the number of domains
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.count
+}
+
+// Size returns the size of the table in bytes
+func (s *Set) Size() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.table)
+}
+
+// end returns the end offset of domain i in data
+func (s *Set) end(i int) int {
+	return int(binary.LittleEndian.Uint32(s.table[headerSize+4*i:]))
+}
+
+// domain returns domain i without copying
+func (s *Set) domain(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = s.end(i - 1)
+	}
+	return s.data[start:s.end(i)]
+}
+
+// Contains reports whether domain is in the set
+func (s *Set) Contains(domain string) bool {
+	return s.lookup(domain) >= 0
+}
+
+// Tag returns the tag of a domain in the set
+func (s *Set) Tag(domain string) (uint16, bool) {
+	i := s.lookup(domain)
+	if i < 0 {
+		return 0, false
+	}
+	defer runtime.KeepAlive(s)
+	return binary.LittleEndian.Uint16(s.tags[2*i:]), true
+}
+
+// lookup returns the number of a domain, -1 if it is not in the set
+func (s *Set) lookup(domain string) int {
+	if s == nil || s.slots == 0 {
+		return -1
+	}
+	defer runtime.KeepAlive(s)
+
+	mask := uint32(s.slots - 1)
+	for slot := hash(domain) & mask; ; slot = (slot + 1) & mask {
+		n := binary.LittleEndian.Uint32(s.index[4*slot:])
+		if n == 0 {
+			return -1
+		}
+		if equal(s.domain(int(n-1)), domain) {
+			return int(n - 1)
+		}
+	}
+}
+
+// tagsSize returns the size of the tags of count domains, kept a multiple
+// of four so the hash index stays aligned
+func tagsSize(count int) int {
+	return (2*count + 3) &^ 3
+}
+
+// Match returns the first of host and its parent domains that is in the set
+func (s *Set) Match(host string) (string, bool) {
+	if s == nil || s.count == 0 {
+		return "", false
+	}
+	for {
+		if s.Contains(host) {
+			return host, true
+		}
+		dot := strings.IndexByte(host, '.')
+		if dot < 0 {
+			return "", false
+		}
+		host = host[dot+1:]
+	}
+}
+
+// Range calls fn with each domain in sorted order until fn returns false
+func (s *Set) Range(fn func(domain string) bool) {
+	if s == nil {
+		return
+	}
+	for i := 0; i < s.count; i++ {
+		if !fn(string(s.domain(i))) {
+			break
+		}
+	}
+	runtime.KeepAlive(s)
+}
+
+// equal compares a stored domain with a string without converting either
+func equal(stored []byte, domain string) bool {
+	if len(stored) != len(domain) {
+		return false
+	}
+	for i := 0; i < len(stored); i++ {
+		if stored[i] != domain[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hash is the 32-bit FNV-1a hash of a domain
+func hash(domain string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(domain); i++ {
+		h ^= uint32(domain[i])
+		h *= 16777619
+	}
+	return h
+}
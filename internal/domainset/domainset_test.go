@@ -0,0 +1,417 @@
+package domainset
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSetRoundTrip(t *testing.T) {
+	var builder Builder
+	builder.AddTagged("example.com", 1)
+	builder.AddTagged("ads.example.net", 2)
+	builder.AddTagged("tracker.io", 3)
+	builder.AddTagged("example.com", 4) // keeps the first tag
+	built := builder.Build()
+
+	path := filepath.Join(t.TempDir(), "set")
+	if err := os.WriteFile(path, built.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+
+	for name, set := range map[string]*Set{"built": built, "opened": opened} {
+		if set.Len() != 3 {
+			t.Errorf("%s: Len() = %d, want 3", name, set.Len())
+		}
+		var domains []string
+		set.Range(func(domain string) bool {
+			domains = append(domains, domain)
+			return true
+		})
+		if got := strings.Join(domains, " "); got != "ads.example.net example.com tracker.io" {
+			t.Errorf("%s: Range() = %s, want sorted domains", name, got)
+		}
+
+		matches := []struct {
+			host, domain string
+			tag          uint16
+		}{
+			{"example.com", "example.com", 1},
+			{"www.example.com", "example.com", 1},
+			{"a.b.ads.example.net", "ads.example.net", 2},
+			{"tracker.io", "tracker.io", 3},
+		}
+		for _, m := range matches {
+			domain, ok := set.Match(m.host)
+			if !ok || domain != m.domain {
+				t.Errorf("%s: Match(%q) = %q, %v, want %q", name, m.host, domain, ok, m.domain)
+			}
+			if tag, ok := set.Tag(domain); !ok || tag != m.tag {
+				t.Errorf("%s: Tag(%q) = %d, %v, want %d", name, domain, tag, ok, m.tag)
+			}
+		}
+		for _, host := range []string{"example.net", "com", "notexample.com", "tracker.io.evil", ""} {
+			if domain, ok := set.Match(host); ok {
+				t.Errorf("%s: Match(%q) = %q, want no match", name, host, domain)
+			}
+		}
+		if _, ok := set.Tag("www.example.com"); ok {
+			t.Errorf("%s: Tag of a subdomain found, want exact domains only", name)
+		}
+	}
+}
+
+func TestEmptySet(t *testing.T) {
+	var builder Builder
+	set := builder.Build()
+	if set.Len() != 0 || set.Contains("example.com") {
+		t.Fatal("empty set has domains")
+	}
+	reopened, err := newSet(set.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Match("example.com"); ok {
+		t.Fatal("empty set matched a host")
+	}
+}
+
+func TestCorruptSet(t *testing.T) {
+	var builder Builder
+	builder.Add("example.com")
+	valid := builder.Build().Bytes()
+	slots := int(binary.LittleEndian.Uint32(valid[len(fileMagic)+4:]))
+	indexStart := headerSize + 4 + tagsSize(1)
+
+	corrupt := map[string]func(table []byte) []byte{
+		"magic":     func(table []byte) []byte { table[0] = 'X'; return table },
+		"truncated": func(table []byte) []byte { return table[:len(table)-1] },
+		"offset": func(table []byte) []byte {
+			binary.LittleEndian.PutUint32(table[headerSize:], 100)
+			return table
+		},
+		"slot out of range": func(table []byte) []byte {
+			binary.LittleEndian.PutUint32(table[indexStart:], 2)
+			return table
+		},
+		// Lookups of absent domains would probe forever
+		"no empty slot": func(table []byte) []byte {
+			for slot := 0; slot < slots; slot++ {
+				binary.LittleEndian.PutUint32(table[indexStart+4*slot:], 1)
+			}
+			return table
+		},
+	}
+	for name, change := range corrupt {
+		if _, err := newSet(change(slices.Clone(valid))); err == nil {
+			t.Errorf("%s: corrupt table accepted", name)
+		}
+	}
+}
+
+// Compare the storage of ad domains on the same generated host names:
+//
+//	go test -run '^$' -bench . ./internal/domainset
+//	go test -run '^$' -bench . ./internal/domainset -args -list /etc/hosts.blocklist
+//
+// Each benchmark also reports the heap its storage takes as heap-MiB. Save
+// the output of runs to compare them with benchstat.
+var (
+	benchDomains = flag.Int("domains", 1000000, "number of generated blocked domains")
+	benchList    = flag.String("list", "", "hosts file or domain list to use instead of generated domains")
+	benchQueries = flag.Int("queries", 100000, "number of distinct lookup hosts")
+	benchHits    = flag.Float64("hits", 0.3, "share of lookups that are blocked")
+)
+
+// Top-level domains with rough weights of their share in block lists
+var benchTLDs = []struct {
+	name   string
+	weight int
+}{
+	{"com", 50}, {"net", 12}, {"org", 5}, {"io", 4}, {"info", 3}, {"xyz", 3},
+	{"ru", 3}, {"de", 2}, {"co.uk", 2}, {"com.br", 2}, {"cn", 2}, {"top", 2},
+	{"vn", 2}, {"online", 1}, {"site", 1}, {"jp", 1}, {"fr", 1}, {"tk", 1},
+	{"com.vn", 1}, {"co.jp", 1},
+}
+
+// Labels ad and tracking hosts often start with
+var benchPrefixes = []string{
+	"ads", "ad", "track", "tracker", "pixel", "metrics", "stats", "analytics",
+	"cdn", "static", "img", "beacon", "log", "events", "tag", "sync",
+}
+
+// Labels browsers put in front of blocked domains
+var benchQueryPrefixes = []string{"www", "static", "a1", "cdn", "api", "img", "s", "m"}
+
+// Syllables for pronounceable labels
+var benchSyllables = []string{
+	"ad", "ba", "ce", "di", "fo", "gu", "ha", "ji", "ko", "lu", "ma", "ne", "or",
+	"pi", "qu", "ra", "se", "ti", "um", "ve", "wa", "xo", "yi", "zu", "net",
+	"tra", "ck", "ly", "ify", "hub", "io", "go", "max", "pro",
+}
+
+// benchFixture holds the domains in each storage and the hosts looked up,
+// built once for all benchmarks
+type benchFixture struct {
+	queries []string
+
+	levelMap map[string]bool
+	set      *Set
+	mapped   *Set
+
+	mapBytes, setBytes, mappedBytes uint64
+}
+
+var (
+	benchOnce sync.Once
+	bench     *benchFixture
+	benchErr  error
+	benchDir  string
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+	if bench != nil {
+		bench.mapped.Close()
+	}
+	if benchDir != "" {
+		os.RemoveAll(benchDir)
+	}
+	os.Exit(code)
+}
+
+// loadBenchFixture builds the fixture on first use
+func loadBenchFixture(b *testing.B) *benchFixture {
+	b.Helper()
+	benchOnce.Do(func() { bench, benchErr = newBenchFixture() })
+	if benchErr != nil {
+		b.Fatal(benchErr)
+	}
+	return bench
+}
+
+func newBenchFixture() (*benchFixture, error) {
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	var domains []string
+	if *benchList != "" {
+		var err error
+		if domains, err = readBenchList(*benchList); err != nil {
+			return nil, err
+		}
+	} else {
+		domains = generateDomains(rng, *benchDomains)
+	}
+
+	f := &benchFixture{queries: generateQueries(rng, domains, *benchQueries, *benchHits)}
+	f.mapBytes = heapGrowth(func() {
+		f.levelMap = make(map[string]bool)
+		for _, domain := range domains {
+			// Own the strings, as a map built from parsed lists does
+			f.levelMap[strings.Clone(domain)] = true
+		}
+	})
+	f.setBytes = heapGrowth(func() {
+		var builder Builder
+		for _, domain := range domains {
+			builder.Add(domain)
+		}
+		f.set = builder.Build()
+	})
+
+	var err error
+	if benchDir, err = os.MkdirTemp("", "domainset"); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(benchDir, "ad_domains.set")
+	if err := os.WriteFile(path, f.set.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	f.mappedBytes = heapGrowth(func() { f.mapped, err = Open(path) })
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the domains live so freeing them is not measured as shrinking
+	runtime.KeepAlive(domains)
+	return f, nil
+}
+
+// benchLookups looks up the fixture hosts in turn and reports the heap the
+// storage takes
+func benchLookups(b *testing.B, heap uint64, lookup func(string) bool) {
+	f := loadBenchFixture(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup(f.queries[i%len(f.queries)])
+	}
+	b.ReportMetric(float64(heap)/(1<<20), "heap-MiB")
+}
+
+// BenchmarkMapSplit is the lookup SmartProxy used before parent levels were
+// sliced from the host: split into labels and join each parent
+func BenchmarkMapSplit(b *testing.B) {
+	f := loadBenchFixture(b)
+	benchLookups(b, f.mapBytes, func(host string) bool {
+		if f.levelMap[host] {
+			return true
+		}
+		parts := strings.Split(host, ".")
+		for i := 1; i < len(parts); i++ {
+			if f.levelMap[strings.Join(parts[i:], ".")] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// BenchmarkMap checks the host and its parent domains in a map without
+// allocating
+func BenchmarkMap(b *testing.B) {
+	f := loadBenchFixture(b)
+	benchLookups(b, f.mapBytes, func(host string) bool {
+		for {
+			if f.levelMap[host] {
+				return true
+			}
+			dot := strings.IndexByte(host, '.')
+			if dot < 0 {
+				return false
+			}
+			host = host[dot+1:]
+		}
+	})
+}
+
+// BenchmarkSet matches hosts in a set built in the heap
+func BenchmarkSet(b *testing.B) {
+	f := loadBenchFixture(b)
+	benchLookups(b, f.setBytes, func(host string) bool {
+		_, ok := f.set.Match(host)
+		return ok
+	})
+}
+
+// BenchmarkSetMapped matches hosts in a set mapped from a file
+func BenchmarkSetMapped(b *testing.B) {
+	f := loadBenchFixture(b)
+	benchLookups(b, f.mappedBytes, func(host string) bool {
+		_, ok := f.mapped.Match(host)
+		return ok
+	})
+}
+
+// heapGrowth returns how much the live heap grows while fn runs
+func heapGrowth(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if after.HeapAlloc < before.HeapAlloc {
+		return 0
+	}
+	return after.HeapAlloc - before.HeapAlloc
+}
+
+// generateDomains returns n distinct domains shaped like block list entries
+func generateDomains(rng *rand.Rand, n int) []string {
+	seen := make(map[string]bool, n)
+	domains := make([]string, 0, n)
+	for len(domains) < n {
+		domain := randomDomain(rng)
+		if rng.IntN(10) < 4 {
+			domain = benchPrefixes[rng.IntN(len(benchPrefixes))] + "." + domain
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// generateQueries returns hosts to look up: subdomains of blocked domains
+// for the hit ratio, other hosts for the rest
+func generateQueries(rng *rand.Rand, domains []string, n int, hitRatio float64) []string {
+	queries := make([]string, max(n, 1))
+	for i := range queries {
+		prefix := benchQueryPrefixes[rng.IntN(len(benchQueryPrefixes))]
+		if len(domains) > 0 && rng.Float64() < hitRatio {
+			queries[i] = prefix + "." + domains[rng.IntN(len(domains))]
+		} else {
+			queries[i] = prefix + "." + randomDomain(rng)
+		}
+	}
+	return queries
+}
+
+// randomDomain returns a registrable domain with a pronounceable label
+func randomDomain(rng *rand.Rand) string {
+	var b strings.Builder
+	for n := 2 + rng.IntN(4); n > 0; n-- {
+		b.WriteString(benchSyllables[rng.IntN(len(benchSyllables))])
+	}
+	if rng.IntN(5) == 0 {
+		fmt.Fprintf(&b, "%d", rng.IntN(100))
+	}
+
+	total := 0
+	for _, tld := range benchTLDs {
+		total += tld.weight
+	}
+	pick := rng.IntN(total)
+	for _, tld := range benchTLDs {
+		if pick < tld.weight {
+			b.WriteString("." + tld.name)
+			break
+		}
+		pick -= tld.weight
+	}
+	return b.String()
+}
+
+// readBenchList reads the domains of a hosts file or domain list
+func readBenchList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#!"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		domain := strings.ToLower(fields[len(fields)-1])
+		if strings.Contains(domain, ".") && domain != "0.0.0.0" && domain != "127.0.0.1" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, scanner.Err()
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package domainset
+
+import "os"
+
+// mapFile reads a file where memory mapping is not supported
+func mapFile(path string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(path)
+	return data, nil, err
+}
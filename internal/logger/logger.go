@@ -1,48 +1,195 @@
 package logger
 
 import (
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
 
 	"github.com/MatusOllah/slogcolor"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Supported log formats
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatColor = "color"
+)
+
+// Supported log outputs
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+	OutputFile   = "file"
+	OutputSyslog = "syslog"
 )
 
 // Config represents logging configuration
 type Config struct {
-	Level string `yaml:"level"`
-}
-
-// SetupLogger configures slog with colored output using slogcolor
-func SetupLogger(config *Config) *slog.Logger {
-	// Determine log level from config
-	level := slog.LevelInfo
-	if config != nil && config.Level != "" {
-		switch strings.ToLower(config.Level) {
-		case "debug":
-			level = slog.LevelDebug
-		case "info":
-			level = slog.LevelInfo
-		case "warn", "warning":
-			level = slog.LevelWarn
-		case "error":
-			level = slog.LevelError
+	Level  string       `yaml:"level"`
+	Format string       `yaml:"format"`
+	Output string       `yaml:"output"`
+	File   FileConfig   `yaml:"file"`
+	Syslog SyslogConfig `yaml:"syslog"`
+
+	// Sinks replaces the single output above with several outputs,
+	// each with its own level and format
+	Sinks []SinkConfig `yaml:"sinks"`
+
+	// Unredacted writes passwords and auth material in clear text.
+	// Only meant for short troubleshooting sessions.
+	Unredacted bool `yaml:"unredacted"`
+}
+
+// SinkConfig represents a single log destination
+type SinkConfig struct {
+	Level  string       `yaml:"level"`
+	Format string       `yaml:"format"`
+	Output string       `yaml:"output"`
+	File   FileConfig   `yaml:"file"`
+	Syslog SyslogConfig `yaml:"syslog"`
+}
+
+// FileConfig represents file output with rotation
+type FileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+	MaxBackups int    `yaml:"max_backups"`
+	Compress   bool   `yaml:"compress"`
+}
+
+// SyslogConfig represents syslog output. An empty network and address
+// writes to the local syslog socket, which journald also listens on.
+type SyslogConfig struct {
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+// SetupLogger configures slog with the configured format and outputs
+func SetupLogger(config *Config) (*slog.Logger, error) {
+	if config == nil {
+		config = &Config{}
+	}
+
+	sinks := config.Sinks
+	if len(sinks) == 0 {
+		sinks = []SinkConfig{{
+			Level:  config.Level,
+			Format: config.Format,
+			Output: config.Output,
+			File:   config.File,
+			Syslog: config.Syslog,
+		}}
+	}
+
+	handlers := make([]slog.Handler, 0, len(sinks))
+	for i, sink := range sinks {
+		// Sinks without their own level inherit the top-level one
+		if sink.Level == "" {
+			sink.Level = config.Level
+		}
+		handler, err := newSinkHandler(sink)
+		if err != nil {
+			return nil, fmt.Errorf("log sink %d (%s): %w", i, sink.Output, err)
 		}
+		handlers = append(handlers, handler)
 	}
 
-	opts := &slogcolor.Options{
-		Level:         level,
-		TimeFormat:    "15:04:05.000",
-		SrcFileMode:   slogcolor.ShortFile,
-		SrcFileLength: 0,
-		MsgPrefix:     "",
+	handler := handlers[0]
+	if len(handlers) > 1 {
+		handler = newMultiHandler(handlers...)
 	}
 
-	// Show more detailed source info in debug mode
-	if level == slog.LevelDebug {
-		opts.SrcFileMode = slogcolor.LongFile
+	// Secrets are masked everywhere unless explicitly revealed
+	log := slog.New(NewRedactHandler(handler, config.Unredacted))
+	if config.Unredacted {
+		log.Warn("UNREDACTED LOGGING ENABLED: passwords, upstream credentials and auth headers " +
+			"will be written to logs in clear text. Disable logging.unredacted when troubleshooting is done.")
+	}
+	return log, nil
+}
+
+// ParseLevel converts a level name to a slog level, defaulting to info
+func ParseLevel(name string) slog.Level {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// newSinkHandler creates the handler for a single sink
+func newSinkHandler(sink SinkConfig) (slog.Handler, error) {
+	level := ParseLevel(sink.Level)
+
+	switch strings.ToLower(sink.Output) {
+	case "", OutputStdout:
+		return newFormatHandler(os.Stdout, sink.Format, level, false), nil
+	case OutputStderr:
+		return newFormatHandler(os.Stderr, sink.Format, level, false), nil
+	case OutputFile:
+		if sink.File.Path == "" {
+			return nil, fmt.Errorf("file output requires a path")
+		}
+		writer := &lumberjack.Logger{
+			Filename:   sink.File.Path,
+			MaxSize:    sink.File.MaxSizeMB,
+			MaxAge:     sink.File.MaxAgeDays,
+			MaxBackups: sink.File.MaxBackups,
+			Compress:   sink.File.Compress,
+			LocalTime:  true,
+		}
+		return newFormatHandler(writer, sink.Format, level, false), nil
+	case OutputSyslog:
+		return newSyslogHandler(sink.Syslog, sink.Format, level)
+	default:
+		return nil, fmt.Errorf("unknown log output: %s", sink.Output)
+	}
+}
+
+// newFormatHandler creates a text, JSON or colored handler writing to w.
+// Syslog stamps its own time, so omitTime drops the record time there.
+func newFormatHandler(w io.Writer, format string, level slog.Level, omitTime bool) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level:     level,
+		AddSource: level == slog.LevelDebug,
+	}
+	if omitTime {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
 	}
 
-	handler := slogcolor.NewHandler(os.Stdout, opts)
-	return slog.New(handler)
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts)
+	case FormatColor:
+		colorOpts := &slogcolor.Options{
+			Level:         level,
+			TimeFormat:    "15:04:05.000",
+			SrcFileMode:   slogcolor.ShortFile,
+			SrcFileLength: 0,
+			MsgPrefix:     "",
+		}
+
+		// Show more detailed source info in debug mode
+		if level == slog.LevelDebug {
+			colorOpts.SrcFileMode = slogcolor.LongFile
+		}
+		return slogcolor.NewHandler(w, colorOpts)
+	default:
+		return slog.NewTextHandler(w, opts)
+	}
 }
@@ -0,0 +1,120 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// RedactedValue replaces secrets in log output
+const RedactedValue = "[REDACTED]"
+
+// Secret marks a string that must never reach log output in clear text,
+// such as passwords or raw Proxy-Authorization material
+type Secret string
+
+// LogValue masks the secret so it stays hidden even without the redacting handler
+func (s Secret) LogValue() slog.Value {
+	if s == "" {
+		return slog.StringValue("")
+	}
+	return slog.StringValue(RedactedValue)
+}
+
+// sensitiveKeyParts are attribute key fragments whose string values are masked
+var sensitiveKeyParts = []string{
+	"password",
+	"passwd",
+	"secret",
+	"token",
+	"credential",
+	"authorization",
+	"base64",
+	"cookie",
+}
+
+// sensitiveKeys are attribute keys masked on exact match
+var sensitiveKeys = map[string]bool{
+	"auth":    true,
+	"decoded": true,
+}
+
+// isSensitiveKey reports whether an attribute key names secret material
+func isSensitiveKey(key string) bool {
+	lowerKey := strings.ToLower(key)
+	if sensitiveKeys[lowerKey] {
+		return true
+	}
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(lowerKey, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHandler masks secret attributes before passing records on.
+// With reveal set, Secret values are written in clear text instead.
+type redactHandler struct {
+	inner  slog.Handler
+	reveal bool
+}
+
+// NewRedactHandler wraps a handler so that Secret values and attributes with
+// sensitive keys are masked. reveal disables masking for troubleshooting.
+func NewRedactHandler(inner slog.Handler, reveal bool) slog.Handler {
+	return &redactHandler{inner: inner, reveal: reveal}
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(a))
+		return true
+	})
+	return h.inner.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redactAttr(a)
+	}
+	return &redactHandler{inner: h.inner.WithAttrs(redacted), reveal: h.reveal}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{inner: h.inner.WithGroup(name), reveal: h.reveal}
+}
+
+// redactAttr masks a single attribute, descending into groups
+func (h *redactHandler) redactAttr(a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindLogValuer {
+		if secret, ok := a.Value.Any().(Secret); ok {
+			if h.reveal {
+				return slog.String(a.Key, string(secret))
+			}
+			return slog.Attr{Key: a.Key, Value: secret.LogValue()}
+		}
+	}
+
+	value := a.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = h.redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindString, slog.KindAny:
+		if !h.reveal && isSensitiveKey(a.Key) {
+			return slog.String(a.Key, RedactedValue)
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: value}
+}
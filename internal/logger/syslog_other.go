@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package logger
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+)
+
+// newSyslogHandler reports that syslog is unavailable on this platform
+func newSyslogHandler(config SyslogConfig, format string, level slog.Level) (slog.Handler, error) {
+	return nil, fmt.Errorf("syslog output is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,82 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// syslogHandler formats records with a regular handler and writes each one
+// to syslog with a priority matching the record level
+type syslogHandler struct {
+	inner  slog.Handler
+	writer *syslog.Writer
+	buf    *bytes.Buffer
+	mu     *sync.Mutex
+}
+
+// newSyslogHandler connects to syslog. With an empty network and address
+// this is the local /dev/log socket, which journald also serves.
+func newSyslogHandler(config SyslogConfig, format string, level slog.Level) (slog.Handler, error) {
+	tag := config.Tag
+	if tag == "" {
+		tag = "smartproxy"
+	}
+
+	writer, err := syslog.Dial(config.Network, config.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	// Colors make no sense in syslog
+	if strings.ToLower(format) == FormatColor {
+		format = FormatText
+	}
+
+	buf := &bytes.Buffer{}
+	return &syslogHandler{
+		inner:  newFormatHandler(buf, format, level, true),
+		writer: writer,
+		buf:    buf,
+		mu:     &sync.Mutex{},
+	}, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	line := strings.TrimRight(h.buf.String(), "\n")
+
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.writer.Err(line)
+	case r.Level >= slog.LevelWarn:
+		return h.writer.Warning(line)
+	case r.Level >= slog.LevelInfo:
+		return h.writer.Info(line)
+	default:
+		return h.writer.Debug(line)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithAttrs(attrs), writer: h.writer, buf: h.buf, mu: h.mu}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithGroup(name), writer: h.writer, buf: h.buf, mu: h.mu}
+}
@@ -0,0 +1,531 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/hothuongtin/smartproxy/internal/domainset"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Formats of ad block lists
+const (
+	AdListAuto    = "auto"    // detected from the content
+	AdListHosts   = "hosts"   // 0.0.0.0 example.com
+	AdListDomains = "domains" // one domain per line
+	AdListABP     = "abp"     // Adblock Plus / EasyList network filters
+)
+
+// Party restriction of an ABP filter
+const (
+	abpAnyParty = iota
+	abpThirdParty
+	abpFirstParty
+)
+
+// Host names in hosts files that are not blocked domains
+var hostsFileReserved = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// abpRule is an ABP filter that matches URLs rather than whole domains
+type abpRule struct {
+	pattern    string // lowercase, * and ^ wildcards, implicit * added for missing anchors
+	hostAnchor bool   // || filter, matched from the start of the host or a parent domain
+	party      int
+	literal    string // longest literal part, checked before matching
+	source     uint16 // list the filter came from
+}
+
+// abpRuleSet holds URL filters, indexed by the domain of || filters
+type abpRuleSet struct {
+	byDomain map[string][]*abpRule
+	generic  []*abpRule
+}
+
+// adFilter is the compiled form of the ad domains and ad block lists.
+// Domains are kept in compact sorted tables since lists may hold millions.
+type adFilter struct {
+	blocked     *domainset.Set // domains blocked with their subdomains
+	exceptions  *domainset.Set // @@ domains never blocked, with their subdomains
+	partial     *domainset.Set // domains with URL exceptions, never blocked as a whole
+	rules       abpRuleSet
+	exceptRules abpRuleSet
+	skipped     int // filters with unsupported syntax or options
+
+	// Names of the lists, by the source number of their entries
+	sources []string
+	source  uint16 // list being parsed
+
+	// Domains added by parse until build
+	addBlocked, addExceptions, addPartial domainset.Builder
+}
+
+func newAdFilter() *adFilter {
+	return &adFilter{
+		rules:       abpRuleSet{byDomain: make(map[string][]*abpRule)},
+		exceptRules: abpRuleSet{byDomain: make(map[string][]*abpRule)},
+	}
+}
+
+// build compiles the domains added so far. The filter is used after build.
+func (f *adFilter) build() {
+	f.blocked = f.addBlocked.Build()
+	f.exceptions = f.addExceptions.Build()
+	f.partial = f.addPartial.Build()
+}
+
+// addDomain blocks a domain and its subdomains. It returns false for names
+// that are not domains.
+func (f *adFilter) addDomain(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	domain = strings.TrimPrefix(strings.TrimPrefix(domain, "*."), ".")
+	if !validAdDomain(domain) {
+		return false
+	}
+	f.addBlocked.AddTagged(domain, f.source)
+	return true
+}
+
+// validAdDomain reports whether s looks like a domain name
+func validAdDomain(s string) bool {
+	if s == "" || s[0] == '.' || s[0] == '-' || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parse adds the entries of a list and returns how many were added
+func (f *adFilter) parse(data []byte, format string) int {
+	if format == "" || format == AdListAuto {
+		format = detectAdListFormat(data)
+	}
+
+	added := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var ok bool
+		switch format {
+		case AdListHosts:
+			added += f.addHostsLine(line)
+			continue
+		case AdListABP:
+			ok = f.addABPFilter(line)
+		default:
+			if i := strings.IndexAny(line, "#!"); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+			ok = line != "" && f.addDomain(line)
+		}
+		if ok {
+			added++
+		}
+	}
+	return added
+}
+
+// detectAdListFormat guesses the format of a list from its first entries
+func detectAdListFormat(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[Adblock"), strings.HasPrefix(line, "!"),
+			strings.Contains(line, "||"), strings.HasPrefix(line, "@@"), strings.Contains(line, "^"):
+			return AdListABP
+		}
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			if _, err := netip.ParseAddr(fields[0]); err == nil {
+				return AdListHosts
+			}
+		}
+		return AdListDomains
+	}
+	return AdListDomains
+}
+
+// addHostsLine blocks the names of a hosts file line
+func (f *adFilter) addHostsLine(line string) int {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return 0
+	}
+	if _, err := netip.ParseAddr(fields[0]); err != nil {
+		return 0
+	}
+
+	added := 0
+	for _, name := range fields[1:] {
+		if !hostsFileReserved[strings.ToLower(name)] && f.addDomain(name) {
+			added++
+		}
+	}
+	return added
+}
+
+// addABPFilter adds a network filter. Comments, element hiding filters and
+// filters with unsupported options are skipped.
+func (f *adFilter) addABPFilter(line string) bool {
+	if line == "" || line[0] == '!' || line[0] == '[' {
+		return false
+	}
+	for _, marker := range []string{"##", "#@#", "#?#", "#$#", "#%#"} {
+		if strings.Contains(line, marker) {
+			return false
+		}
+	}
+
+	exception := strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+
+	// Regular expression filters are not supported
+	if len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/' {
+		f.skipped++
+		return false
+	}
+
+	party := abpAnyParty
+	if i := strings.LastIndexByte(line, '$'); i >= 0 {
+		for _, option := range strings.Split(strings.ToLower(line[i+1:]), ",") {
+			switch strings.TrimSpace(option) {
+			case "third-party", "3p", "~first-party", "~1p":
+				party = abpThirdParty
+			case "~third-party", "~3p", "first-party", "1p":
+				party = abpFirstParty
+			case "important", "all", "document", "doc":
+			default:
+				// Content types and page domains are unknown to a proxy;
+				// applying the filter to everything would block too much
+				f.skipped++
+				return false
+			}
+		}
+		line = line[:i]
+	}
+
+	pattern := strings.ToLower(line)
+	hostAnchor := strings.HasPrefix(pattern, "||")
+	startAnchor := !hostAnchor && strings.HasPrefix(pattern, "|")
+	endAnchor := len(pattern) > 1 && strings.HasSuffix(pattern, "|")
+	pattern = strings.TrimPrefix(pattern, "||")
+	pattern = strings.TrimPrefix(pattern, "|")
+	pattern = strings.TrimSuffix(pattern, "|")
+	if strings.Trim(pattern, "*^") == "" {
+		f.skipped++
+		return false
+	}
+
+	// ||example.com^ blocks or excepts a whole domain
+	domain, rest := splitABPDomain(pattern)
+	if hostAnchor && party == abpAnyParty && strings.Contains(domain, ".") && (rest == "" || rest == "^") {
+		if exception {
+			f.addExceptions.Add(domain)
+		} else {
+			f.addBlocked.AddTagged(domain, f.source)
+		}
+		return true
+	}
+
+	rule := &abpRule{hostAnchor: hostAnchor, party: party, literal: abpLiteral(pattern), source: f.source}
+	if !hostAnchor && !startAnchor {
+		pattern = "*" + pattern
+	}
+	if !endAnchor {
+		pattern += "*"
+	}
+	rule.pattern = pattern
+
+	// Index || filters by their domain when it is complete
+	key := ""
+	if hostAnchor && strings.Contains(domain, ".") && (rest == "" || strings.IndexByte("^/:", rest[0]) >= 0) {
+		key = domain
+	}
+	if exception {
+		f.exceptRules.add(key, rule)
+		if key != "" {
+			f.addPartial.Add(key)
+		}
+	} else {
+		f.rules.add(key, rule)
+	}
+	return true
+}
+
+// splitABPDomain splits the leading domain name off a pattern
+func splitABPDomain(pattern string) (string, string) {
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return pattern[:i], pattern[i:]
+		}
+	}
+	return pattern, ""
+}
+
+// abpLiteral returns the longest part of a pattern without wildcards
+func abpLiteral(pattern string) string {
+	longest := ""
+	for _, part := range strings.FieldsFunc(pattern, func(r rune) bool { return r == '*' || r == '^' }) {
+		if len(part) > len(longest) {
+			longest = part
+		}
+	}
+	return longest
+}
+
+func (set *abpRuleSet) add(domain string, rule *abpRule) {
+	if domain == "" {
+		set.generic = append(set.generic, rule)
+		return
+	}
+	set.byDomain[domain] = append(set.byDomain[domain], rule)
+}
+
+// match returns the filter matching the lowercase URL, nil if none does.
+// rest is the URL after the scheme, host its host part.
+func (set *abpRuleSet) match(rawURL, rest, host string, thirdParty bool) *abpRule {
+	for level := host; ; {
+		for _, rule := range set.byDomain[level] {
+			if rule.partyMatches(thirdParty) && abpMatch(rule.pattern, rest[len(host)-len(level):]) {
+				return rule
+			}
+		}
+		dot := strings.IndexByte(level, '.')
+		if dot < 0 {
+			break
+		}
+		level = level[dot+1:]
+	}
+
+	for _, rule := range set.generic {
+		if !rule.partyMatches(thirdParty) || !strings.Contains(rawURL, rule.literal) {
+			continue
+		}
+		if !rule.hostAnchor {
+			if abpMatch(rule.pattern, rawURL) {
+				return rule
+			}
+			continue
+		}
+		// Try the host and each parent domain
+		for i := 0; i <= len(host); i++ {
+			if (i == 0 || host[i-1] == '.') && abpMatch(rule.pattern, rest[i:]) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+func (rule *abpRule) partyMatches(thirdParty bool) bool {
+	switch rule.party {
+	case abpThirdParty:
+		return thirdParty
+	case abpFirstParty:
+		return !thirdParty
+	}
+	return true
+}
+
+// abpMatch matches a whole string against a pattern where * matches any
+// characters and ^ a separator or the end
+func abpMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			c := pattern[p]
+			if c == '*' {
+				star, starI = p, i
+				p++
+				continue
+			}
+			if c == s[i] || c == '^' && abpSeparator(s[i]) {
+				p++
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && (pattern[p] == '*' || pattern[p] == '^') {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// abpSeparator reports whether c matches ^
+func abpSeparator(c byte) bool {
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == '%')
+}
+
+// domainLevels calls fn with host and each parent domain until fn returns true
+func domainLevels(host string, fn func(domain string) bool) bool {
+	for {
+		if fn(host) {
+			return true
+		}
+		dot := strings.IndexByte(host, '.')
+		if dot < 0 {
+			return false
+		}
+		host = host[dot+1:]
+	}
+}
+
+// excepted reports whether an exception keeps the whole host from being
+// blocked
+func (f *adFilter) excepted(host string) bool {
+	_, ok := f.exceptions.Match(host)
+	return ok
+}
+
+// blockedDomain returns the blocked domain matching host and the list it
+// came from, for decisions where only the host is known: CONNECT tunnels and
+// DNS queries
+func (f *adFilter) blockedDomain(host string) (string, string, bool) {
+	if f.excepted(host) {
+		return "", "", false
+	}
+	if _, ok := f.partial.Match(host); ok {
+		return "", "", false
+	}
+	return f.matchBlocked(host)
+}
+
+// matchBlocked returns the blocked domain matching host and its list
+func (f *adFilter) matchBlocked(host string) (string, string, bool) {
+	domain, ok := f.blocked.Match(host)
+	if !ok {
+		return "", "", false
+	}
+	source, _ := f.blocked.Tag(domain)
+	return domain, f.sourceName(source), true
+}
+
+// sourceName returns the name of the list of a source number
+func (f *adFilter) sourceName(source uint16) string {
+	if int(source) < len(f.sources) {
+		return f.sources[source]
+	}
+	return ""
+}
+
+// blocksRequest reports whether a request URL is blocked by a domain or URL
+// filter, with the blocked domain, or the host for URL filters, and the list
+// of the filter. thirdParty tells whether the request comes from another
+// site.
+func (f *adFilter) blocksRequest(host, rawURL string, thirdParty bool) (string, string, bool) {
+	if f.excepted(host) {
+		return "", "", false
+	}
+	lowerURL := strings.ToLower(rawURL)
+	rest := lowerURL
+	if i := strings.Index(rest, "://"); i >= 0 {
+		rest = rest[i+3:]
+	}
+	if !strings.HasPrefix(rest, host) {
+		// Userinfo or an unusual URL; match from the host alone
+		rest = host + "/"
+	}
+
+	if f.exceptRules.match(lowerURL, rest, host, thirdParty) != nil {
+		return "", "", false
+	}
+	if domain, list, ok := f.matchBlocked(host); ok {
+		return domain, list, true
+	}
+	if rule := f.rules.match(lowerURL, rest, host, thirdParty); rule != nil {
+		return host, f.sourceName(rule.source), true
+	}
+	return "", "", false
+}
+
+// isThirdParty reports whether a request to host was made by a page of
+// another site, judged by its Referer
+func isThirdParty(host, referer string) bool {
+	if referer == "" {
+		return false
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	return registrableDomain(strings.ToLower(u.Hostname())) != registrableDomain(host)
+}
+
+// registrableDomain returns the site of a host, such as example.co.uk
+func registrableDomain(host string) string {
+	if site, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return site
+	}
+	return host
+}
+
+// pacDomains returns the blocked domains a PAC file can block on its own:
+// those without exceptions for them or their subdomains
+func (f *adFilter) pacDomains() []string {
+	withExceptions := make(map[string]bool)
+	for _, set := range []*domainset.Set{f.exceptions, f.partial} {
+		set.Range(func(domain string) bool {
+			domainLevels(domain, func(level string) bool {
+				withExceptions[level] = true
+				return false
+			})
+			return true
+		})
+	}
+
+	domains := make([]string, 0, f.blocked.Len())
+	f.blocked.Range(func(domain string) bool {
+		if !withExceptions[domain] && !f.excepted(domain) {
+			domains = append(domains, domain)
+		}
+		return true
+	})
+	return domains
+}
+
+// size returns the number of domain and URL filters
+func (f *adFilter) size() (domains, urlFilters int) {
+	urlFilters = len(f.rules.generic) + len(f.exceptRules.generic)
+	for _, rules := range f.rules.byDomain {
+		urlFilters += len(rules)
+	}
+	for _, rules := range f.exceptRules.byDomain {
+		urlFilters += len(rules)
+	}
+	return f.blocked.Len() + f.exceptions.Len(), urlFilters
+}
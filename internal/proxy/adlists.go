@@ -0,0 +1,436 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hothuongtin/smartproxy/internal/domainset"
+)
+
+// Subscription refresh interval used when none is configured
+const defaultAdListRefresh = 24 * time.Hour
+
+// Failed subscription downloads are retried after this long
+const adListRetryInterval = 15 * time.Minute
+
+// How often subscriptions are checked for a due refresh
+const adListCheckInterval = time.Minute
+
+// Largest subscription accepted
+const adListMaxSize = 64 << 20
+
+// List name of the ad domains file in statistics
+const adDomainsSource = "domains_file"
+
+// File in the cache directory the blocked domains are mapped from
+const adDomainsTableFile = "ad_domains.set"
+
+// AdBlockConfig contains the ad domains, block lists and the exceptions to
+// them
+type AdBlockConfig struct {
+	Domains   []string // from the ad domains file
+	Lists     []AdListConfig
+	CacheDir  string   // last known good copies of subscriptions
+	Allowlist []string // domain patterns never blocked
+	Policies  []AdPolicy
+
+	// How blocked requests are answered: status (default), page, gif,
+	// empty or reset. Tunnels get 403 unless reset.
+	BlockResponse string
+	BlockStatus   int // default 204, 403 for the page
+}
+
+// AdListConfig is a block list read from a file or subscribed to by URL
+type AdListConfig struct {
+	Path    string
+	URL     string
+	Format  string        // auto (default), hosts, domains or abp
+	Refresh time.Duration // subscription refresh interval, default 24h
+}
+
+// adListSource is the current content of a block list
+type adListSource struct {
+	config       AdListConfig
+	data         []byte
+	etag         string
+	lastModified string
+	next         time.Time // next subscription refresh
+}
+
+// adListCacheMeta is stored next to a cached subscription
+type adListCacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// adLists holds the sources of the current filter and refreshes
+// subscriptions until stopped
+type adLists struct {
+	config   *AdBlockConfig
+	policies *adPolicies
+	logger   *slog.Logger
+	mu       sync.Mutex
+	sources  []*adListSource
+	stop     chan struct{}
+}
+
+// Global ad blocking state, replaced on config reload
+var (
+	adFilterMutex   sync.RWMutex
+	currentAdFilter *adFilter
+	currentAdLists  *adLists
+
+	// adListClient downloads subscriptions
+	adListClient = &http.Client{Timeout: 2 * time.Minute}
+)
+
+// SetAdBlockConfig loads the ad domains and block lists and starts refreshing
+// subscriptions. Subscriptions start from their cached copy, if any, and are
+// downloaded in the background. On error the current lists stay in place.
+func SetAdBlockConfig(config *AdBlockConfig, logger *slog.Logger) error {
+	var lists *adLists
+	if config != nil {
+		policies, err := compileAdPolicies(config)
+		if err != nil {
+			return err
+		}
+		lists = &adLists{config: config, policies: policies, logger: logger, stop: make(chan struct{})}
+		adFilterMutex.RLock()
+		previous := currentAdLists
+		adFilterMutex.RUnlock()
+
+		for i, list := range config.Lists {
+			source, err := lists.open(list, previous)
+			if err != nil {
+				return fmt.Errorf("ad_blocking list #%d: %w", i+1, err)
+			}
+			lists.sources = append(lists.sources, source)
+		}
+	}
+
+	adFilterMutex.Lock()
+	if currentAdLists != nil {
+		close(currentAdLists.stop)
+	}
+	currentAdLists = lists
+	adFilterMutex.Unlock()
+
+	if lists == nil {
+		adFilterMutex.Lock()
+		currentAdFilter = nil
+		adFilterMutex.Unlock()
+		return nil
+	}
+	lists.rebuild()
+	go lists.refreshLoop()
+	return nil
+}
+
+// open validates a list and reads its content: the file, or the copy of a
+// subscription from the previous configuration or the cache directory
+func (l *adLists) open(list AdListConfig, previous *adLists) (*adListSource, error) {
+	switch list.Format {
+	case "", AdListAuto, AdListHosts, AdListDomains, AdListABP:
+	default:
+		return nil, fmt.Errorf("unknown format %q", list.Format)
+	}
+	if list.Refresh <= 0 {
+		list.Refresh = defaultAdListRefresh
+	}
+	source := &adListSource{config: list}
+
+	switch {
+	case (list.Path == "") == (list.URL == ""):
+		return nil, errors.New("set either path or url")
+	case list.Path != "":
+		data, err := os.ReadFile(list.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ad list: %w", err)
+		}
+		source.data = data
+		return source, nil
+	}
+
+	u, err := url.Parse(list.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid subscription url %q", list.URL)
+	}
+
+	// Keep the content downloaded before a reload
+	if previous != nil {
+		previous.mu.Lock()
+		defer previous.mu.Unlock()
+		for _, old := range previous.sources {
+			if old.config.URL == list.URL && old.data != nil {
+				source.data, source.etag, source.lastModified = old.data, old.etag, old.lastModified
+				source.next = old.next
+				return source, nil
+			}
+		}
+	}
+
+	source.next = time.Now()
+	if l.config.CacheDir == "" {
+		return source, nil
+	}
+	dataPath, metaPath := l.cachePaths(list.URL)
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return source, nil
+	}
+	var meta adListCacheMeta
+	if metaData, err := os.ReadFile(metaPath); err == nil && json.Unmarshal(metaData, &meta) == nil && meta.URL == list.URL {
+		source.etag, source.lastModified = meta.ETag, meta.LastModified
+	}
+	source.data = data
+	if info, err := os.Stat(dataPath); err == nil {
+		source.next = info.ModTime().Add(list.Refresh)
+	}
+	l.logger.Debug("Loaded cached ad list", "url", list.URL, "bytes", len(data))
+	return source, nil
+}
+
+// cachePaths returns the cache files of a subscription
+func (l *adLists) cachePaths(rawURL string) (string, string) {
+	sum := sha256.Sum256([]byte(rawURL))
+	name := hex.EncodeToString(sum[:8])
+	return filepath.Join(l.config.CacheDir, name+".txt"), filepath.Join(l.config.CacheDir, name+".json")
+}
+
+// rebuild compiles the domains and every list into a new filter
+func (l *adLists) rebuild() {
+	filter := newAdFilter()
+	filter.sources = append(filter.sources, adDomainsSource)
+	for _, domain := range l.config.Domains {
+		filter.addDomain(domain)
+	}
+
+	l.mu.Lock()
+	for i, source := range l.sources {
+		name := source.config.URL
+		if name == "" {
+			name = source.config.Path
+		}
+		filter.sources = append(filter.sources, name)
+		filter.source = uint16(i + 1)
+		if source.data != nil {
+			filter.parse(source.data, source.config.Format)
+		}
+	}
+	l.mu.Unlock()
+	filter.build()
+	l.mapBlockedDomains(filter)
+
+	adFilterMutex.Lock()
+	if currentAdLists != l {
+		// Replaced by a reload meanwhile
+		adFilterMutex.Unlock()
+		return
+	}
+	currentAdFilter = filter
+	adFilterMutex.Unlock()
+
+	domains, urlFilters := filter.size()
+	l.logger.Info("Loaded ad block lists",
+		"lists", len(l.sources),
+		"domains", domains,
+		"url_filters", urlFilters,
+		"skipped_filters", filter.skipped,
+		"domain_table_bytes", filter.blocked.Size())
+
+	// The PAC file lists the blocked domains
+	regeneratePAC()
+}
+
+// mapBlockedDomains moves the blocked domains of a filter out of the heap
+// into a memory-mapped file in the cache directory, if there is one
+func (l *adLists) mapBlockedDomains(filter *adFilter) {
+	if l.config.CacheDir == "" || filter.blocked.Len() == 0 {
+		return
+	}
+	path := filepath.Join(l.config.CacheDir, adDomainsTableFile)
+	if err := writeFileAtomic(path, filter.blocked.Bytes()); err != nil {
+		l.logger.Warn("Failed to write ad domains table", "path", path, "error", err)
+		return
+	}
+	mapped, err := domainset.Open(path)
+	if err != nil {
+		l.logger.Warn("Failed to map ad domains table", "path", path, "error", err)
+		return
+	}
+	filter.blocked = mapped
+}
+
+// refreshLoop downloads subscriptions when due until the lists are replaced
+func (l *adLists) refreshLoop() {
+	ticker := time.NewTicker(adListCheckInterval)
+	defer ticker.Stop()
+	for {
+		changed := false
+		for _, source := range l.sources {
+			if source.config.URL != "" && !time.Now().Before(source.next) && l.refresh(source) {
+				changed = true
+			}
+		}
+		if changed {
+			l.rebuild()
+		}
+
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh downloads a subscription and reports whether its content changed.
+// On failure the last known good content is kept.
+func (l *adLists) refresh(source *adListSource) bool {
+	l.mu.Lock()
+	etag, lastModified := source.etag, source.lastModified
+	l.mu.Unlock()
+
+	data, newETag, newLastModified, err := fetchAdList(source.config.URL, etag, lastModified)
+	if err == nil && data != nil && newAdFilter().parse(data, source.config.Format) == 0 {
+		err = errors.New("no filters in list")
+	}
+	if err != nil {
+		l.logger.Warn("Failed to refresh ad list, keeping last known good copy",
+			"url", source.config.URL,
+			"error", err)
+		l.mu.Lock()
+		source.next = time.Now().Add(adListRetryInterval)
+		l.mu.Unlock()
+		return false
+	}
+
+	l.mu.Lock()
+	source.next = time.Now().Add(source.config.Refresh)
+	l.mu.Unlock()
+
+	dataPath, metaPath := l.cachePaths(source.config.URL)
+	if data == nil {
+		l.logger.Debug("Ad list not modified", "url", source.config.URL)
+		if l.config.CacheDir != "" {
+			now := time.Now()
+			os.Chtimes(dataPath, now, now)
+		}
+		return false
+	}
+
+	l.mu.Lock()
+	source.data, source.etag, source.lastModified = data, newETag, newLastModified
+	l.mu.Unlock()
+	l.logger.Info("Downloaded ad list", "url", source.config.URL, "bytes", len(data))
+
+	if l.config.CacheDir != "" {
+		meta, _ := json.Marshal(adListCacheMeta{URL: source.config.URL, ETag: newETag, LastModified: newLastModified})
+		if err := writeFileAtomic(dataPath, data); err != nil {
+			l.logger.Warn("Failed to cache ad list", "url", source.config.URL, "error", err)
+		} else if err := writeFileAtomic(metaPath, meta); err != nil {
+			l.logger.Warn("Failed to cache ad list", "url", source.config.URL, "error", err)
+		}
+	}
+	return true
+}
+
+// fetchAdList downloads a subscription. It returns nil data if the list was
+// not modified since the given ETag or date.
+func fetchAdList(rawURL, etag, lastModified string) ([]byte, string, string, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("User-Agent", "SmartProxy")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := adListClient.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, lastModified, nil
+	case http.StatusOK:
+	default:
+		return nil, "", "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, adListMaxSize+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(data) > adListMaxSize {
+		return nil, "", "", errors.New("list too large")
+	}
+	return data, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+// writeFileAtomic replaces a file so readers never see partial content
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicMode(path, data, 0o644)
+}
+
+// writeFileAtomicMode is writeFileAtomic with the given permissions
+func writeFileAtomicMode(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadAdFilter returns the ad filter, nil if ad blocking has no lists
+func loadAdFilter() *adFilter {
+	adFilterMutex.RLock()
+	defer adFilterMutex.RUnlock()
+	return currentAdFilter
+}
+
+// loadAdPolicies returns the allowlist and client policies, nil if ad
+// blocking has no lists
+func loadAdPolicies() *adPolicies {
+	adFilterMutex.RLock()
+	defer adFilterMutex.RUnlock()
+	if currentAdLists == nil {
+		return nil
+	}
+	return currentAdLists.policies
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// AdPolicy changes ad blocking for matching clients. All conditions set must
+// match; the first matching policy applies.
+type AdPolicy struct {
+	Name      string
+	Users     []string // upstream account usernames from the credentials
+	ClientIPs []string // IPs or CIDRs
+	Disabled  bool     // no ad blocking for these clients
+	Allowlist []string // domain patterns never blocked
+	Block     []string // domain patterns blocked in addition to the lists
+
+	// How blocked requests are answered, default from AdBlockConfig
+	BlockResponse string
+	BlockStatus   int
+}
+
+// adPolicy is the compiled form of AdPolicy
+type adPolicy struct {
+	name       string
+	users      map[string]bool
+	clientNets []netip.Prefix
+	disabled   bool
+	allow      *domainMatcher
+	block      *domainMatcher
+	decision   RouteDecision
+}
+
+// adPolicies holds the global allowlist, the client policies and the
+// decision for blocked requests of other clients
+type adPolicies struct {
+	allow    *domainMatcher
+	policies []adPolicy
+	decision RouteDecision
+}
+
+// compileAdPolicies validates the allowlist, policies and block responses
+func compileAdPolicies(config *AdBlockConfig) (*adPolicies, error) {
+	compiled := &adPolicies{}
+	var err error
+	if compiled.decision, err = adBlockDecision(config.BlockResponse, config.BlockStatus); err != nil {
+		return nil, fmt.Errorf("ad_blocking: %w", err)
+	}
+	if compiled.allow, err = compileAdDomains(config.Allowlist); err != nil {
+		return nil, fmt.Errorf("ad_blocking allowlist: %w", err)
+	}
+
+	for i, policy := range config.Policies {
+		name := policy.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		p := adPolicy{name: name, disabled: policy.Disabled, decision: compiled.decision}
+		if len(policy.Users) == 0 && len(policy.ClientIPs) == 0 {
+			return nil, fmt.Errorf("ad_blocking policy %s: needs users or client_ips", name)
+		}
+		if len(policy.Users) > 0 {
+			p.users = make(map[string]bool, len(policy.Users))
+			for _, user := range policy.Users {
+				p.users[user] = true
+			}
+		}
+		if p.clientNets, err = parsePrefixes(policy.ClientIPs); err != nil {
+			return nil, fmt.Errorf("ad_blocking policy %s: %w", name, err)
+		}
+		if p.allow, err = compileAdDomains(policy.Allowlist); err != nil {
+			return nil, fmt.Errorf("ad_blocking policy %s allowlist: %w", name, err)
+		}
+		if p.block, err = compileAdDomains(policy.Block); err != nil {
+			return nil, fmt.Errorf("ad_blocking policy %s block: %w", name, err)
+		}
+		if policy.BlockResponse != "" || policy.BlockStatus != 0 {
+			if p.decision, err = adBlockDecision(policy.BlockResponse, policy.BlockStatus); err != nil {
+				return nil, fmt.Errorf("ad_blocking policy %s: %w", name, err)
+			}
+		}
+		compiled.policies = append(compiled.policies, p)
+	}
+	return compiled, nil
+}
+
+// adBlockDecision returns the decision for blocked ads
+func adBlockDecision(response string, status int) (RouteDecision, error) {
+	response, status, err := parseBlockResponse(response, status)
+	if err != nil {
+		return RouteDecision{}, err
+	}
+	return RouteDecision{Action: ActionBlock, Rule: ruleAdDomain, Status: status, BlockResponse: response}, nil
+}
+
+// compileAdDomains compiles domain patterns, nil if there are none
+func compileAdDomains(patterns []string) (*domainMatcher, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	return newDomainMatcher(patterns)
+}
+
+// policyFor returns the policy of a client, nil if none matches
+func (ap *adPolicies) policyFor(rr *RouteRequest) *adPolicy {
+	if ap == nil {
+		return nil
+	}
+	for i := range ap.policies {
+		p := &ap.policies[i]
+		if p.users != nil && (rr.Upstream == nil || !p.users[rr.Upstream.Username]) {
+			continue
+		}
+		if len(p.clientNets) > 0 && (!rr.ClientIP.IsValid() || !containsAddr(p.clientNets, rr.ClientIP)) {
+			continue
+		}
+		return p
+	}
+	return nil
+}
+
+// blockDecision returns the decision for an ad blocked under a policy
+func (ap *adPolicies) blockDecision(p *adPolicy) RouteDecision {
+	switch {
+	case p != nil:
+		return p.decision
+	case ap != nil:
+		return ap.decision
+	}
+	decision, _ := adBlockDecision("", 0)
+	return decision
+}
+
+// allowed returns the allowlist pattern exempting a host for a policy
+func (ap *adPolicies) allowed(p *adPolicy, host string) (string, bool) {
+	if ap != nil {
+		if pattern, ok := ap.allow.match(host); ok {
+			return pattern, true
+		}
+	}
+	if p != nil {
+		return p.allow.match(host)
+	}
+	return "", false
+}
+
+// pacExceptions returns the allowlisted domains a PAC file must not block,
+// and false if the PAC file cannot block ads on its own because clients are
+// treated differently or allowlist patterns cannot be mirrored
+func (ap *adPolicies) pacExceptions() ([]string, bool) {
+	if ap == nil {
+		return nil, true
+	}
+	if len(ap.policies) > 0 {
+		return nil, false
+	}
+	exact, suffix, wildcard, firstLabels, keywords := ap.allow.domainSets()
+	if len(firstLabels) > 0 || len(keywords) > 0 {
+		return nil, false
+	}
+	domains := append(append(exact, suffix...), wildcard...)
+	return domains, true
+}
@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultAdStatsPath is where ad blocking statistics are served when no path
+// is configured
+const DefaultAdStatsPath = "/adblock/stats"
+
+// Statistics are saved this often when no interval is configured
+const defaultAdStatsSaveInterval = 5 * time.Minute
+
+// Estimated size of a blocked ad response when none is configured
+const defaultAdStatsBytesPerBlock = 20 << 10
+
+// Most domains, lists and clients counted separately; others are counted
+// together under adStatsOther
+const adStatsMaxKeys = 10000
+
+// Key counting domains, lists and clients beyond adStatsMaxKeys
+const adStatsOther = "(other)"
+
+// Entries per table returned by the API unless ?limit= is given
+const defaultAdStatsLimit = 100
+
+// Kinds of blocks counted
+const (
+	adStatsBlock = iota // HTTP request or tunnel
+	adStatsQuery        // DNS query
+)
+
+// AdStatsConfig controls ad blocking statistics
+type AdStatsConfig struct {
+	Path          string        // API path, DefaultAdStatsPath if empty
+	File          string        // counters kept across restarts, empty to keep them in memory
+	SaveInterval  time.Duration // how often the file is written
+	BytesPerBlock int64         // estimated size of a blocked response
+	Allow         []string      // client IPs or CIDRs allowed to read the API, none if empty
+}
+
+// adStatsData holds the counters, as saved to the file
+type adStatsData struct {
+	Since      time.Time         `json:"since"`
+	Requests   uint64            `json:"blocked_requests"`
+	Tunnels    uint64            `json:"blocked_tunnels"`
+	Queries    uint64            `json:"blocked_dns_queries"`
+	BytesSaved uint64            `json:"estimated_bytes_saved"`
+	Domains    map[string]uint64 `json:"domains"`
+	Lists      map[string]uint64 `json:"lists"`
+	Clients    map[string]uint64 `json:"clients"`
+}
+
+// adStats counts blocks and saves the counters until stopped
+type adStats struct {
+	config *AdStatsConfig
+	allow  []netip.Prefix // clients allowed to read the API
+	logger *slog.Logger
+	mu     sync.Mutex
+	data   adStatsData
+	dirty  bool // changed since the last save
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// adStatsEntry is a counter in API responses
+type adStatsEntry struct {
+	Name string `json:"name"`
+	Hits uint64 `json:"hits"`
+}
+
+// adStatsResponse is the API response
+type adStatsResponse struct {
+	Since      time.Time      `json:"since"`
+	Requests   uint64         `json:"blocked_requests"`
+	Tunnels    uint64         `json:"blocked_tunnels"`
+	Queries    uint64         `json:"blocked_dns_queries"`
+	BytesSaved uint64         `json:"estimated_bytes_saved"`
+	Domains    []adStatsEntry `json:"domains"`
+	Lists      []adStatsEntry `json:"lists"`
+	Clients    []adStatsEntry `json:"clients"`
+}
+
+// Global statistics state, replaced on config reload
+var (
+	adStatsMutex   sync.RWMutex
+	currentAdStats *adStats
+)
+
+// SetAdStatsConfig starts or stops ad blocking statistics. Counters are read
+// from the file when it changes and kept across reloads otherwise. On error
+// the current statistics stay in place.
+func SetAdStatsConfig(config *AdStatsConfig, logger *slog.Logger) error {
+	adStatsMutex.RLock()
+	previous := currentAdStats
+	adStatsMutex.RUnlock()
+
+	var stats *adStats
+	if config != nil {
+		allow, err := parsePrefixes(config.Allow)
+		if err != nil {
+			return fmt.Errorf("invalid ad stats allow entry: %w", err)
+		}
+		stats = &adStats{config: config, allow: allow, logger: logger, stop: make(chan struct{}), done: make(chan struct{})}
+		if previous != nil && previous.config.File == config.File {
+			// Copy the counters, the previous statistics keep using theirs
+			// until stopped
+			previous.mu.Lock()
+			stats.data = previous.data
+			stats.data.Domains = maps.Clone(previous.data.Domains)
+			stats.data.Lists = maps.Clone(previous.data.Lists)
+			stats.data.Clients = maps.Clone(previous.data.Clients)
+			stats.dirty = previous.dirty
+			previous.dirty = false // saved by the new statistics
+			previous.mu.Unlock()
+		} else {
+			data, err := loadAdStats(config.File)
+			if err != nil {
+				return err
+			}
+			stats.data = data
+		}
+	}
+
+	adStatsMutex.Lock()
+	currentAdStats = stats
+	adStatsMutex.Unlock()
+
+	// Counts recorded meanwhile by the previous statistics are saved by it
+	if previous != nil {
+		previous.close()
+	}
+	if stats != nil {
+		go stats.saveLoop()
+	}
+	return nil
+}
+
+// loadAdStats reads saved counters, starting afresh if there are none
+func loadAdStats(path string) (adStatsData, error) {
+	data := adStatsData{Since: time.Now().UTC()}
+	if path != "" {
+		content, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return data, fmt.Errorf("failed to read ad stats: %w", err)
+		default:
+			if err := json.Unmarshal(content, &data); err != nil {
+				return data, fmt.Errorf("invalid ad stats file %s: %w", path, err)
+			}
+		}
+	}
+	for _, counts := range []*map[string]uint64{&data.Domains, &data.Lists, &data.Clients} {
+		if *counts == nil {
+			*counts = make(map[string]uint64)
+		}
+	}
+	return data, nil
+}
+
+// recordAdStats counts a blocked request, tunnel or DNS query
+func recordAdStats(rr *RouteRequest, match adMatch, kind int) {
+	adStatsMutex.RLock()
+	stats := currentAdStats
+	adStatsMutex.RUnlock()
+	if stats == nil {
+		return
+	}
+
+	client := "unknown"
+	if rr.ClientIP.IsValid() {
+		client = rr.ClientIP.String()
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	switch {
+	case kind == adStatsQuery:
+		stats.data.Queries++
+	case rr.Connect:
+		stats.data.Tunnels++
+	default:
+		stats.data.Requests++
+	}
+	// A blocked DNS query may save a connection, but not knowingly any bytes
+	if kind == adStatsBlock {
+		stats.data.BytesSaved += uint64(stats.bytesPerBlock())
+	}
+	addAdStatsCount(stats.data.Domains, match.domain)
+	addAdStatsCount(stats.data.Lists, match.list)
+	addAdStatsCount(stats.data.Clients, client)
+	stats.dirty = true
+}
+
+// addAdStatsCount increments a counter, keeping the number of keys bounded
+func addAdStatsCount(counts map[string]uint64, key string) {
+	if key == "" {
+		return
+	}
+	if _, ok := counts[key]; !ok && len(counts) >= adStatsMaxKeys {
+		key = adStatsOther
+	}
+	counts[key]++
+}
+
+func (s *adStats) bytesPerBlock() int64 {
+	if s.config.BytesPerBlock > 0 {
+		return s.config.BytesPerBlock
+	}
+	return defaultAdStatsBytesPerBlock
+}
+
+// saveLoop writes the counters to the file until stopped, and once more
+// when stopped
+func (s *adStats) saveLoop() {
+	defer close(s.done)
+	interval := s.config.SaveInterval
+	if interval <= 0 {
+		interval = defaultAdStatsSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.save()
+			return
+		case <-ticker.C:
+			s.save()
+		}
+	}
+}
+
+// save writes the counters to the file if they changed
+func (s *adStats) save() {
+	if s.config.File == "" {
+		return
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+	content, err := json.Marshal(s.data)
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(s.config.File, content)
+	}
+	if err != nil {
+		s.logger.Warn("Failed to save ad stats", "file", s.config.File, "error", err)
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+}
+
+// close stops saving after a last save
+func (s *adStats) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// SaveAdStats writes the ad blocking statistics to their file, for shutdown
+func SaveAdStats() {
+	adStatsMutex.RLock()
+	stats := currentAdStats
+	adStatsMutex.RUnlock()
+	if stats != nil {
+		stats.save()
+	}
+}
+
+// adStatsRequest reports whether r asks for the ad blocking statistics
+func adStatsRequest(r *http.Request) (*adStats, bool) {
+	adStatsMutex.RLock()
+	stats := currentAdStats
+	adStatsMutex.RUnlock()
+	// The API is not served until clients are allowed to read it
+	if stats == nil || len(stats.allow) == 0 {
+		return nil, false
+	}
+	path := stats.config.Path
+	if path == "" {
+		path = DefaultAdStatsPath
+	}
+	return stats, r.URL.Path == path
+}
+
+// serveAdStats writes the counters as JSON, the largest first. ?limit=n
+// limits each table to n entries, 0 for all.
+func (s *Server) serveAdStats(w http.ResponseWriter, r *http.Request, stats *adStats) {
+	// The counters name clients by IP, so only allowed clients read them
+	if !containsAddr(stats.allow, remoteAddrIP(r.RemoteAddr)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultAdStatsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	s.logger.Debug("Serving ad stats", "remote_addr", r.RemoteAddr)
+
+	stats.mu.Lock()
+	resp := adStatsResponse{
+		Since:      stats.data.Since,
+		Requests:   stats.data.Requests,
+		Tunnels:    stats.data.Tunnels,
+		Queries:    stats.data.Queries,
+		BytesSaved: stats.data.BytesSaved,
+		Domains:    topAdStats(stats.data.Domains, limit),
+		Lists:      topAdStats(stats.data.Lists, limit),
+		Clients:    topAdStats(stats.data.Clients, limit),
+	}
+	stats.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(resp)
+}
+
+// topAdStats returns the largest counters, at most limit unless it is 0
+func topAdStats(counts map[string]uint64, limit int) []adStatsEntry {
+	entries := make([]adStatsEntry, 0, len(counts))
+	for name, hits := range counts {
+		entries = append(entries, adStatsEntry{Name: name, Hits: hits})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hits != entries[j].Hits {
+			return entries[i].Hits > entries[j].Hits
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
@@ -1,10 +1,15 @@
 package proxy
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
 	"strings"
+
+	applog "github.com/hothuongtin/smartproxy/internal/logger"
 )
 
 // UpstreamInfo holds parsed upstream configuration
@@ -14,6 +19,54 @@ type UpstreamInfo struct {
 	Username string
 	Password string
 	Type     string // http or socks5
+
+	// CredentialID fingerprints the Proxy-Authorization the client sent
+	CredentialID string
+
+	// Named upstreams come from the configuration and may use addresses
+	// in the destination deny list; client-supplied ones may not
+	Named bool
+}
+
+// upstreamContextKey stores the authenticated upstream in a request context
+type upstreamContextKey struct{}
+
+// withUpstream returns the request with the upstream attached to its context
+func withUpstream(r *http.Request, upstream *UpstreamInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), upstreamContextKey{}, upstream))
+}
+
+// upstreamFromRequest returns the upstream attached by withUpstream, if any
+func upstreamFromRequest(r *http.Request) *UpstreamInfo {
+	if r == nil {
+		return nil
+	}
+	upstream, _ := r.Context().Value(upstreamContextKey{}).(*UpstreamInfo)
+	return upstream
+}
+
+// ClientID identifies the client by the upstream account it authenticated
+// with, as [user@]host:port. The password is never part of the ID.
+func (u *UpstreamInfo) ClientID() string {
+	addr := net.JoinHostPort(u.Host, u.Port)
+	if u.Username != "" {
+		return u.Username + "@" + addr
+	}
+	return addr
+}
+
+// LogValue renders upstream info for logs with the credentials masked
+func (u *UpstreamInfo) LogValue() slog.Value {
+	if u == nil {
+		return slog.StringValue("<nil>")
+	}
+	return slog.GroupValue(
+		slog.String("type", u.Type),
+		slog.String("host", u.Host),
+		slog.String("port", u.Port),
+		slog.Any("username", applog.Secret(u.Username)),
+		slog.Any("password", applog.Secret(u.Password)),
+	)
 }
 
 // Helper functions
@@ -36,17 +89,15 @@ func ParseUpstreamFromAuth(username, password string, logger *slog.Logger) (*Ups
 	logger.Debug("Parsing upstream from authentication",
 		"username", username,
 		"password_length", len(password),
-		"password_first_20", password[:min(20, len(password))],
-		"password_last_20", password[max(0, len(password)-20):])
+		"password", applog.Secret(password))
 
 	// Check for any trailing whitespace or special characters
 	if len(password) > 0 {
 		lastChar := password[len(password)-1]
 		logger.Debug("Password details",
-			"last_char_byte", lastChar,
-			"last_char_printable", string(lastChar),
+			"last_char", applog.Secret(string(lastChar)),
 			"is_whitespace", lastChar == ' ' || lastChar == '\t' || lastChar == '\n' || lastChar == '\r',
-			"full_password", fmt.Sprintf("%q", password)) // %q shows escaped chars
+			"full_password", applog.Secret(fmt.Sprintf("%q", password))) // %q shows escaped chars
 	}
 
 	// Username is the schema (http or socks5)
@@ -69,15 +120,12 @@ func ParseUpstreamFromAuth(username, password string, logger *slog.Logger) (*Ups
 	if err != nil {
 		logger.Debug("Failed to decode base64 password",
 			"error", err,
-			"password", password,
-			"password_bytes", []byte(password))
+			"password", applog.Secret(password))
 
 		// Try to identify the problematic character
 		if len(password) >= 72 {
 			logger.Debug("Character at position 72",
-				"char", password[71],
-				"char_byte", password[71],
-				"char_printable", string(password[71]))
+				"char_printable", applog.Secret(string(password[71])))
 		}
 
 		return nil, fmt.Errorf("failed to decode password: %w", err)
@@ -85,14 +133,14 @@ func ParseUpstreamFromAuth(username, password string, logger *slog.Logger) (*Ups
 
 	decodedStr := string(decoded)
 	logger.Debug("Decoded upstream configuration",
-		"decoded", decodedStr,
+		"decoded", applog.Secret(decodedStr),
 		"schema", schema)
 
 	// Parse decoded string
 	// Format: host:port or host:port:username:password
 	parts := strings.Split(decodedStr, ":")
 	if len(parts) < 2 {
-		logger.Debug("Invalid upstream format", "parts", len(parts), "decoded", decodedStr)
+		logger.Debug("Invalid upstream format", "parts", len(parts), "decoded", applog.Secret(decodedStr))
 		return nil, fmt.Errorf("invalid upstream format, expected host:port")
 	}
 
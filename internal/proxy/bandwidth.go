@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Minimum token bucket burst so small limits still allow reasonable reads
+const minBandwidthBurst = 16 * 1024
+
+// BandwidthConfig contains bandwidth limits in bytes per second (0 = unlimited)
+type BandwidthConfig struct {
+	Global      int64
+	PerClient   int64
+	PerUpstream int64
+	Clients     map[string]int64 // overrides keyed by client ID ([user@]host:port)
+	Upstreams   map[string]int64 // overrides keyed by upstream key (type:host:port)
+}
+
+// bandwidthEntry holds a limiter, the connections using it and its last
+// used time
+type bandwidthEntry struct {
+	limiter  *rate.Limiter
+	refs     int
+	lastUsed time.Time
+}
+
+// bandwidthLimits holds the limiters of one connection or response body
+// until it is closed
+type bandwidthLimits struct {
+	limiters []*rate.Limiter
+	entries  []*bandwidthEntry
+	once     sync.Once
+}
+
+// Global bandwidth state
+var (
+	bandwidthMutex     sync.RWMutex
+	bandwidthConfig    *BandwidthConfig
+	globalLimiter      = rate.NewLimiter(rate.Inf, minBandwidthBurst)
+	clientLimiters     = make(map[string]*bandwidthEntry)
+	upstreamLimiters   = make(map[string]*bandwidthEntry)
+	bandwidthLimitsSet bool
+)
+
+// SetBandwidthConfig updates bandwidth limits. Existing limiters, including
+// those of connections already in progress, pick up the new limits.
+func SetBandwidthConfig(config *BandwidthConfig) {
+	bandwidthMutex.Lock()
+	defer bandwidthMutex.Unlock()
+
+	bandwidthConfig = config
+	bandwidthLimitsSet = config != nil && (config.Global > 0 || config.PerClient > 0 ||
+		config.PerUpstream > 0 || len(config.Clients) > 0 || len(config.Upstreams) > 0)
+
+	applyBandwidthLimit(globalLimiter, globalBandwidthLimit())
+	for id, entry := range clientLimiters {
+		applyBandwidthLimit(entry.limiter, clientBandwidthLimit(id))
+	}
+	for key, entry := range upstreamLimiters {
+		applyBandwidthLimit(entry.limiter, upstreamBandwidthLimit(key))
+	}
+}
+
+// globalBandwidthLimit returns the global limit, caller must hold bandwidthMutex
+func globalBandwidthLimit() int64 {
+	if bandwidthConfig == nil {
+		return 0
+	}
+	return bandwidthConfig.Global
+}
+
+// clientBandwidthLimit returns the limit for a client, caller must hold bandwidthMutex
+func clientBandwidthLimit(clientID string) int64 {
+	if bandwidthConfig == nil {
+		return 0
+	}
+	if limit, ok := bandwidthConfig.Clients[clientID]; ok {
+		return limit
+	}
+	return bandwidthConfig.PerClient
+}
+
+// upstreamBandwidthLimit returns the limit for an upstream, caller must hold bandwidthMutex
+func upstreamBandwidthLimit(key string) int64 {
+	if bandwidthConfig == nil {
+		return 0
+	}
+	if limit, ok := bandwidthConfig.Upstreams[key]; ok {
+		return limit
+	}
+	return bandwidthConfig.PerUpstream
+}
+
+// applyBandwidthLimit sets the rate and burst of a limiter
+func applyBandwidthLimit(limiter *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetLimit(rate.Limit(bytesPerSecond))
+	limiter.SetBurst(int(max64(bytesPerSecond, minBandwidthBurst)))
+}
+
+// acquireBandwidthLimiter gets or creates a keyed limiter and counts a user
+// of it, caller must hold bandwidthMutex
+func acquireBandwidthLimiter(limiters map[string]*bandwidthEntry, key string, limit int64) *bandwidthEntry {
+	entry, ok := limiters[key]
+	if !ok {
+		entry = &bandwidthEntry{limiter: rate.NewLimiter(rate.Inf, minBandwidthBurst)}
+		applyBandwidthLimit(entry.limiter, limit)
+		limiters[key] = entry
+	}
+	entry.refs++
+	entry.lastUsed = time.Now()
+	return entry
+}
+
+// release stops counting the connection as a user of its limiters
+func (l *bandwidthLimits) release() {
+	l.once.Do(func() {
+		bandwidthMutex.Lock()
+		defer bandwidthMutex.Unlock()
+		now := time.Now()
+		for _, entry := range l.entries {
+			entry.refs--
+			entry.lastUsed = now
+		}
+	})
+}
+
+// bandwidthLimiters returns the limiters that apply to traffic of a client,
+// through via unless it is nil for direct routes. Nil is returned when
+// nothing is limited. The limits are released when the throttled body or
+// connection is closed.
+func bandwidthLimiters(client *UpstreamInfo, via *UpstreamInfo) *bandwidthLimits {
+	bandwidthMutex.RLock()
+	limitsSet := bandwidthLimitsSet
+	bandwidthMutex.RUnlock()
+	if !limitsSet {
+		return nil
+	}
+
+	bandwidthMutex.Lock()
+	defer bandwidthMutex.Unlock()
+
+	limits := &bandwidthLimits{limiters: []*rate.Limiter{globalLimiter}}
+	if client != nil {
+		clientID := client.ClientID()
+		limits.entries = append(limits.entries, acquireBandwidthLimiter(clientLimiters, clientID, clientBandwidthLimit(clientID)))
+	}
+	if via != nil {
+		key := upstreamKey(via)
+		limits.entries = append(limits.entries, acquireBandwidthLimiter(upstreamLimiters, key, upstreamBandwidthLimit(key)))
+	}
+	for _, entry := range limits.entries {
+		limits.limiters = append(limits.limiters, entry.limiter)
+	}
+	return limits
+}
+
+// cleanupBandwidthLimiters removes limiters no connection uses that were
+// not used within maxAge
+func cleanupBandwidthLimiters(maxAge time.Duration, logger *slog.Logger) {
+	bandwidthMutex.Lock()
+	defer bandwidthMutex.Unlock()
+
+	now := time.Now()
+	var cleaned int
+	for _, limiters := range []map[string]*bandwidthEntry{clientLimiters, upstreamLimiters} {
+		for key, entry := range limiters {
+			if entry.refs == 0 && now.Sub(entry.lastUsed) > maxAge {
+				delete(limiters, key)
+				cleaned++
+			}
+		}
+	}
+
+	if cleaned > 0 {
+		logger.Debug("Bandwidth limiter cleanup completed", "cleaned", cleaned)
+	}
+}
+
+// waitBandwidth blocks until all limiters allow n bytes
+func waitBandwidth(limiters []*rate.Limiter, n int) error {
+	for _, limiter := range limiters {
+		if limiter.Limit() == rate.Inf {
+			continue
+		}
+		// Reads larger than the burst are charged in burst-sized steps
+		for remaining := n; remaining > 0; {
+			step := min(remaining, limiter.Burst())
+			if err := limiter.WaitN(context.Background(), step); err != nil {
+				return err
+			}
+			remaining -= step
+		}
+	}
+	return nil
+}
+
+// throttledBody limits the rate at which a response body is read
+type throttledBody struct {
+	io.ReadCloser
+	limits *bandwidthLimits
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := waitBandwidth(b.limits.limiters, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (b *throttledBody) Close() error {
+	b.limits.release()
+	return b.ReadCloser.Close()
+}
+
+// throttleBody wraps a response body with the given limits, released when
+// the body is closed
+func throttleBody(body io.ReadCloser, limits *bandwidthLimits) io.ReadCloser {
+	if limits == nil {
+		return body
+	}
+	if body == nil {
+		limits.release()
+		return body
+	}
+	return &throttledBody{ReadCloser: body, limits: limits}
+}
+
+// throttledConn limits both directions of a tunneled connection
+type throttledConn struct {
+	net.Conn
+	limits *bandwidthLimits
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if waitErr := waitBandwidth(c.limits.limiters, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	if err := waitBandwidth(c.limits.limiters, len(p)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *throttledConn) Close() error {
+	c.limits.release()
+	return c.Conn.Close()
+}
+
+// halfCloser is implemented by TCP connections that support half-close
+type halfCloser interface {
+	CloseWrite() error
+	CloseRead() error
+}
+
+// throttledHalfCloseConn keeps half-close support of the underlying connection,
+// which goproxy relies on to shut down tunnels cleanly
+type throttledHalfCloseConn struct {
+	*throttledConn
+	halfCloser halfCloser
+}
+
+func (c *throttledHalfCloseConn) CloseWrite() error {
+	return c.halfCloser.CloseWrite()
+}
+
+func (c *throttledHalfCloseConn) CloseRead() error {
+	return c.halfCloser.CloseRead()
+}
+
+// throttleConn wraps a tunnel connection with the given limits, released
+// when the connection is closed
+func throttleConn(conn net.Conn, limits *bandwidthLimits) net.Conn {
+	if limits == nil {
+		return conn
+	}
+	if conn == nil {
+		limits.release()
+		return conn
+	}
+	throttled := &throttledConn{Conn: conn, limits: limits}
+	if hc, ok := conn.(halfCloser); ok {
+		return &throttledHalfCloseConn{throttledConn: throttled, halfCloser: hc}
+	}
+	return throttled
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Responses to blocked requests
+const (
+	BlockResponseStatus = "status" // the block status with an empty body (default)
+	BlockResponsePage   = "page"   // HTML page naming the matched rule
+	BlockResponseGIF    = "gif"    // transparent 1x1 GIF
+	BlockResponseEmpty  = "empty"  // empty body of the requested type
+	BlockResponseReset  = "reset"  // TCP reset of the client connection
+)
+
+// transparentGIF is a 1x1 transparent GIF
+var transparentGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00" +
+	"!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// Extensions of requests answered with the GIF by the empty response
+var imageExtensions = map[string]bool{
+	".gif": true, ".png": true, ".jpg": true, ".jpeg": true, ".webp": true,
+	".avif": true, ".svg": true, ".ico": true, ".bmp": true,
+}
+
+// parseBlockResponse validates a block response and returns it with its
+// status: 204 by default, 403 for the block page
+func parseBlockResponse(response string, status int) (string, int, error) {
+	response = strings.ToLower(response)
+	switch response {
+	case "":
+		response = BlockResponseStatus
+	case BlockResponseStatus, BlockResponsePage, BlockResponseGIF, BlockResponseEmpty, BlockResponseReset:
+	default:
+		return "", 0, fmt.Errorf("unknown block_response %q", response)
+	}
+
+	if status == 0 {
+		status = http.StatusNoContent
+		if response == BlockResponsePage {
+			status = http.StatusForbidden
+		}
+	}
+	if status < 100 || status > 599 {
+		return "", 0, fmt.Errorf("invalid block status %d", status)
+	}
+	return response, status, nil
+}
+
+// blockResponse answers a blocked request as its decision asks
+func blockResponse(r *http.Request, decision RouteDecision) *http.Response {
+	var resp *http.Response
+	switch decision.BlockResponse {
+	case BlockResponsePage:
+		resp = newProxyResponse(r, "text/html; charset=utf-8", decision.Status, blockPage(r, decision))
+	case BlockResponseGIF:
+		resp = newProxyResponse(r, "image/gif", http.StatusOK, string(transparentGIF))
+	case BlockResponseEmpty:
+		contentType := requestedContentType(r)
+		body := ""
+		if contentType == "image/gif" {
+			body = string(transparentGIF)
+		}
+		resp = newProxyResponse(r, contentType, http.StatusOK, body)
+	case BlockResponseReset:
+		// Requests inside MITM tunnels do not know the client connection
+		// and get the status response instead
+		resetClientConn(r.Context())
+		resp = newProxyResponse(r, goproxy.ContentTypeText, decision.Status, "")
+	default:
+		return newProxyResponse(r, goproxy.ContentTypeText, decision.Status, "")
+	}
+
+	// Do not let the browser remember a block that may be lifted
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// blockPage returns an HTML page explaining why a request was blocked
+func blockPage(r *http.Request, decision RouteDecision) string {
+	reason := "routing rule " + decision.Rule
+	if decision.Rule == ruleAdDomain {
+		reason = "ad blocking"
+	}
+
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Blocked by SmartProxy</title></head>\n<body>\n")
+	b.WriteString("<h1>Blocked by SmartProxy</h1>\n")
+	fmt.Fprintf(&b, "<p>The request to <code>%s</code> was blocked by %s.</p>\n",
+		html.EscapeString(r.URL.String()), html.EscapeString(reason))
+	b.WriteString("<p>Contact your proxy administrator if this page is needed.</p>\n</body></html>\n")
+	return b.String()
+}
+
+// requestedContentType guesses the content type a blocked request expects
+// from its fetch destination, extension or Accept header
+func requestedContentType(r *http.Request) string {
+	switch r.Header.Get("Sec-Fetch-Dest") {
+	case "script", "worker", "sharedworker", "serviceworker":
+		return "application/javascript"
+	case "style":
+		return "text/css"
+	case "image":
+		return "image/gif"
+	}
+
+	ext := strings.ToLower(path.Ext(r.URL.Path))
+	switch {
+	case ext == ".js" || ext == ".mjs":
+		return "application/javascript"
+	case ext == ".css":
+		return "text/css"
+	case ext == ".json":
+		return "application/json"
+	case imageExtensions[ext]:
+		return "image/gif"
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.HasPrefix(accept, "image/"):
+		return "image/gif"
+	case strings.HasPrefix(accept, "text/css"):
+		return "text/css"
+	}
+	return goproxy.ContentTypeText
+}
+
+// resetClientConn aborts the client connection of a request with a TCP
+// reset. It reports false when the connection is not known or not TCP.
+func resetClientConn(ctx context.Context) bool {
+	conn, ok := ctx.Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return false
+	}
+	return resetConn(conn)
+}
+
+// resetConn closes a client connection with a TCP reset instead of a FIN
+func resetConn(conn net.Conn) bool {
+	raw := conn
+	for {
+		switch c := raw.(type) {
+		case *trackedConn:
+			raw = c.Conn
+			continue
+		case *trackedHalfCloseConn:
+			raw = c.Conn
+			continue
+		case *transparentConn:
+			raw = c.Conn
+			continue
+		case *tls.Conn:
+			raw = c.NetConn()
+			continue
+		case *net.TCPConn:
+			c.SetLinger(0)
+			// Close the outer connection so close callbacks run
+			conn.Close()
+			return true
+		}
+		return false
+	}
+}
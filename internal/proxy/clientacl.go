@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+)
+
+// ClientACLConfig controls which clients may connect and how clients of
+// trusted networks are handled
+type ClientACLConfig struct {
+	Allow    []string // IPs or CIDRs, empty allows every client not denied
+	Deny     []string // IPs or CIDRs, checked before Allow
+	Policies []ClientPolicy
+}
+
+// ClientPolicy applies to clients in Networks. The first matching policy wins.
+type ClientPolicy struct {
+	Networks []string
+	SkipAuth bool   // accept requests without credentials
+	Upstream string // named upstream used for requests without credentials
+}
+
+// clientPolicy is the compiled form of ClientPolicy
+type clientPolicy struct {
+	networks []netip.Prefix
+	upstream *UpstreamInfo
+}
+
+// clientACL is the compiled form of ClientACLConfig
+type clientACL struct {
+	allow    []netip.Prefix
+	deny     []netip.Prefix
+	policies []clientPolicy
+}
+
+// Global client ACL, replaced on config reload
+var (
+	clientACLMutex sync.RWMutex
+	currentACL     *clientACL
+)
+
+// SetClientACL compiles and installs the client ACL. Policies reference
+// named upstreams. On error the current ACL stays in place.
+func SetClientACL(config *ClientACLConfig, upstreams map[string]*UpstreamInfo) error {
+	acl, err := compileClientACL(config, upstreams)
+	if err != nil {
+		return err
+	}
+	installClientACL(acl)
+	return nil
+}
+
+// compileClientACL compiles the client ACL without installing it
+func compileClientACL(config *ClientACLConfig, upstreams map[string]*UpstreamInfo) (*clientACL, error) {
+	acl := &clientACL{}
+	if config != nil {
+		var err error
+		if acl.allow, err = parsePrefixes(config.Allow); err != nil {
+			return nil, fmt.Errorf("client_acl allow: %w", err)
+		}
+		if acl.deny, err = parsePrefixes(config.Deny); err != nil {
+			return nil, fmt.Errorf("client_acl deny: %w", err)
+		}
+
+		for i, policy := range config.Policies {
+			compiled, err := compileClientPolicy(policy, upstreams)
+			if err != nil {
+				return nil, fmt.Errorf("client_acl policy #%d: %w", i+1, err)
+			}
+			acl.policies = append(acl.policies, compiled)
+		}
+	}
+	return acl, nil
+}
+
+// installClientACL replaces the client ACL
+func installClientACL(acl *clientACL) {
+	clientACLMutex.Lock()
+	currentACL = acl
+	clientACLMutex.Unlock()
+}
+
+// compileClientPolicy validates a policy and resolves its upstream
+func compileClientPolicy(policy ClientPolicy, upstreams map[string]*UpstreamInfo) (clientPolicy, error) {
+	var compiled clientPolicy
+	if len(policy.Networks) == 0 {
+		return compiled, fmt.Errorf("no networks")
+	}
+	networks, err := parsePrefixes(policy.Networks)
+	if err != nil {
+		return compiled, err
+	}
+	compiled.networks = networks
+
+	switch {
+	case policy.SkipAuth && policy.Upstream == "":
+		return compiled, fmt.Errorf("skip_auth needs an upstream")
+	case !policy.SkipAuth && policy.Upstream != "":
+		return compiled, fmt.Errorf("upstream is only used with skip_auth")
+	case policy.SkipAuth:
+		upstream, ok := upstreams[policy.Upstream]
+		if !ok {
+			return compiled, fmt.Errorf("unknown upstream %q", policy.Upstream)
+		}
+		compiled.upstream = upstream
+	}
+	return compiled, nil
+}
+
+// parsePrefixes parses a list of IPs and CIDRs
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// loadClientACL returns the client ACL, nil if not configured
+func loadClientACL() *clientACL {
+	clientACLMutex.RLock()
+	defer clientACLMutex.RUnlock()
+	return currentACL
+}
+
+// allows reports whether a client address may connect
+func (acl *clientACL) allows(addr netip.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	if containsAddr(acl.deny, addr) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsAddr(acl.allow, addr)
+}
+
+// clientPolicyUpstream returns the upstream for a request without
+// credentials from a mapped client certificate, a listener or a client
+// network that skips authentication, nil otherwise. On transparent listeners
+// client network policies take precedence over the listener upstream.
+func clientPolicyUpstream(r *http.Request) *UpstreamInfo {
+	if r == nil || r.Header.Get("Proxy-Authorization") != "" {
+		return nil
+	}
+	lc := listenerFromContext(r.Context())
+	if lc != nil {
+		if upstream := clientCertUpstream(r.Context(), lc); upstream != nil {
+			return upstream
+		}
+		if lc.SkipAuth && !lc.Transparent && lc.Upstream != nil {
+			upstream := *lc.Upstream
+			return &upstream
+		}
+	}
+
+	if upstream := networkPolicyUpstream(r); upstream != nil {
+		return upstream
+	}
+	if lc != nil && lc.Transparent && lc.Upstream != nil {
+		upstream := *lc.Upstream
+		return &upstream
+	}
+	return nil
+}
+
+// networkPolicyUpstream returns the upstream of the first client ACL policy
+// matching the client address, nil if none skips authentication
+func networkPolicyUpstream(r *http.Request) *UpstreamInfo {
+	acl := loadClientACL()
+	if acl == nil || len(acl.policies) == 0 {
+		return nil
+	}
+	addr := remoteAddrIP(r.RemoteAddr)
+	if !addr.IsValid() {
+		return nil
+	}
+
+	for _, policy := range acl.policies {
+		if containsAddr(policy.networks, addr) {
+			if policy.upstream == nil {
+				return nil
+			}
+			// Copy so per-request changes do not leak into the policy
+			upstream := *policy.upstream
+			return &upstream
+		}
+	}
+	return nil
+}
+
+// aclListener closes connections from clients the client ACL refuses
+// before any bytes are read
+type aclListener struct {
+	net.Listener
+	logger *slog.Logger
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// Only IP clients are subject to the ACL
+		tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || loadClientACL().allows(tcpAddr.AddrPort().Addr().Unmap()) {
+			return conn, nil
+		}
+
+		l.logger.Debug("Client connection refused by ACL",
+			"remote_addr", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// errDestinationDenied is returned when a direct dial targets a denied address
+var errDestinationDenied = errors.New("destination address denied by proxy policy")
+
+// DestinationConfig contains CIDR lists applied to target addresses, both IP
+// literals and resolved host names
+type DestinationConfig struct {
+	Direct   []string // route direct
+	Upstream []string // route through the upstream
+	Deny     []string // never connect, checked before routing rules
+}
+
+// destinationNets is the compiled form of DestinationConfig
+type destinationNets struct {
+	direct   []netip.Prefix
+	upstream []netip.Prefix
+	deny     []netip.Prefix
+}
+
+// Global destination policy, replaced on config reload
+var (
+	destinationMutex sync.RWMutex
+	destinations     *destinationNets
+)
+
+// SetDestinationConfig compiles the destination CIDR lists. On error the
+// current lists stay in place.
+func SetDestinationConfig(config *DestinationConfig) error {
+	nets, err := compileDestinationConfig(config)
+	if err != nil {
+		return err
+	}
+	installDestinations(nets)
+	return nil
+}
+
+// compileDestinationConfig parses the destination CIDR lists without
+// installing them
+func compileDestinationConfig(config *DestinationConfig) (*destinationNets, error) {
+	nets := &destinationNets{}
+	if config != nil {
+		for _, list := range []struct {
+			name    string
+			entries []string
+			nets    *[]netip.Prefix
+		}{
+			{"direct", config.Direct, &nets.direct},
+			{"upstream", config.Upstream, &nets.upstream},
+			{"deny", config.Deny, &nets.deny},
+		} {
+			for _, entry := range list.entries {
+				prefix, err := parsePrefix(entry)
+				if err != nil {
+					return nil, fmt.Errorf("destinations %s: %w", list.name, err)
+				}
+				*list.nets = append(*list.nets, prefix)
+			}
+		}
+	}
+	return nets, nil
+}
+
+// installDestinations replaces the destination policy
+func installDestinations(nets *destinationNets) {
+	destinationMutex.Lock()
+	destinations = nets
+	destinationMutex.Unlock()
+}
+
+// currentDestinations returns the destination policy, nil if not configured
+func currentDestinations() *destinationNets {
+	destinationMutex.RLock()
+	defer destinationMutex.RUnlock()
+	return destinations
+}
+
+// containsAddr reports whether any prefix contains the address
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeniedDestination reports whether an IP literal target is denied
+func isDeniedDestination(host string) bool {
+	nets := currentDestinations()
+	if nets == nil || len(nets.deny) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return containsAddr(nets.deny, addr.Unmap())
+}
+
+// destinationAction returns the action of the direct and upstream CIDR
+// lists for a target. Host names are resolved only if a list is configured.
+func destinationAction(host string, logger *slog.Logger) (string, bool) {
+	nets := currentDestinations()
+	if nets == nil || (len(nets.direct) == 0 && len(nets.upstream) == 0) {
+		return "", false
+	}
+
+	for _, addr := range resolveHost(host, logger) {
+		switch {
+		case containsAddr(nets.deny, addr):
+			return ActionReject, true
+		case containsAddr(nets.direct, addr):
+			return ActionDirect, true
+		case containsAddr(nets.upstream, addr):
+			return ActionUpstream, true
+		}
+	}
+	return "", false
+}
+
+// checkDialDestination is a net.Dialer Control function that refuses denied
+// addresses. It sees the address actually connected to, after resolution.
+func checkDialDestination(network, address string, _ syscall.RawConn) error {
+	nets := currentDestinations()
+	if nets == nil || len(nets.deny) == 0 {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil
+	}
+	if containsAddr(nets.deny, addrPort.Addr().Unmap()) {
+		return fmt.Errorf("%w: %s", errDestinationDenied, address)
+	}
+	return nil
+}
+
+// newDirectDialer returns a dialer for direct connections that resolves with
+// the built-in resolver and refuses denied destination addresses
+func newDirectDialer(timeout time.Duration) *resolvingDialer {
+	return &resolvingDialer{Dialer: net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   checkDialDestination,
+	}}
+}
+
+// upstreamProxyDialer returns the dialer connecting to an upstream proxy.
+// Addresses from client credentials are checked like direct destinations.
+func upstreamProxyDialer(named bool) *resolvingDialer {
+	if named {
+		return &resolvingDialer{Dialer: net.Dialer{
+			Timeout:   DefaultTimeout,
+			KeepAlive: 30 * time.Second,
+		}}
+	}
+	return newDirectDialer(DefaultTimeout)
+}
+
+// destinationDeniedResponse answers a request whose direct dial was refused
+func destinationDeniedResponse(r *http.Request, logger *slog.Logger) *http.Response {
+	logger.Warn("Direct connection to denied destination refused",
+		"host", r.Host,
+		"method", r.Method)
+	return newProxyResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "Destination denied by proxy policy")
+}
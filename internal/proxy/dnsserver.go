@@ -0,0 +1,346 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Answers the DNS server gives for ad domains
+const (
+	DNSBlockNXDomain = "nxdomain" // the name does not exist
+	DNSBlockZero     = "zero"     // 0.0.0.0 and :: addresses
+)
+
+// TTL of answers for ad domains
+const dnsBlockTTL = 60
+
+// Idle time after which DNS clients over TCP are disconnected
+const dnsTCPIdleTimeout = 10 * time.Second
+
+// Smallest UDP payload every DNS client accepts
+const dnsMinUDPSize = 512
+
+// Most UDP queries and TCP clients served at once; further queries are
+// dropped and further clients disconnected
+const dnsMaxConcurrent = 256
+
+// DNSServerConfig controls the embedded DNS server. Queries for ad domains
+// are answered locally, others are forwarded to the resolver's servers.
+type DNSServerConfig struct {
+	Listen        string   // UDP and TCP address
+	BlockResponse string   // nxdomain (default) or zero
+	Allow         []string // client IPs or CIDRs answered, nobody when empty
+}
+
+// startDNSServer opens the DNS listeners and serves them in the background
+func (s *Server) startDNSServer() ([]io.Closer, error) {
+	config := s.config.DNSServer
+	switch config.BlockResponse {
+	case "", DNSBlockNXDomain, DNSBlockZero:
+	default:
+		return nil, fmt.Errorf("dns server: unknown block_response %q", config.BlockResponse)
+	}
+	// Without allow entries nobody is answered, so the server is never an
+	// open resolver
+	allow, err := parsePrefixes(config.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("dns server: invalid allow entry: %w", err)
+	}
+
+	packetConn, err := net.ListenPacket("udp", config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("dns server: %w", err)
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		packetConn.Close()
+		return nil, fmt.Errorf("dns server: %w", err)
+	}
+
+	// UDP queries and TCP clients share the limit
+	slots := make(chan struct{}, dnsMaxConcurrent)
+	go s.serveDNSPackets(packetConn, allow, slots)
+	go s.serveDNSStreams(listener, allow, slots)
+
+	s.logger.Info("Starting DNS server",
+		"address", config.Listen,
+		"block_response", config.BlockResponse,
+		"ad_blocking", s.routingConfig.AdBlocking.Enabled)
+	return []io.Closer{packetConn, listener}, nil
+}
+
+// serveDNSPackets answers queries from allowed clients over UDP, each
+// holding a slot while it is answered
+func (s *Server) serveDNSPackets(conn net.PacketConn, allow []netip.Prefix, slots chan struct{}) {
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Debug("DNS read failed", "error", err)
+			continue
+		}
+
+		if !containsAddr(allow, clientAddr(addr)) {
+			s.logger.Debug("DNS query refused, client not allowed", "remote_addr", addr.String())
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			s.logger.Debug("DNS query dropped, too many in progress", "remote_addr", addr.String())
+			continue
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-slots }()
+			if resp := s.answerDNS(query, addr, true); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+// serveDNSStreams answers length-prefixed queries from allowed clients over
+// TCP, each client holding a slot until it disconnects
+func (s *Server) serveDNSStreams(listener net.Listener, allow []netip.Prefix, slots chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Debug("DNS accept failed", "error", err)
+			continue
+		}
+		if !containsAddr(allow, clientAddr(conn.RemoteAddr())) {
+			s.logger.Debug("DNS client refused, not allowed", "remote_addr", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			s.logger.Debug("DNS client dropped, too many connected", "remote_addr", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			s.serveDNSStream(conn)
+		}()
+	}
+}
+
+// serveDNSStream answers the queries of one TCP client until it goes idle
+func (s *Server) serveDNSStream(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		resp := s.answerDNS(query, conn.RemoteAddr(), false)
+		if resp == nil {
+			return
+		}
+		msg := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		copy(msg[2:], resp)
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// answerDNS returns the packed response to a query, nil to drop it. Ad
+// domains are answered locally, other queries are forwarded as is.
+func (s *Server) answerDNS(query []byte, client net.Addr, udp bool) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return packDNSResponse(dnsResponse(header, nil, dnsmessage.RCodeFormatError))
+	}
+
+	// Policies by client IP apply, there is no user to match
+	name := strings.TrimSuffix(question.Name.String(), ".")
+	rr := &RouteRequest{Host: normalizeHost(name), ClientIP: clientAddr(client)}
+	var match adMatch
+	blocked := false
+	if question.Class == dnsmessage.ClassINET {
+		match, blocked = isAdRequest(rr, s.routingConfig, s.logger)
+	}
+	if blocked {
+		s.logger.Debug("DNS query blocked",
+			"client", client.String(),
+			"name", name,
+			"type", question.Type.String(),
+			"reason", ruleAdDomain)
+		adBlockedQueries.Add(1)
+		recordAdStats(rr, match, adStatsQuery)
+		return packDNSResponse(s.blockedDNSResponse(header, question))
+	}
+
+	resp, err := forwardDNS(query, udp)
+	if err != nil {
+		s.logger.Warn("Failed to forward DNS query",
+			"client", client.String(),
+			"name", name,
+			"error", err)
+		return packDNSResponse(dnsResponse(header, &question, dnsmessage.RCodeServerFailure))
+	}
+
+	// Answers too large for the client's UDP buffer are truncated so it
+	// retries over TCP
+	if udp && len(resp) > clientUDPSize(&parser) {
+		msg := dnsResponse(header, &question, dnsmessage.RCodeSuccess)
+		msg.Truncated = true
+		return packDNSResponse(msg)
+	}
+	return resp
+}
+
+// blockedDNSResponse answers a query for an ad domain
+func (s *Server) blockedDNSResponse(header dnsmessage.Header, question dnsmessage.Question) dnsmessage.Message {
+	if s.config.DNSServer.BlockResponse != DNSBlockZero {
+		return dnsResponse(header, &question, dnsmessage.RCodeNameError)
+	}
+
+	msg := dnsResponse(header, &question, dnsmessage.RCodeSuccess)
+	answer := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  question.Type,
+		Class: dnsmessage.ClassINET,
+		TTL:   dnsBlockTTL,
+	}
+	switch question.Type {
+	case dnsmessage.TypeA:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: answer, Body: &dnsmessage.AResource{}})
+	case dnsmessage.TypeAAAA:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: answer, Body: &dnsmessage.AAAAResource{}})
+	}
+	return msg
+}
+
+// clientAddr returns the IP of a DNS client, invalid if unknown
+func clientAddr(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// dnsResponse returns an empty response to a query
+func dnsResponse(header dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode) dnsmessage.Message {
+	msg := dnsmessage.Message{Header: dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	}}
+	if question != nil {
+		msg.Questions = []dnsmessage.Question{*question}
+	}
+	return msg
+}
+
+// packDNSResponse packs a response, nil if it cannot be packed
+func packDNSResponse(msg dnsmessage.Message) []byte {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+// clientUDPSize returns the largest UDP response a client accepts, from the
+// EDNS0 record of its query. The parser must be positioned after the first
+// question.
+func clientUDPSize(parser *dnsmessage.Parser) int {
+	size := dnsMinUDPSize
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return size
+	}
+	for {
+		header, err := parser.AdditionalHeader()
+		if err != nil {
+			return size
+		}
+		if header.Type == dnsmessage.TypeOPT && int(header.Class) > size {
+			size = int(header.Class)
+		}
+		if parser.SkipAdditional() != nil {
+			return size
+		}
+	}
+}
+
+// forwardDNS sends a query to each resolver server in turn until one
+// answers. UDP clients get truncated answers of UDP servers as they are.
+func forwardDNS(query []byte, udp bool) ([]byte, error) {
+	resolverMutex.RLock()
+	config, servers := resolverConfig, resolverServers
+	resolverMutex.RUnlock()
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS servers configured")
+	}
+
+	timeout := defaultResolverTimeout
+	if config != nil && config.Timeout > 0 {
+		timeout = config.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var lastErr error
+	for _, server := range servers {
+		var resp []byte
+		var err error
+		if udp && server.protocol == "udp" {
+			resp, err = exchangeUDP(ctx, server.address, query)
+		} else {
+			resp, err = server.exchange(ctx, query)
+		}
+		if err == nil && len(resp) < 12 {
+			err = errors.New("short response")
+		}
+		if err == nil {
+			// Answer with the client's query ID whatever the server echoed
+			copy(resp[:2], query[:2])
+			return resp, nil
+		}
+		lastErr = fmt.Errorf("dns server %s: %w", server.address, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
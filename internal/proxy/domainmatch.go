@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Domain pattern prefixes for explicit match types
+const (
+	exactDomainPrefix   = "exact:"
+	keywordDomainPrefix = "keyword:"
+)
+
+// domainTrieNode is a node of a trie keyed by domain labels from right to
+// left, so com -> example -> cdn for cdn.example.com. Non-empty patterns
+// mark how the domain ending at this node matches.
+type domainTrieNode struct {
+	children        map[string]*domainTrieNode
+	exactPattern    string // the domain itself
+	suffixPattern   string // the domain and its subdomains
+	wildcardPattern string // subdomains only
+}
+
+// domainMatcher matches hosts against direct domain patterns:
+//
+//	example.com, .example.com   the domain and its subdomains
+//	exact:example.com           only the domain itself
+//	*.example.com               only subdomains
+//	cdn.*                       hosts whose first label is cdn
+//	keyword:cdn                 hosts containing the text (old substring match)
+type domainMatcher struct {
+	root        *domainTrieNode
+	firstLabels map[string]string // label -> pattern
+	keywords    []string
+}
+
+// legacyDomainPattern describes a direct_domains entry in the substring
+// format of older versions, and the keyword pattern it is matched as now
+type legacyDomainPattern struct {
+	Entry   string
+	Keyword string
+}
+
+// migrateDirectDomains rewrites direct_domains entries in the old substring
+// format as keyword patterns, which match the same hosts. Those are single
+// labels with or without a trailing dot, such as "cdn." or "cloudflare";
+// they are returned so callers can warn about them.
+func migrateDirectDomains(patterns []string) ([]string, []legacyDomainPattern) {
+	var migrated []string
+	var legacy []legacyDomainPattern
+	for _, entry := range patterns {
+		pattern := strings.ToLower(strings.TrimSpace(entry))
+		label := strings.TrimSuffix(pattern, ".")
+		if label != "" && !strings.ContainsAny(label, ".:*") {
+			keyword := keywordDomainPrefix + pattern
+			legacy = append(legacy, legacyDomainPattern{Entry: entry, Keyword: keyword})
+			pattern = keyword
+		}
+		migrated = append(migrated, pattern)
+	}
+	return migrated, legacy
+}
+
+// newDomainMatcher compiles domain patterns
+func newDomainMatcher(patterns []string) (*domainMatcher, error) {
+	m := &domainMatcher{
+		root:        &domainTrieNode{},
+		firstLabels: make(map[string]string),
+	}
+
+	for _, entry := range patterns {
+		pattern := strings.ToLower(strings.TrimSpace(entry))
+		if pattern == "" {
+			continue
+		}
+		if err := m.add(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(m.keywords)
+	return m, nil
+}
+
+// add compiles a single normalized pattern into the matcher
+func (m *domainMatcher) add(pattern string) error {
+	switch {
+	case strings.HasPrefix(pattern, keywordDomainPrefix):
+		keyword := pattern[len(keywordDomainPrefix):]
+		if keyword == "" {
+			return fmt.Errorf("empty keyword in direct domain %q", pattern)
+		}
+		m.keywords = append(m.keywords, keyword)
+	case strings.HasPrefix(pattern, exactDomainPrefix):
+		domain := strings.TrimSuffix(pattern[len(exactDomainPrefix):], ".")
+		if err := validateDomain(domain, pattern); err != nil {
+			return err
+		}
+		m.node(domain).exactPattern = pattern
+	case strings.HasPrefix(pattern, "*."):
+		domain := pattern[2:]
+		if err := validateDomain(domain, pattern); err != nil {
+			return err
+		}
+		m.node(domain).wildcardPattern = pattern
+	case strings.HasSuffix(pattern, ".*"):
+		label := strings.TrimSuffix(pattern, ".*")
+		if label == "" || strings.ContainsAny(label, ".*") {
+			return fmt.Errorf("invalid first label pattern %q", pattern)
+		}
+		m.firstLabels[label] = pattern
+	default:
+		domain := strings.TrimSuffix(strings.TrimPrefix(pattern, "."), ".")
+		if err := validateDomain(domain, pattern); err != nil {
+			return err
+		}
+		m.node(domain).suffixPattern = pattern
+	}
+	return nil
+}
+
+// validateDomain rejects domains that cannot be stored in the trie
+func validateDomain(domain, pattern string) error {
+	if domain == "" || strings.Contains(domain, "*") || strings.Contains(domain, "..") ||
+		strings.HasPrefix(domain, ".") || strings.Contains(domain, ":") {
+		return fmt.Errorf("invalid direct domain pattern %q", pattern)
+	}
+	return nil
+}
+
+// node returns the trie node of a domain, creating it if needed
+func (m *domainMatcher) node(domain string) *domainTrieNode {
+	node := m.root
+	rest := domain
+	for {
+		dot := strings.LastIndexByte(rest, '.')
+		label := rest[dot+1:]
+		if node.children == nil {
+			node.children = make(map[string]*domainTrieNode)
+		}
+		child, ok := node.children[label]
+		if !ok {
+			child = &domainTrieNode{}
+			node.children[label] = child
+		}
+		node = child
+		if dot < 0 {
+			return node
+		}
+		rest = rest[:dot]
+	}
+}
+
+// match returns the pattern matching a lowercase host without port
+func (m *domainMatcher) match(host string) (string, bool) {
+	if m == nil || host == "" {
+		return "", false
+	}
+
+	// Walk the trie label by label from the right without allocating
+	node := m.root
+	rest := host
+	for node.children != nil {
+		dot := strings.LastIndexByte(rest, '.')
+		child, ok := node.children[rest[dot+1:]]
+		if !ok {
+			break
+		}
+		node = child
+		if dot < 0 {
+			if node.exactPattern != "" {
+				return node.exactPattern, true
+			}
+			if node.suffixPattern != "" {
+				return node.suffixPattern, true
+			}
+			break
+		}
+		if node.suffixPattern != "" {
+			return node.suffixPattern, true
+		}
+		if node.wildcardPattern != "" {
+			return node.wildcardPattern, true
+		}
+		rest = rest[:dot]
+	}
+
+	if len(m.firstLabels) > 0 {
+		if dot := strings.IndexByte(host, '.'); dot > 0 {
+			if pattern, ok := m.firstLabels[host[:dot]]; ok {
+				return pattern, true
+			}
+		}
+	}
+
+	for _, keyword := range m.keywords {
+		if strings.Contains(host, keyword) {
+			return keywordDomainPrefix + keyword, true
+		}
+	}
+	return "", false
+}
+
+// domainSets lists the compiled patterns by match type, for the PAC file
+func (m *domainMatcher) domainSets() (exact, suffix, wildcard, firstLabels, keywords []string) {
+	if m == nil {
+		return nil, nil, nil, nil, nil
+	}
+
+	var walk func(node *domainTrieNode, domain string)
+	walk = func(node *domainTrieNode, domain string) {
+		if node.exactPattern != "" {
+			exact = append(exact, domain)
+		}
+		if node.suffixPattern != "" {
+			suffix = append(suffix, domain)
+		}
+		if node.wildcardPattern != "" {
+			wildcard = append(wildcard, domain)
+		}
+		for label, child := range node.children {
+			if domain == "" {
+				walk(child, label)
+			} else {
+				walk(child, label+"."+domain)
+			}
+		}
+	}
+	walk(m.root, "")
+
+	for label := range m.firstLabels {
+		firstLabels = append(firstLabels, label)
+	}
+	keywords = append(keywords, m.keywords...)
+
+	for _, list := range [][]string{exact, suffix, wildcard, firstLabels} {
+		sort.Strings(list)
+	}
+	return exact, suffix, wildcard, firstLabels, keywords
+}
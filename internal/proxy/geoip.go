@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIPConfig contains the GeoIP databases used by routing rules. Target
+// hosts are resolved with the built-in resolver.
+type GeoIPConfig struct {
+	CountryDatabase string // MaxMind-format country database (mmdb)
+	ASNDatabase     string // MaxMind-format ASN database (mmdb)
+}
+
+// geoLocation is the GeoIP information of a target host
+type geoLocation struct {
+	Country string // ISO 3166 code, empty if unknown
+	ASN     uint   // 0 if unknown
+}
+
+// geoIPCountryRecord is the part of a country database record we use
+type geoIPCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// geoIPASNRecord is the part of an ASN database record we use
+type geoIPASNRecord struct {
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// Global GeoIP state, replaced on config reload
+var (
+	geoIPMutex     sync.RWMutex
+	geoIPConfig    *GeoIPConfig
+	geoIPCountryDB *maxminddb.Reader
+	geoIPASNDB     *maxminddb.Reader
+)
+
+// SetGeoIPConfig loads the configured GeoIP databases. On error the current
+// databases stay in place. Call it before SetRoutingRules so rules with
+// GeoIP conditions can be validated.
+func SetGeoIPConfig(config *GeoIPConfig) error {
+	databases, err := loadGeoIPConfig(config)
+	if err != nil {
+		return err
+	}
+	installGeoIPConfig(databases)
+	return nil
+}
+
+// geoIPConfigDatabases holds GeoIP databases loaded but not yet installed
+type geoIPConfigDatabases struct {
+	config       *GeoIPConfig
+	country, asn *maxminddb.Reader
+}
+
+// loadGeoIPConfig reads the configured GeoIP databases without installing
+// them
+func loadGeoIPConfig(config *GeoIPConfig) (*geoIPConfigDatabases, error) {
+	databases := &geoIPConfigDatabases{config: config}
+	if config != nil {
+		var err error
+		if databases.country, err = openGeoIPDatabase(config.CountryDatabase); err != nil {
+			return nil, err
+		}
+		if databases.asn, err = openGeoIPDatabase(config.ASNDatabase); err != nil {
+			return nil, err
+		}
+	}
+	return databases, nil
+}
+
+// installGeoIPConfig replaces the GeoIP databases
+func installGeoIPConfig(databases *geoIPConfigDatabases) {
+	geoIPMutex.Lock()
+	geoIPConfig = databases.config
+	geoIPCountryDB = databases.country
+	geoIPASNDB = databases.asn
+	geoIPMutex.Unlock()
+}
+
+// openGeoIPDatabase reads an mmdb file, returning nil if path is empty. The
+// file is read into memory so a reload can swap readers while lookups run.
+func openGeoIPDatabase(path string) (*maxminddb.Reader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP database %s: %w", path, err)
+	}
+	return reader, nil
+}
+
+// geoIPDatabases reports which GeoIP databases are loaded
+func geoIPDatabases() (country, asn bool) {
+	geoIPMutex.RLock()
+	defer geoIPMutex.RUnlock()
+	return geoIPCountryDB != nil, geoIPASNDB != nil
+}
+
+// lookupGeoIP resolves a host and looks up its first address with a known
+// country or ASN
+func lookupGeoIP(host string, logger *slog.Logger) geoLocation {
+	geoIPMutex.RLock()
+	countryDB, asnDB := geoIPCountryDB, geoIPASNDB
+	geoIPMutex.RUnlock()
+
+	var loc geoLocation
+	if countryDB == nil && asnDB == nil {
+		return loc
+	}
+
+	for _, addr := range resolveHost(host, logger) {
+		ip := net.IP(addr.AsSlice())
+		if countryDB != nil {
+			var record geoIPCountryRecord
+			if err := countryDB.Lookup(ip, &record); err == nil {
+				loc.Country = record.Country.ISOCode
+				if loc.Country == "" {
+					loc.Country = record.RegisteredCountry.ISOCode
+				}
+			}
+		}
+		if asnDB != nil {
+			var record geoIPASNRecord
+			if err := asnDB.Lookup(ip, &record); err == nil {
+				loc.ASN = record.ASN
+			}
+		}
+		if loc.Country != "" || loc.ASN != 0 {
+			break
+		}
+	}
+
+	logger.Debug("GeoIP lookup",
+		"host", host,
+		"country", loc.Country,
+		"asn", loc.ASN)
+	return loc
+}
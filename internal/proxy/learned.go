@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"container/list"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LearnedRoutingConfig contains settings for routing direct by the
+// Content-Type of earlier upstream responses in MITM mode
+type LearnedRoutingConfig struct {
+	Enabled      bool
+	ContentTypes []string // image/*, font/woff2, ...
+	TTL          time.Duration
+	MaxEntries   int
+	PathDepth    int // path segments kept in the learned prefix
+}
+
+// learnedRoute is a host and path prefix learned to serve static content
+type learnedRoute struct {
+	key         string
+	contentType string
+	expires     time.Time
+}
+
+// Global learned routing state. Entries are kept in least recently used order.
+var (
+	learnedMutex   sync.Mutex
+	learnedConfig  *LearnedRoutingConfig
+	learnedRoutes  = make(map[string]*list.Element)
+	learnedLRU     = list.New()
+	learnedTypes   map[string]bool // exact media types
+	learnedClasses map[string]bool // top-level types of type/* patterns
+)
+
+// SetLearnedRoutingConfig updates learned routing settings at runtime.
+// Disabling learned routing forgets all learned routes.
+func SetLearnedRoutingConfig(config *LearnedRoutingConfig) {
+	types := make(map[string]bool)
+	classes := make(map[string]bool)
+	if config != nil {
+		for _, pattern := range config.ContentTypes {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if class, ok := strings.CutSuffix(pattern, "/*"); ok {
+				classes[class] = true
+			} else if pattern != "" {
+				types[pattern] = true
+			}
+		}
+	}
+
+	learnedMutex.Lock()
+	defer learnedMutex.Unlock()
+
+	learnedConfig = config
+	learnedTypes = types
+	learnedClasses = classes
+	if config == nil || !config.Enabled {
+		learnedRoutes = make(map[string]*list.Element)
+		learnedLRU.Init()
+		return
+	}
+	evictLearnedRoutes()
+}
+
+// learnedRouteKey returns the cache key of a request: its host, port and
+// the first PathDepth segments of its path
+func learnedRouteKey(rr *RouteRequest, depth int) string {
+	path := rr.Path
+	if path == "" {
+		path = "/"
+	}
+	if depth > 0 {
+		segments := 0
+		for i := 1; i < len(path); i++ {
+			if path[i] == '/' {
+				segments++
+				if segments == depth {
+					path = path[:i]
+					break
+				}
+			}
+		}
+	}
+	return rr.Host + ":" + strconv.Itoa(rr.Port) + path
+}
+
+// learnedMethod reports whether requests with the method can be learned and
+// routed by learned routes
+func learnedMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// isLearnedStatic reports whether a request matches a learned static route
+// that has not expired
+func isLearnedStatic(rr *RouteRequest, logger *slog.Logger) bool {
+	if !learnedMethod(rr.Method) {
+		return false
+	}
+
+	learnedMutex.Lock()
+	defer learnedMutex.Unlock()
+
+	if learnedConfig == nil || !learnedConfig.Enabled || len(learnedRoutes) == 0 {
+		return false
+	}
+
+	key := learnedRouteKey(rr, learnedConfig.PathDepth)
+	elem, ok := learnedRoutes[key]
+	if !ok {
+		return false
+	}
+	route := elem.Value.(*learnedRoute)
+	if time.Now().After(route.expires) {
+		learnedLRU.Remove(elem)
+		delete(learnedRoutes, key)
+		return false
+	}
+
+	learnedLRU.MoveToFront(elem)
+	logger.Debug("Request matches learned static route",
+		"key", key,
+		"content_type", route.contentType,
+		"action", "direct_connection")
+	return true
+}
+
+// learnStaticRoute remembers the host and path prefix of a successful
+// upstream response with a static Content-Type
+func learnStaticRoute(rr *RouteRequest, resp *http.Response, logger *slog.Logger) {
+	if resp == nil || resp.StatusCode < 200 || resp.StatusCode > 299 || !learnedMethod(rr.Method) {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+
+	learnedMutex.Lock()
+	defer learnedMutex.Unlock()
+
+	if learnedConfig == nil || !learnedConfig.Enabled {
+		return
+	}
+	class, _, _ := strings.Cut(mediaType, "/")
+	if !learnedTypes[mediaType] && !learnedClasses[class] {
+		return
+	}
+
+	key := learnedRouteKey(rr, learnedConfig.PathDepth)
+	expires := time.Now().Add(learnedConfig.TTL)
+	if elem, ok := learnedRoutes[key]; ok {
+		route := elem.Value.(*learnedRoute)
+		route.contentType = mediaType
+		route.expires = expires
+		learnedLRU.MoveToFront(elem)
+		return
+	}
+
+	learnedRoutes[key] = learnedLRU.PushFront(&learnedRoute{key: key, contentType: mediaType, expires: expires})
+	evictLearnedRoutes()
+
+	logger.Debug("Learned static route",
+		"key", key,
+		"content_type", mediaType,
+		"ttl", learnedConfig.TTL,
+		"entries", len(learnedRoutes))
+}
+
+// evictLearnedRoutes drops the least recently used routes over MaxEntries.
+// Callers must hold learnedMutex.
+func evictLearnedRoutes() {
+	if learnedConfig.MaxEntries <= 0 {
+		return
+	}
+	for learnedLRU.Len() > learnedConfig.MaxEntries {
+		route := learnedLRU.Remove(learnedLRU.Back()).(*learnedRoute)
+		delete(learnedRoutes, route.key)
+	}
+}
+
+// cleanupLearnedRoutes removes expired learned routes
+func cleanupLearnedRoutes(logger *slog.Logger) {
+	learnedMutex.Lock()
+	defer learnedMutex.Unlock()
+
+	now := time.Now()
+	var cleaned int
+	for key, elem := range learnedRoutes {
+		if now.After(elem.Value.(*learnedRoute).expires) {
+			learnedLRU.Remove(elem)
+			delete(learnedRoutes, key)
+			cleaned++
+		}
+	}
+
+	if cleaned > 0 {
+		logger.Debug("Learned route cleanup completed",
+			"cleaned", cleaned,
+			"remaining", len(learnedRoutes))
+	}
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// connContextKey stores the client connection in request contexts
+type connContextKey struct{}
+
+// trackedConn runs registered callbacks when the client connection closes,
+// including after goproxy has hijacked it for a CONNECT tunnel
+type trackedConn struct {
+	net.Conn
+	mu       sync.Mutex
+	closed   bool
+	onClose  []func()
+	closeErr error
+}
+
+func (c *trackedConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.closeErr
+	}
+	c.closed = true
+	callbacks := c.onClose
+	c.onClose = nil
+	c.closeErr = c.Conn.Close()
+	c.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn()
+	}
+	return c.closeErr
+}
+
+// addOnClose registers fn to run on close, or runs it at once if already closed
+func (c *trackedConn) addOnClose(fn func()) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		fn()
+		return
+	}
+	c.onClose = append(c.onClose, fn)
+	c.mu.Unlock()
+}
+
+// trackedHalfCloseConn keeps half-close support of TCP connections
+type trackedHalfCloseConn struct {
+	*trackedConn
+	halfCloser halfCloser
+}
+
+func (c *trackedHalfCloseConn) CloseWrite() error {
+	return c.halfCloser.CloseWrite()
+}
+
+func (c *trackedHalfCloseConn) CloseRead() error {
+	return c.halfCloser.CloseRead()
+}
+
+// trackingListener wraps accepted connections so their lifetime can be tracked
+type trackingListener struct {
+	net.Listener
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &trackedConn{Conn: conn}
+	if hc, ok := conn.(halfCloser); ok {
+		return &trackedHalfCloseConn{trackedConn: tracked, halfCloser: hc}, nil
+	}
+	return tracked, nil
+}
+
+// connContext stores the client connection in the request context, used as
+// http.Server.ConnContext
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// onConnClose registers fn to run when the client connection of a request
+// closes. It reports false when the connection is not tracked.
+func onConnClose(ctx context.Context, fn func()) bool {
+	switch conn := ctx.Value(connContextKey{}).(type) {
+	case *trackedConn:
+		conn.addOnClose(fn)
+		return true
+	case *trackedHalfCloseConn:
+		conn.addOnClose(fn)
+		return true
+	default:
+		return false
+	}
+}
+
+// Prefix of listener addresses that are Unix socket paths
+const unixListenerPrefix = "unix:"
+
+// ListenerConfig describes an address SmartProxy accepts clients on
+type ListenerConfig struct {
+	Address  string // host:port, [ipv6]:port or unix:/path.sock
+	TLSCert  string // serve TLS when both are set, reloaded on change
+	TLSKey   string
+	SkipAuth bool          // accept requests without credentials
+	Upstream *UpstreamInfo // upstream for requests without credentials
+
+	// Transparent accepts connections redirected by iptables or nftables
+	// instead of proxy requests. Upstream is the default for clients not
+	// matched by a client ACL policy.
+	Transparent bool
+
+	// Client certificates verified against ClientCA may be mapped by subject
+	// common name or full subject to an upstream profile
+	ClientCA          string
+	RequireClientCert bool
+	ClientUpstreams   map[string]*UpstreamInfo
+}
+
+// listenerContextKey stores the ListenerConfig of a connection in request contexts
+type listenerContextKey struct{}
+
+// listenerFromContext returns the listener a request arrived on, if known
+func listenerFromContext(ctx context.Context) *ListenerConfig {
+	lc, _ := ctx.Value(listenerContextKey{}).(*ListenerConfig)
+	return lc
+}
+
+// listen opens a listener, refusing clients outside the client ACL before
+// the TLS handshake or transparent sniffing and tracking connection lifetimes
+func (s *Server) listen(lc *ListenerConfig) (net.Listener, error) {
+	if lc.Transparent && !transparentSupported {
+		return nil, fmt.Errorf("listener %s: transparent proxy requires Linux", lc.Address)
+	}
+
+	network, address := "tcp", lc.Address
+	if path, ok := strings.CutPrefix(lc.Address, unixListenerPrefix); ok {
+		network, address = "unix", path
+		// Remove a socket left behind by an unclean shutdown
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+	}
+
+	if lc.Transparent && (network != "tcp" || lc.TLSCert != "") {
+		return nil, fmt.Errorf("listener %s: transparent listeners must be plain TCP", lc.Address)
+	}
+
+	var tlsConfig *tls.Config
+	if lc.TLSCert != "" || lc.TLSKey != "" {
+		reloader, err := newTLSReloader(lc, s.logger)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", lc.Address, err)
+		}
+		tlsConfig = &tls.Config{GetConfigForClient: reloader.getConfigForClient}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %w", lc.Address, err)
+	}
+	listener = &aclListener{Listener: listener, logger: s.logger}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	if lc.Transparent {
+		listener = s.newTransparentListener(listener, lc)
+	}
+	return &trackingListener{Listener: listener}, nil
+}
@@ -0,0 +1,373 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Key types of MITM leaf certificates
+const (
+	MITMKeyECDSA = "ecdsa" // P-256
+	MITMKeyRSA   = "rsa"   // 2048 bits
+)
+
+// Leaf certificates are valid this long when no validity is configured
+const defaultMITMCertValidity = 30 * 24 * time.Hour
+
+// Leaf certificates kept in memory when no cache size is configured
+const defaultMITMCertCacheSize = 1000
+
+// Leaf certificates start this long before they are signed, for clients
+// with a slow clock
+const mitmCertBackdate = time.Hour
+
+// MITMCertConfig controls the leaf certificates signed for intercepted hosts
+type MITMCertConfig struct {
+	KeyType   string        // MITMKeyECDSA (default) or MITMKeyRSA
+	Validity  time.Duration // capped at the expiry of the CA
+	CacheSize int           // certificates kept in memory
+	Wildcard  bool          // sign *.example.com once for all its subdomains
+	CacheDir  string        // certificates kept across restarts, empty to keep them in memory
+}
+
+// certCache signs leaf certificates for MITM with the CA and keeps the most
+// recently used ones. Concurrent requests for the same certificate wait for
+// one signing.
+type certCache struct {
+	ca     tls.Certificate
+	caLeaf *x509.Certificate
+	config MITMCertConfig
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // certificate name -> *certEntry
+	lru     *list.List
+	pending map[string]*certCall
+
+	hits      atomic.Uint64
+	loaded    atomic.Uint64 // read from the cache directory
+	generated atomic.Uint64
+	genTotal  atomic.Int64 // nanoseconds spent generating
+	genMax    atomic.Int64
+}
+
+// certEntry is a cached certificate
+type certEntry struct {
+	name string
+	cert *tls.Certificate
+}
+
+// certCall is a certificate being loaded or generated
+type certCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// newCertCache checks the settings and the CA that signs leaf certificates
+func newCertCache(ca tls.Certificate, config MITMCertConfig, logger *slog.Logger) (*certCache, error) {
+	switch config.KeyType {
+	case "":
+		config.KeyType = MITMKeyECDSA
+	case MITMKeyECDSA, MITMKeyRSA:
+	default:
+		return nil, fmt.Errorf("unknown MITM key type %q, use %s or %s", config.KeyType, MITMKeyECDSA, MITMKeyRSA)
+	}
+	if config.Validity <= 0 {
+		config.Validity = defaultMITMCertValidity
+	}
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaultMITMCertCacheSize
+	}
+
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("MITM CA has no certificate")
+	}
+	caLeaf := ca.Leaf
+	if caLeaf == nil {
+		var err error
+		if caLeaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("invalid MITM CA certificate: %w", err)
+		}
+	}
+	if _, ok := ca.PrivateKey.(crypto.Signer); !ok {
+		return nil, fmt.Errorf("unsupported MITM CA key type %T", ca.PrivateKey)
+	}
+	if config.CacheDir != "" {
+		if err := os.MkdirAll(config.CacheDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create MITM certificate cache: %w", err)
+		}
+	}
+
+	return &certCache{
+		ca:      ca,
+		caLeaf:  caLeaf,
+		config:  config,
+		logger:  logger,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]*certCall),
+	}, nil
+}
+
+// tlsConfig returns the TLS configuration for a MITM connection to host,
+// as goproxy.ConnectAction.TLSConfig
+func (c *certCache) tlsConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	cert, err := c.certificate(host)
+	if err != nil {
+		c.logger.Warn("Failed to sign MITM certificate", "host", host, "error", err)
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil
+}
+
+// certificate returns a leaf certificate for host, which may include a port
+func (c *certCache) certificate(host string) (*tls.Certificate, error) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	name := c.certName(normalizeHost(host))
+
+	c.mu.Lock()
+	if element, ok := c.entries[name]; ok {
+		entry := element.Value.(*certEntry)
+		if c.fresh(entry.cert.Leaf) {
+			c.lru.MoveToFront(element)
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return entry.cert, nil
+		}
+		c.lru.Remove(element)
+		delete(c.entries, name)
+	}
+	if call, ok := c.pending[name]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	call := &certCall{done: make(chan struct{})}
+	c.pending[name] = call
+	c.mu.Unlock()
+
+	call.cert, call.err = c.load(name)
+	if call.err != nil {
+		call.cert, call.err = c.generate(name)
+	}
+
+	c.mu.Lock()
+	delete(c.pending, name)
+	if call.err == nil {
+		c.entries[name] = c.lru.PushFront(&certEntry{name: name, cert: call.cert})
+		for c.lru.Len() > c.config.CacheSize {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*certEntry).name)
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.cert, call.err
+}
+
+// certName returns the name a certificate for host is signed for. With
+// wildcards, hosts share a certificate for *. and their registrable domain
+// or parent domain; public suffixes never get a wildcard.
+func (c *certCache) certName(host string) string {
+	if !c.config.Wildcard || net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return host
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil && domain == host {
+		return "*." + host
+	}
+	parent := host[strings.IndexByte(host, '.')+1:]
+	if suffix, _ := publicsuffix.PublicSuffix(parent); suffix == parent {
+		return host
+	}
+	return "*." + parent
+}
+
+// fresh reports whether a certificate is far enough from expiry to be used.
+// Certificates expiring with the CA are used until they expire.
+func (c *certCache) fresh(leaf *x509.Certificate) bool {
+	if !leaf.NotAfter.Before(c.caLeaf.NotAfter) {
+		return time.Now().Before(leaf.NotAfter)
+	}
+	return time.Now().Add(c.config.Validity / 4).Before(leaf.NotAfter)
+}
+
+// generate signs a new certificate for name
+func (c *certCache) generate(name string) (*tls.Certificate, error) {
+	start := time.Now()
+
+	var key crypto.Signer
+	var err error
+	keyUsage := x509.KeyUsageDigitalSignature
+	if c.config.KeyType == MITMKeyRSA {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := start.Add(c.config.Validity)
+	if notAfter.After(c.caLeaf.NotAfter) {
+		notAfter = c.caLeaf.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"SmartProxy MITM"}},
+		NotBefore:             start.Add(-mitmCertBackdate),
+		NotAfter:              notAfter,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+		if domain, ok := strings.CutPrefix(name, "*."); ok {
+			template.DNSNames = append(template.DNSNames, domain)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.caLeaf, key.Public(), c.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := c.chain(der, key)
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := time.Since(start)
+	c.generated.Add(1)
+	c.genTotal.Add(int64(elapsed))
+	for {
+		longest := c.genMax.Load()
+		if int64(elapsed) <= longest || c.genMax.CompareAndSwap(longest, int64(elapsed)) {
+			break
+		}
+	}
+	c.logger.Debug("Generated MITM certificate",
+		"name", name,
+		"key_type", c.config.KeyType,
+		"duration", elapsed)
+
+	if c.config.CacheDir != "" {
+		if err := c.save(name, der, key); err != nil {
+			c.logger.Warn("Failed to save MITM certificate", "name", name, "error", err)
+		}
+	}
+	return cert, nil
+}
+
+// chain returns a certificate with the CA chain for a signed leaf
+func (c *certCache) chain(der []byte, key crypto.PrivateKey) (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: append([][]byte{der}, c.ca.Certificate...),
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// certFile returns the cache file of a certificate name
+func (c *certCache) certFile(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(c.config.CacheDir, hex.EncodeToString(sum[:16])+".pem")
+}
+
+// save writes a certificate and its key to the cache directory
+func (c *certCache) save(name string, der []byte, key crypto.Signer) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	content = append(content, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	return writeFileAtomicMode(c.certFile(name), content, 0o600)
+}
+
+// load reads a certificate from the cache directory. Certificates of another
+// CA, key type or name, and those close to expiry, are not used.
+func (c *certCache) load(name string) (*tls.Certificate, error) {
+	if c.config.CacheDir == "" {
+		return nil, os.ErrNotExist
+	}
+	content, err := os.ReadFile(c.certFile(name))
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(content, content)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := leaf.CheckSignatureFrom(c.caLeaf); err != nil {
+		return nil, err
+	}
+	keyType := MITMKeyECDSA
+	if leaf.PublicKeyAlgorithm == x509.RSA {
+		keyType = MITMKeyRSA
+	}
+	if keyType != c.config.KeyType || leaf.Subject.CommonName != name || !c.fresh(leaf) {
+		return nil, errors.New("outdated MITM certificate")
+	}
+
+	cert, err := c.chain(pair.Certificate[0], pair.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	c.loaded.Add(1)
+	c.logger.Debug("Loaded MITM certificate", "name", name)
+	return cert, nil
+}
+
+// counts returns the number of certificates served from memory, loaded from
+// the cache directory and generated, with the mean and longest generation
+// time
+func (c *certCache) counts() (hits, loaded, generated uint64, mean, longest time.Duration) {
+	generated = c.generated.Load()
+	if generated > 0 {
+		mean = time.Duration(c.genTotal.Load() / int64(generated))
+	}
+	return c.hits.Load(), c.loaded.Load(), generated, mean, time.Duration(c.genMax.Load())
+}
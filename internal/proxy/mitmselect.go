@@ -0,0 +1,343 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Hosts are tunneled this long after failed handshakes when no duration is
+// configured
+const defaultMITMBypassDuration = time.Hour
+
+// Failed handshakes in a row before a host is tunneled when no count is
+// configured
+const defaultMITMBypassFailures = 3
+
+// Most clients and hosts whose failed handshakes are counted
+const mitmFailureMaxHosts = 10000
+
+// Alerts a client sends when it refuses the MITM certificate, as Go reports
+// them. Other handshake failures, such as scanners hanging up or timeouts,
+// say nothing about the certificate and are not counted.
+var mitmCertificateAlerts = []string{
+	"remote error: tls: bad certificate",
+	"remote error: tls: unsupported certificate",
+	"remote error: tls: revoked certificate",
+	"remote error: tls: expired certificate",
+	"remote error: tls: unknown certificate",
+	"remote error: tls: unknown certificate authority",
+}
+
+// MITMSelectConfig chooses which CONNECT tunnels are intercepted in MITM mode
+type MITMSelectConfig struct {
+	Hosts   []string // domain patterns to intercept, all hosts when empty
+	Exclude []string // domain patterns never intercepted, checked first
+
+	AutoBypass     bool          // tunnel hosts to clients that refuse the MITM certificate
+	BypassFailures int           // failed handshakes in a row before a host is tunneled
+	BypassDuration time.Duration // how long the host is tunneled to the client
+}
+
+// mitmSelection is a compiled MITMSelectConfig
+type mitmSelection struct {
+	config  *MITMSelectConfig
+	hosts   *domainMatcher // nil intercepts all hosts
+	exclude *domainMatcher
+}
+
+// mitmFailureKey identifies a host as seen by one client, so a client
+// without the CA installed does not turn off interception for the others
+type mitmFailureKey struct {
+	client netip.Addr
+	host   string
+}
+
+// mitmFailure counts the failed handshakes of a client with a host
+type mitmFailure struct {
+	count       int
+	bypassUntil time.Time
+}
+
+// mitmHandshake is a MITM handshake goproxy runs for a client
+type mitmHandshake struct {
+	client netip.Addr
+	host   string
+}
+
+// Global MITM selection state, replaced on config reload. Failed handshakes
+// are kept across reloads while auto-bypass stays enabled.
+var (
+	mitmSelectMutex   sync.RWMutex
+	currentMITMSelect *mitmSelection
+
+	mitmFailureMutex sync.Mutex
+	mitmFailures     = make(map[mitmFailureKey]*mitmFailure)
+
+	// Handshakes by the session number goproxy logs their failure with. The
+	// number has 16 bits, which bounds the map.
+	mitmHandshakeMutex sync.Mutex
+	mitmHandshakes     = make(map[int64]mitmHandshake)
+)
+
+// SetMITMSelectConfig updates which hosts are intercepted in MITM mode
+func SetMITMSelectConfig(config *MITMSelectConfig) error {
+	selection, err := compileMITMSelect(config)
+	if err != nil {
+		return err
+	}
+	installMITMSelect(selection)
+	return nil
+}
+
+// compileMITMSelect compiles the MITM host patterns without installing them,
+// nil to intercept all hosts
+func compileMITMSelect(config *MITMSelectConfig) (*mitmSelection, error) {
+	if config == nil {
+		return nil, nil
+	}
+	selection := &mitmSelection{config: config}
+	if len(config.Hosts) > 0 {
+		hosts, err := newDomainMatcher(config.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mitm hosts: %w", err)
+		}
+		selection.hosts = hosts
+	}
+	exclude, err := newDomainMatcher(config.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mitm exclude: %w", err)
+	}
+	selection.exclude = exclude
+	return selection, nil
+}
+
+// installMITMSelect replaces the MITM selection, forgetting failed
+// handshakes unless auto-bypass stays enabled
+func installMITMSelect(selection *mitmSelection) {
+	mitmSelectMutex.Lock()
+	currentMITMSelect = selection
+	mitmSelectMutex.Unlock()
+
+	if selection == nil || !selection.config.AutoBypass {
+		mitmFailureMutex.Lock()
+		mitmFailures = make(map[mitmFailureKey]*mitmFailure)
+		mitmFailureMutex.Unlock()
+	}
+}
+
+// loadMITMSelect returns the MITM selection, nil to intercept all hosts
+func loadMITMSelect() *mitmSelection {
+	mitmSelectMutex.RLock()
+	defer mitmSelectMutex.RUnlock()
+	return currentMITMSelect
+}
+
+// mitmHostname returns the lowercase host of a CONNECT target
+func mitmHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return normalizeHost(host)
+}
+
+// shouldIntercept reports whether a CONNECT from client to host is
+// intercepted, with the reason when it is tunneled instead
+func shouldIntercept(host string, client netip.Addr) (bool, string) {
+	selection := loadMITMSelect()
+	if selection == nil {
+		return true, ""
+	}
+	hostname := mitmHostname(host)
+	if pattern, ok := selection.exclude.match(hostname); ok {
+		return false, "excluded by " + pattern
+	}
+	if selection.hosts != nil {
+		if _, ok := selection.hosts.match(hostname); !ok {
+			return false, "not in mitm hosts"
+		}
+	}
+	if selection.config.AutoBypass && mitmBypassed(mitmFailureKey{client: client, host: hostname}) {
+		return false, "auto bypass after failed handshakes"
+	}
+	return true, ""
+}
+
+// mitmBypassed reports whether a host is tunneled to a client after failed
+// handshakes
+func mitmBypassed(key mitmFailureKey) bool {
+	mitmFailureMutex.Lock()
+	defer mitmFailureMutex.Unlock()
+	failure, ok := mitmFailures[key]
+	if !ok || failure.bypassUntil.IsZero() {
+		return false
+	}
+	if time.Now().Before(failure.bypassUntil) {
+		return true
+	}
+	// Try intercepting again
+	delete(mitmFailures, key)
+	return false
+}
+
+// trackMITMHandshakes wraps a goproxy.ConnectAction.TLSConfig to remember
+// the client of each handshake, which goproxy leaves out when it logs the
+// handshake failing
+func trackMITMHandshakes(tlsConfig func(string, *goproxy.ProxyCtx) (*tls.Config, error)) func(string, *goproxy.ProxyCtx) (*tls.Config, error) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		config, err := tlsConfig(host, ctx)
+		if err == nil && ctx.Req != nil {
+			mitmHandshakeMutex.Lock()
+			mitmHandshakes[ctx.Session&0xFFFF] = mitmHandshake{
+				client: remoteAddrIP(ctx.Req.RemoteAddr),
+				host:   mitmHostname(host),
+			}
+			mitmHandshakeMutex.Unlock()
+		}
+		return config, err
+	}
+}
+
+// mitmHandshakeClient returns the client of the handshake goproxy logged
+// with session for host
+func mitmHandshakeClient(session int64, host string) (netip.Addr, bool) {
+	mitmHandshakeMutex.Lock()
+	defer mitmHandshakeMutex.Unlock()
+	handshake, ok := mitmHandshakes[session]
+	if !ok || handshake.host != mitmHostname(host) {
+		return netip.Addr{}, false
+	}
+	delete(mitmHandshakes, session)
+	return handshake.client, true
+}
+
+// mitmCertificateRejected reports whether a handshake failed because the
+// client refused the certificate
+func mitmCertificateRejected(reason string) bool {
+	for _, alert := range mitmCertificateAlerts {
+		if strings.HasSuffix(reason, alert) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordMITMHandshakeFailure counts a client refusing the certificate of an
+// intercepted host, and tunnels the host to the client once it refused it
+// often enough
+func recordMITMHandshakeFailure(client netip.Addr, host, reason string, logger *slog.Logger) {
+	hostname := mitmHostname(host)
+	logger.Debug("MITM handshake with client failed", "client", client, "host", hostname, "error", reason)
+
+	selection := loadMITMSelect()
+	if selection == nil || !selection.config.AutoBypass || !client.IsValid() || !mitmCertificateRejected(reason) {
+		return
+	}
+	limit := selection.config.BypassFailures
+	if limit <= 0 {
+		limit = defaultMITMBypassFailures
+	}
+	duration := selection.config.BypassDuration
+	if duration <= 0 {
+		duration = defaultMITMBypassDuration
+	}
+
+	key := mitmFailureKey{client: client, host: hostname}
+	mitmFailureMutex.Lock()
+	defer mitmFailureMutex.Unlock()
+	failure, ok := mitmFailures[key]
+	if !ok {
+		if len(mitmFailures) >= mitmFailureMaxHosts {
+			pruneMITMFailures()
+			if len(mitmFailures) >= mitmFailureMaxHosts {
+				return
+			}
+		}
+		failure = &mitmFailure{}
+		mitmFailures[key] = failure
+	}
+	if !failure.bypassUntil.IsZero() {
+		return
+	}
+	failure.count++
+	if failure.count >= limit {
+		failure.bypassUntil = time.Now().Add(duration)
+		logger.Info("Tunneling host without MITM after failed handshakes",
+			"client", client,
+			"host", hostname,
+			"failures", failure.count,
+			"duration", duration,
+			"last_error", reason)
+	}
+}
+
+// recordMITMSuccess forgets the failed handshakes of a client with a host
+// once it sends a request through the intercepted tunnel
+func recordMITMSuccess(client netip.Addr, hostname string) {
+	key := mitmFailureKey{client: client, host: normalizeHost(hostname)}
+	mitmFailureMutex.Lock()
+	defer mitmFailureMutex.Unlock()
+	if failure, ok := mitmFailures[key]; ok && failure.bypassUntil.IsZero() {
+		delete(mitmFailures, key)
+	}
+}
+
+// pruneMITMFailures drops expired bypasses, then hosts still being counted.
+// The caller holds mitmFailureMutex.
+func pruneMITMFailures() {
+	now := time.Now()
+	for key, failure := range mitmFailures {
+		if !failure.bypassUntil.IsZero() && now.After(failure.bypassUntil) {
+			delete(mitmFailures, key)
+		}
+	}
+	for key, failure := range mitmFailures {
+		if len(mitmFailures) < mitmFailureMaxHosts {
+			break
+		}
+		if failure.bypassUntil.IsZero() {
+			delete(mitmFailures, key)
+		}
+	}
+}
+
+// goproxyLogger writes goproxy's messages to the log. goproxy reports failed
+// client handshakes of intercepted tunnels only here, so they are counted
+// for auto-bypass.
+type goproxyLogger struct {
+	logger *slog.Logger
+}
+
+// Printf implements goproxy.Logger. Messages look like
+// "[001] WARN: Cannot handshake client example.com:443 <error>", where 001
+// is the session of the CONNECT.
+func (l goproxyLogger) Printf(format string, v ...any) {
+	message := strings.TrimSpace(fmt.Sprintf(format, v...))
+	session := int64(-1)
+	if prefix, text, ok := strings.Cut(message, "] "); ok {
+		if n, err := strconv.ParseInt(strings.TrimPrefix(prefix, "["), 10, 64); err == nil {
+			session = n
+		}
+		message = text
+	}
+	warning, ok := strings.CutPrefix(message, "WARN: ")
+	if !ok {
+		l.logger.Debug("goproxy: " + strings.TrimPrefix(message, "INFO: "))
+		return
+	}
+	if target, ok := strings.CutPrefix(warning, "Cannot handshake client "); ok {
+		host, reason, _ := strings.Cut(target, " ")
+		client, _ := mitmHandshakeClient(session, host)
+		recordMITMHandshakeFailure(client, host, reason, l.logger)
+		return
+	}
+	l.logger.Warn("goproxy: " + warning)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// logBuffer collects log output written from the proxy's goroutines
+type logBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// waitFor waits until a logged line contains all parts
+func (l *logBuffer) waitFor(parts ...string) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, line := range strings.Split(l.String(), "\n") {
+			found := true
+			for _, part := range parts {
+				found = found && strings.Contains(line, part)
+			}
+			if found {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// newMITMTestProxy starts a goproxy server that intercepts every CONNECT
+// with auto-bypass after one refused certificate
+func newMITMTestProxy(t *testing.T) (string, *logBuffer) {
+	t.Helper()
+	installMITMSelect(&mitmSelection{config: &MITMSelectConfig{AutoBypass: true, BypassFailures: 1}})
+	t.Cleanup(func() { installMITMSelect(nil) })
+
+	logs := &logBuffer{}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = goproxyLogger{logger: slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	connect := &goproxy.ConnectAction{
+		Action:    goproxy.ConnectMitm,
+		TLSConfig: trackMITMHandshakes(goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)),
+	}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return connect, host
+	})
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String(), logs
+}
+
+// connectMITM opens an intercepted tunnel to host through the proxy
+func connectMITM(t *testing.T, proxyAddr, host string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+	return conn
+}
+
+// The loopback address test clients connect from
+var mitmTestClient = netip.MustParseAddr("127.0.0.1")
+
+// A client refusing the certificate is reported by goproxy in the message
+// format goproxyLogger parses, and counted for that client only
+func TestMITMBypassAfterRefusedCertificate(t *testing.T) {
+	proxyAddr, logs := newMITMTestProxy(t)
+	conn := connectMITM(t, proxyAddr, "refused.test:443")
+
+	client := tls.Client(conn, &tls.Config{ServerName: "refused.test"})
+	if err := client.Handshake(); err == nil {
+		t.Fatal("handshake with an untrusted CA succeeded")
+	}
+	if !logs.waitFor("Tunneling host without MITM", "client=127.0.0.1", "host=refused.test") {
+		t.Fatalf("refused certificate not counted, log:\n%s", logs)
+	}
+	if !mitmBypassed(mitmFailureKey{client: mitmTestClient, host: "refused.test"}) {
+		t.Error("host not tunneled after the client refused the certificate")
+	}
+
+	other := mitmFailureKey{client: netip.MustParseAddr("192.0.2.1"), host: "refused.test"}
+	if mitmBypassed(other) {
+		t.Error("host tunneled to a client that did not refuse the certificate")
+	}
+	if intercept, _ := shouldIntercept("refused.test:443", mitmTestClient); intercept {
+		t.Error("CONNECT still intercepted for the refusing client")
+	}
+}
+
+// Clients hanging up without an alert say nothing about the certificate
+func TestMITMNoBypassWithoutCertificateAlert(t *testing.T) {
+	proxyAddr, logs := newMITMTestProxy(t)
+	conn := connectMITM(t, proxyAddr, "hangup.test:443")
+	conn.Close()
+
+	if !logs.waitFor("MITM handshake with client failed", "client=127.0.0.1", "host=hangup.test") {
+		t.Fatalf("failed handshake not logged, log:\n%s", logs)
+	}
+	if mitmBypassed(mitmFailureKey{client: mitmTestClient, host: "hangup.test"}) {
+		t.Error("host tunneled after a client closed the connection")
+	}
+}
+
+func TestMITMCertificateRejected(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   bool
+	}{
+		{"remote error: tls: bad certificate", true},
+		{"remote error: tls: unknown certificate authority", true},
+		{"remote error: tls: unknown certificate", true},
+		{"EOF", false},
+		{"read tcp 127.0.0.1:8888->127.0.0.1:50000: i/o timeout", false},
+		{"tls: first record does not look like a TLS handshake", false},
+		{"remote error: tls: protocol version not supported", false},
+	}
+	for _, tt := range tests {
+		if got := mitmCertificateRejected(tt.reason); got != tt.want {
+			t.Errorf("mitmCertificateRejected(%q) = %v, want %v", tt.reason, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// Socket option of the netfilter NAT original destination, for IPv4 and IPv6
+const soOriginalDst = 80
+
+// transparentSupported reports whether transparent listeners can be used
+const transparentSupported = true
+
+// originalDestination returns the destination a connection had before it
+// was redirected by iptables or nftables
+func originalDestination(conn net.Conn) (netip.AddrPort, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	local := tcpConn.LocalAddr().(*net.TCPAddr).AddrPort().Addr()
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Unmap().Is4() {
+			// The option returns a sockaddr_in, which fits in this struct
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); sockErr == nil {
+				port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(mreq.Multiaddr[4:8])), port)
+			}
+			return
+		}
+		// The option returns a sockaddr_in6, which fits in this struct
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); sockErr == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if sockErr != nil {
+		return netip.AddrPort{}, fmt.Errorf("SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()), nil
+}
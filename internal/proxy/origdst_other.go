@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// transparentSupported reports whether transparent listeners can be used
+const transparentSupported = false
+
+// originalDestination is only supported on Linux
+func originalDestination(net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("transparent proxy requires Linux")
+}
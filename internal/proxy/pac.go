@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPACPath is where the PAC file is served when no path is configured
+const DefaultPACPath = "/proxy.pac"
+
+// Placeholder for the proxy address, filled in per PAC request
+const pacProxyPlaceholder = "{{SMARTPROXY_ADDRESS}}"
+
+// Most blocked domains embedded in the PAC file. Beyond this browsers would
+// download and parse megabytes of block lists, so only the blocked domains
+// the direct domains overlap are embedded and the shortcuts the PAC file
+// cannot check against the rest are left to SmartProxy.
+const pacMaxAdDomains = 10000
+
+// PACConfig contains proxy auto-config serving settings
+type PACConfig struct {
+	Enabled      bool
+	Path         string
+	ProxyAddress string // host:port clients use, defaults to the Host of the PAC request
+}
+
+// Global PAC state, regenerated by SetPACConfig
+var (
+	pacMutex   sync.RWMutex
+	pacConfig  *PACConfig
+	pacScript  string
+	pacModTime time.Time
+)
+
+// SetPACConfig updates PAC settings and regenerates the PAC file from the
+// current routing rules, ad domains and direct routing lists. Call it after
+// those have been updated.
+func SetPACConfig(config *PACConfig) {
+	var script string
+	if config != nil && config.Enabled {
+		script = generatePAC()
+	}
+
+	pacMutex.Lock()
+	pacConfig = config
+	pacScript = script
+	pacModTime = time.Now()
+	pacMutex.Unlock()
+}
+
+// regeneratePAC rebuilds the PAC file with the current settings, after a
+// list it mirrors changed outside a reload
+func regeneratePAC() {
+	pacMutex.RLock()
+	config := pacConfig
+	pacMutex.RUnlock()
+	if config != nil && config.Enabled {
+		SetPACConfig(config)
+	}
+}
+
+// pacRequest reports whether r asks for the PAC file and returns the script
+func pacRequest(r *http.Request) (string, *PACConfig, time.Time, bool) {
+	pacMutex.RLock()
+	defer pacMutex.RUnlock()
+
+	if pacConfig == nil || !pacConfig.Enabled {
+		return "", nil, time.Time{}, false
+	}
+	path := pacConfig.Path
+	if path == "" {
+		path = DefaultPACPath
+	}
+	if r.URL.Path != path {
+		return "", nil, time.Time{}, false
+	}
+	return pacScript, pacConfig, pacModTime, true
+}
+
+// servePAC writes the PAC file with the proxy address clients should use
+func (s *Server) servePAC(w http.ResponseWriter, r *http.Request, script string, config *PACConfig, modTime time.Time) {
+	address := config.ProxyAddress
+	if address == "" {
+		address = r.Host
+	}
+
+	s.logger.Debug("Serving PAC file",
+		"remote_addr", r.RemoteAddr,
+		"proxy_address", address)
+
+	// Browsers must speak TLS to SmartProxy when the PAC came over a TLS listener
+	proxyType := "PROXY "
+	if lc := listenerFromContext(r.Context()); lc != nil && lc.TLSCert != "" {
+		proxyType = "HTTPS "
+	}
+
+	body := strings.Replace(script, jsString(pacProxyPlaceholder), jsString(proxyType+address), 1)
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	http.ServeContent(w, r, "proxy.pac", modTime, strings.NewReader(body))
+}
+
+// generatePAC builds a PAC script that mirrors Server.route: routing rules
+// first, then ad domains, static files and direct domains. Everything the
+// browser cannot decide on its own is sent to SmartProxy.
+func generatePAC() string {
+	var b strings.Builder
+
+	b.WriteString("// Generated by SmartProxy. Do not edit, changes are lost on reload.\n")
+	fmt.Fprintf(&b, "var proxy = %s;\n", jsString(pacProxyPlaceholder))
+	adDomains := currentAdDomains()
+	extensions := currentStaticExtensions()
+	direct := currentDirectDomains(nil, nil)
+	exact, suffix, wildcard, firstLabels, keywords := direct.domainSets()
+	if len(adDomains) > pacMaxAdDomains {
+		// Static files and keyword and first label matches may be on any
+		// blocked host, so they go to SmartProxy to be decided there
+		b.WriteString("// Too many ad domains to embed, only those overlapping direct domains are.\n")
+		adDomains = directAdDomains(adDomains, direct)
+		extensions, firstLabels, keywords = nil, nil, nil
+		if len(adDomains) > pacMaxAdDomains {
+			// Nothing goes direct by domain then
+			adDomains, exact, suffix, wildcard = nil, nil, nil, nil
+		}
+	}
+	fmt.Fprintf(&b, "var adDomains = %s;\n", jsSet(adDomains))
+	fmt.Fprintf(&b, "var directExtensions = %s;\n", jsSet(extensions))
+	fmt.Fprintf(&b, "var directExact = %s;\n", jsSet(exact))
+	fmt.Fprintf(&b, "var directSuffix = %s;\n", jsSet(suffix))
+	fmt.Fprintf(&b, "var directWildcard = %s;\n", jsSet(wildcard))
+	fmt.Fprintf(&b, "var directFirstLabels = %s;\n", jsSet(firstLabels))
+	fmt.Fprintf(&b, "var directKeywords = %s;\n", jsArray(keywords))
+
+	routingRulesMutex.RLock()
+	rules := routingRules
+	routingRulesMutex.RUnlock()
+
+	var ruleBody strings.Builder
+	var regexes []string
+	catchAll := false
+	for _, rule := range rules {
+		cond, ok := pacRuleCondition(rule.rule, &regexes)
+		action := "proxy"
+		if ok && rule.decision.Action == ActionDirect {
+			action = `"DIRECT"`
+		}
+		fmt.Fprintf(&ruleBody, "  // %s\n", strings.Join(strings.Fields(rule.name), " "))
+		if cond == "" {
+			// A rule without host or port conditions may match anything
+			fmt.Fprintf(&ruleBody, "  return %s;\n", action)
+			catchAll = true
+			break
+		}
+		fmt.Fprintf(&ruleBody, "  if (%s) return %s;\n", cond, action)
+	}
+
+	for i, expr := range regexes {
+		fmt.Fprintf(&b, "var re%d = new RegExp(%s, \"i\");\n", i, jsString(expr))
+	}
+
+	b.WriteString(`
+function hasSuffix(s, suffix) {
+  return s.length >= suffix.length && s.substring(s.length - suffix.length) == suffix;
+}
+
+function isAdDomain(host) {
+  var h = host;
+  while (true) {
+    if (adDomains.hasOwnProperty(h)) return true;
+    var dot = h.indexOf(".");
+    if (dot < 0) return false;
+    h = h.substring(dot + 1);
+  }
+}
+
+function isStaticFile(url) {
+  if (url.substring(0, 5).toLowerCase() != "http:") return false;
+  var path = url.replace(/^[a-z]+:\/\/[^\/?#]*/i, "").replace(/[?#].*$/, "").toLowerCase();
+  var dot = path.lastIndexOf(".");
+  return dot >= 0 && dot < path.length - 1 && directExtensions.hasOwnProperty(path.substring(dot));
+}
+
+function isDirectDomain(host) {
+  if (directExact.hasOwnProperty(host)) return true;
+  var h = host;
+  var sub = false;
+  while (true) {
+    if (directSuffix.hasOwnProperty(h)) return true;
+    if (sub && directWildcard.hasOwnProperty(h)) return true;
+    var dot = h.indexOf(".");
+    if (dot < 0) break;
+    h = h.substring(dot + 1);
+    sub = true;
+  }
+  var first = host.indexOf(".");
+  if (first > 0 && directFirstLabels.hasOwnProperty(host.substring(0, first))) return true;
+  for (var i = 0; i < directKeywords.length; i++) {
+    if (host.indexOf(directKeywords[i]) >= 0) return true;
+  }
+  return false;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  var m = url.match(/^([a-z]+):\/\/(\[[^\]]*\]|[^\/:?#]*)(?::(\d+))?/i);
+  var port = m && m[3] ? parseInt(m[3], 10) : (m && /^(https|wss)$/i.test(m[1]) ? 443 : 80);
+
+`)
+	b.WriteString(ruleBody.String())
+	if !catchAll {
+		b.WriteString(`
+  // Ad domains go to SmartProxy so they are blocked there
+  if (isAdDomain(host)) return proxy;
+  if (isStaticFile(url)) return "DIRECT";
+  if (isDirectDomain(host)) return "DIRECT";
+  return proxy;
+`)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// pacRuleCondition translates the host and port conditions of a rule to
+// JavaScript. It reports false when the rule has conditions a browser cannot
+// evaluate, in which case matching requests must go to SmartProxy.
+func pacRuleCondition(rule RoutingRule, regexes *[]string) (string, bool) {
+	var conds []string
+
+	if len(rule.Hosts) > 0 {
+		var alts []string
+		for _, pattern := range rule.Hosts {
+			alts = append(alts, pacHostCondition(pattern, regexes))
+		}
+		conds = append(conds, jsAny(alts))
+	}
+	if len(rule.Ports) > 0 {
+		var alts []string
+		for _, port := range rule.Ports {
+			alts = append(alts, fmt.Sprintf("port == %d", port))
+		}
+		conds = append(conds, jsAny(alts))
+	}
+
+	evaluable := len(rule.Paths) == 0 && len(rule.Extensions) == 0 && len(rule.Methods) == 0 &&
+		len(rule.ClientIPs) == 0 && len(rule.Users) == 0 && len(rule.UserAgents) == 0 &&
+		len(rule.Countries) == 0 && len(rule.ASNs) == 0
+	return strings.Join(conds, " && "), evaluable
+}
+
+// jsAny joins JavaScript conditions with ||
+func jsAny(conds []string) string {
+	if len(conds) == 1 {
+		return conds[0]
+	}
+	return "(" + strings.Join(conds, " || ") + ")"
+}
+
+// pacHostCondition translates a host pattern the same way compileHostPattern does
+func pacHostCondition(pattern string, regexes *[]string) string {
+	pattern = strings.TrimSpace(pattern)
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		*regexes = append(*regexes, pattern[len(regexPatternPrefix):])
+		return fmt.Sprintf("re%d.test(host)", len(*regexes)-1)
+	}
+
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	switch {
+	case strings.Contains(pattern, "*"):
+		*regexes = append(*regexes, wildcardExpr(pattern))
+		return fmt.Sprintf("re%d.test(host)", len(*regexes)-1)
+	case strings.HasPrefix(pattern, "."):
+		return fmt.Sprintf("(host == %s || hasSuffix(host, %s))", jsString(pattern[1:]), jsString(pattern))
+	default:
+		return fmt.Sprintf("host == %s", jsString(pattern))
+	}
+}
+
+// currentAdDomains returns the blocked domains without exceptions, sorted.
+// None are blocked in the PAC file when clients have their own policies.
+func currentAdDomains() []string {
+	filter := loadAdFilter()
+	if filter == nil {
+		return nil
+	}
+	policies := loadAdPolicies()
+	allowed, ok := policies.pacExceptions()
+	if !ok {
+		return nil
+	}
+
+	// Leave domains above an allowlisted one to SmartProxy as well
+	withAllowed := make(map[string]bool)
+	for _, domain := range allowed {
+		domainLevels(domain, func(level string) bool {
+			withAllowed[level] = true
+			return false
+		})
+	}
+
+	var domains []string
+	for _, domain := range filter.pacDomains() {
+		if _, ok := policies.allowed(nil, domain); !ok && !withAllowed[domain] {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// directAdDomains returns the blocked domains a direct domain pattern could
+// send direct: those it matches and those above a direct domain
+func directAdDomains(domains []string, direct *domainMatcher) []string {
+	exact, suffix, wildcard, _, _ := direct.domainSets()
+	above := make(map[string]bool)
+	for _, list := range [][]string{exact, suffix, wildcard} {
+		for _, domain := range list {
+			domainLevels(domain, func(level string) bool {
+				above[level] = true
+				return false
+			})
+		}
+	}
+
+	var overlap []string
+	for _, domain := range domains {
+		if _, ok := direct.match(domain); ok || above[domain] {
+			overlap = append(overlap, domain)
+		}
+	}
+	return overlap
+}
+
+// currentStaticExtensions returns the static file extensions, sorted
+func currentStaticExtensions() []string {
+	staticExtMutex.RLock()
+	defer staticExtMutex.RUnlock()
+
+	extensions := make([]string, 0, len(staticExtMap))
+	for ext := range staticExtMap {
+		extensions = append(extensions, ext)
+	}
+	sort.Strings(extensions)
+	return extensions
+}
+
+// jsString encodes s as a JavaScript string literal
+func jsString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+// jsArray encodes values as a JavaScript array literal
+func jsArray(values []string) string {
+	if values == nil {
+		values = []string{}
+	}
+	encoded, _ := json.Marshal(values)
+	return string(encoded)
+}
+
+// jsSet encodes values as a JavaScript object used as a set
+func jsSet(values []string) string {
+	set := make(map[string]int, len(values))
+	for _, value := range values {
+		set[value] = 1
+	}
+	encoded, _ := json.Marshal(set)
+	return string(encoded)
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitRule limits requests and concurrent tunnels of a single key
+type RateLimitRule struct {
+	RequestsPerSecond    float64 // 0 = unlimited
+	Burst                int
+	MaxConcurrentTunnels int // 0 = unlimited
+}
+
+// RateLimitConfig contains request rate and tunnel limits per client IP and
+// per authenticated identity
+type RateLimitConfig struct {
+	Enabled     bool
+	PerIP       RateLimitRule
+	PerIdentity RateLimitRule
+}
+
+// requestLimiterEntry holds a request limiter and its last used time
+type requestLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// Global rate limiting state
+var (
+	rateLimitMutex   sync.Mutex
+	rateLimitConfig  *RateLimitConfig
+	requestLimiters  = make(map[string]*requestLimiterEntry) // keyed by ip:<addr> or cred:<id>
+	concurrentTunnel = make(map[string]int)
+)
+
+// SetRateLimitConfig updates request rate and tunnel limits at runtime
+func SetRateLimitConfig(config *RateLimitConfig) {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	rateLimitConfig = config
+	for key, entry := range requestLimiters {
+		rule := rateLimitRuleFor(key)
+		entry.limiter.SetLimit(requestRate(rule))
+		entry.limiter.SetBurst(requestBurst(rule))
+	}
+}
+
+// credentialID returns a short fingerprint of a Proxy-Authorization header.
+// It identifies a client without decoding or parsing the credentials and is
+// safe to log.
+func credentialID(authHeader string) string {
+	h := fnv.New64a()
+	h.Write([]byte(authHeader))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// clientIP returns the IP part of a remote address
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// rateLimitKeys returns the rate limit keys of a request: its client IP and,
+// when known, its credential fingerprint
+func rateLimitKeys(r *http.Request, upstream *UpstreamInfo) []string {
+	keys := []string{"ip:" + clientIP(r.RemoteAddr)}
+	if auth := r.Header.Get("Proxy-Authorization"); auth != "" {
+		keys = append(keys, "cred:"+credentialID(auth))
+	} else if upstream != nil && upstream.CredentialID != "" {
+		// MITM requests inherit the identity of their CONNECT
+		keys = append(keys, "cred:"+upstream.CredentialID)
+	}
+	return keys
+}
+
+// rateLimitRuleFor returns the rule for a key, caller must hold rateLimitMutex
+func rateLimitRuleFor(key string) RateLimitRule {
+	if rateLimitConfig == nil {
+		return RateLimitRule{}
+	}
+	if len(key) > 3 && key[:3] == "ip:" {
+		return rateLimitConfig.PerIP
+	}
+	return rateLimitConfig.PerIdentity
+}
+
+func requestRate(rule RateLimitRule) rate.Limit {
+	if rule.RequestsPerSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(rule.RequestsPerSecond)
+}
+
+func requestBurst(rule RateLimitRule) int {
+	if rule.Burst > 0 {
+		return rule.Burst
+	}
+	return int(math.Max(1, math.Ceil(rule.RequestsPerSecond)))
+}
+
+// allowRequest takes one request token for every key. When any key is over
+// its limit nothing is consumed and the time until a retry may succeed is returned.
+func allowRequest(keys []string) (time.Duration, bool) {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	if rateLimitConfig == nil || !rateLimitConfig.Enabled {
+		return 0, true
+	}
+
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(keys))
+	var retryAfter time.Duration
+	for _, key := range keys {
+		rule := rateLimitRuleFor(key)
+		if rule.RequestsPerSecond <= 0 {
+			continue
+		}
+
+		entry, ok := requestLimiters[key]
+		if !ok {
+			entry = &requestLimiterEntry{limiter: rate.NewLimiter(requestRate(rule), requestBurst(rule))}
+			requestLimiters[key] = entry
+		}
+		entry.lastUsed = now
+
+		reservation := entry.limiter.ReserveN(now, 1)
+		reservations = append(reservations, reservation)
+		if delay := reservation.DelayFrom(now); delay > retryAfter {
+			retryAfter = delay
+		}
+	}
+
+	if retryAfter > 0 {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+		return retryAfter, false
+	}
+	return 0, true
+}
+
+// acquireTunnel counts a new tunnel against every key. It returns a release
+// function, or false when any key already has its maximum of open tunnels.
+func acquireTunnel(keys []string) (func(), bool) {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	if rateLimitConfig == nil || !rateLimitConfig.Enabled {
+		return func() {}, true
+	}
+
+	for _, key := range keys {
+		rule := rateLimitRuleFor(key)
+		if rule.MaxConcurrentTunnels > 0 && concurrentTunnel[key] >= rule.MaxConcurrentTunnels {
+			return nil, false
+		}
+	}
+	for _, key := range keys {
+		concurrentTunnel[key]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rateLimitMutex.Lock()
+			defer rateLimitMutex.Unlock()
+			for _, key := range keys {
+				if concurrentTunnel[key]--; concurrentTunnel[key] <= 0 {
+					delete(concurrentTunnel, key)
+				}
+			}
+		})
+	}, true
+}
+
+// cleanupRateLimiters removes request limiters not used within maxAge
+func cleanupRateLimiters(maxAge time.Duration, logger *slog.Logger) {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	now := time.Now()
+	var cleaned int
+	for key, entry := range requestLimiters {
+		if now.Sub(entry.lastUsed) > maxAge {
+			delete(requestLimiters, key)
+			cleaned++
+		}
+	}
+
+	if cleaned > 0 {
+		logger.Debug("Rate limiter cleanup completed", "cleaned", cleaned)
+	}
+}
+
+// tooManyRequestsResponse builds a 429 response with a Retry-After header
+func tooManyRequestsResponse(r *http.Request, retryAfter time.Duration, message string) *http.Response {
+	resp := newProxyResponse(r, goproxy.ContentTypeText, http.StatusTooManyRequests, message)
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	resp.Header.Set("Retry-After", strconv.Itoa(seconds))
+	return resp
+}
+
+// checkRequestRate enforces the request rate before any credential parsing.
+// It returns a 429 response when the client is over its limit.
+func (s *Server) checkRequestRate(r *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+	upstream, _ := ctx.UserData.(*UpstreamInfo)
+	retryAfter, ok := allowRequest(rateLimitKeys(r, upstream))
+	if ok {
+		return nil
+	}
+
+	s.logger.Debug("Request rate limit exceeded",
+		"remote_addr", r.RemoteAddr,
+		"method", r.Method,
+		"host", r.Host,
+		"retry_after", retryAfter)
+	return tooManyRequestsResponse(r, retryAfter, "Too many requests")
+}
+
+// limitConnect enforces the request rate and concurrent tunnel limits for a
+// CONNECT before any credential parsing. The tunnel is released when the
+// client connection closes.
+func (s *Server) limitConnect(ctx *goproxy.ProxyCtx) bool {
+	keys := rateLimitKeys(ctx.Req, nil)
+
+	if retryAfter, ok := allowRequest(keys); !ok {
+		s.logger.Debug("CONNECT rate limit exceeded",
+			"remote_addr", ctx.Req.RemoteAddr,
+			"host", ctx.Req.Host,
+			"retry_after", retryAfter)
+		ctx.Resp = tooManyRequestsResponse(ctx.Req, retryAfter, "Too many requests")
+		return false
+	}
+
+	release, ok := acquireTunnel(keys)
+	if !ok {
+		s.logger.Debug("Concurrent tunnel limit exceeded",
+			"remote_addr", ctx.Req.RemoteAddr,
+			"host", ctx.Req.Host)
+		ctx.Resp = tooManyRequestsResponse(ctx.Req, time.Second, "Too many concurrent tunnels")
+		return false
+	}
+
+	// The hijacked client connection carries the tunnel until it closes
+	if !onConnClose(ctx.Req.Context(), release) {
+		release()
+	}
+	return true
+}
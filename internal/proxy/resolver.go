@@ -0,0 +1,701 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolution modes for targets reached through an upstream
+const (
+	ResolveRemote = "remote" // pass host names to the upstream
+	ResolveLocal  = "local"  // resolve with the built-in resolver and pass addresses
+)
+
+// Query timeout used until SetResolverConfig is called
+const defaultResolverTimeout = 5 * time.Second
+
+// Failed resolutions are cached at most this long
+const dnsNegativeCacheTTL = 30 * time.Second
+
+// Answers of the system resolver, whose record TTLs are unknown, are cached
+// at most this long
+const dnsSystemCacheTTL = 30 * time.Second
+
+// Delay before the next address is dialed while earlier attempts are still
+// pending, as recommended by RFC 8305
+const dialAttemptDelay = 250 * time.Millisecond
+
+// UDP payload size advertised with EDNS0
+const dnsUDPSize = 1232
+
+// Maximum size of a DNS message
+const dnsMaxMessageSize = 65535
+
+// ResolverConfig contains the DNS servers and cache of the built-in resolver
+// used for direct connections, routing lookups and local resolution of
+// upstream targets
+type ResolverConfig struct {
+	Servers            []string      // udp://, tcp://, tls:// (DoT) or https:// (DoH); empty uses the system resolver
+	Timeout            time.Duration // per lookup
+	CacheSize          int
+	CacheTTL           time.Duration // maximum time an answer is cached
+	UpstreamResolution string        // remote (default) or local
+}
+
+// dnsServer is a parsed DNS server address
+type dnsServer struct {
+	protocol   string // udp, tcp, tls or https
+	address    string // host:port, or the URL for https
+	serverName string // certificate name for tls
+}
+
+// dnsCacheEntry holds the addresses of a host, or the error resolving it
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+// Global resolver state, replaced on config reload
+var (
+	resolverMutex   sync.RWMutex
+	resolverConfig  *ResolverConfig
+	resolverServers []dnsServer
+
+	dnsCacheMutex sync.Mutex
+	dnsCache      = make(map[string]*dnsCacheEntry)
+
+	// dohClient sends DNS-over-HTTPS queries. It never uses a proxy.
+	dohClient = &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+)
+
+// SetResolverConfig installs the DNS servers and cache settings and clears
+// the cache. On error the current settings stay in place.
+func SetResolverConfig(config *ResolverConfig) error {
+	servers, err := compileResolverConfig(config)
+	if err != nil {
+		return err
+	}
+	installResolverConfig(config, servers)
+	return nil
+}
+
+// compileResolverConfig validates the resolver settings and parses the DNS
+// servers
+func compileResolverConfig(config *ResolverConfig) ([]dnsServer, error) {
+	var servers []dnsServer
+	if config != nil {
+		for _, entry := range config.Servers {
+			server, err := parseDNSServer(entry)
+			if err != nil {
+				return nil, fmt.Errorf("dns servers: %w", err)
+			}
+			servers = append(servers, server)
+		}
+		switch config.UpstreamResolution {
+		case "", ResolveRemote, ResolveLocal:
+		default:
+			return nil, fmt.Errorf("dns upstream_resolution: unknown mode %q", config.UpstreamResolution)
+		}
+	}
+	return servers, nil
+}
+
+// installResolverConfig replaces the resolver settings and clears the cache
+func installResolverConfig(config *ResolverConfig, servers []dnsServer) {
+	resolverMutex.Lock()
+	resolverConfig = config
+	resolverServers = servers
+	resolverMutex.Unlock()
+
+	// Answers of the previous servers may differ
+	dnsCacheMutex.Lock()
+	dnsCache = make(map[string]*dnsCacheEntry)
+	dnsCacheMutex.Unlock()
+}
+
+// parseDNSServer parses a server address. Plain addresses use UDP. A TLS
+// server name other than the host can be given as URL fragment, e.g.
+// tls://1.1.1.1#cloudflare-dns.com.
+func parseDNSServer(entry string) (dnsServer, error) {
+	if addr, err := netip.ParseAddr(entry); err == nil && addr.Is6() {
+		entry = "[" + entry + "]"
+	}
+	if !strings.Contains(entry, "://") {
+		entry = "udp://" + entry
+	}
+	u, err := url.Parse(entry)
+	if err != nil {
+		return dnsServer{}, fmt.Errorf("invalid DNS server %q: %w", entry, err)
+	}
+	if u.Host == "" {
+		return dnsServer{}, fmt.Errorf("invalid DNS server %q: missing host", entry)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return dnsServer{protocol: u.Scheme, address: withDefaultPort(u.Host, "53")}, nil
+	case "tls":
+		serverName := u.Hostname()
+		if u.Fragment != "" {
+			serverName = u.Fragment
+		}
+		return dnsServer{protocol: "tls", address: withDefaultPort(u.Host, "853"), serverName: serverName}, nil
+	case "https":
+		return dnsServer{protocol: "https", address: u.String()}, nil
+	default:
+		return dnsServer{}, fmt.Errorf("unsupported DNS server protocol %q", u.Scheme)
+	}
+}
+
+// withDefaultPort adds a port to host addresses without one
+func withDefaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+}
+
+// resolveLocally reports whether targets of a route reached through an
+// upstream are resolved by SmartProxy
+func resolveLocally(decision RouteDecision) bool {
+	switch decision.Resolve {
+	case ResolveLocal:
+		return true
+	case ResolveRemote:
+		return false
+	}
+	resolverMutex.RLock()
+	defer resolverMutex.RUnlock()
+	return resolverConfig != nil && resolverConfig.UpstreamResolution == ResolveLocal
+}
+
+// upstreamTarget returns the host:port to ask an upstream for: the address
+// as is, or with the host resolved locally
+func upstreamTarget(ctx context.Context, decision RouteDecision, address string) (string, error) {
+	if !resolveLocally(decision) {
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, nil
+	}
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addrs[0].String(), port), nil
+}
+
+// resolveHost returns the addresses of a host for routing decisions, nil if
+// it cannot be resolved. IP literals are returned as is.
+func resolveHost(host string, logger *slog.Logger) []netip.Addr {
+	addrs, err := lookupHost(context.Background(), host)
+	if err != nil {
+		logger.Debug("Failed to resolve host", "host", host, "error", err)
+	}
+	return addrs
+}
+
+// lookupHost returns the addresses of a host from the DNS cache or the
+// configured servers, IPv4 first. IP literals are returned as is.
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	host = normalizeHost(host)
+
+	now := time.Now()
+	dnsCacheMutex.Lock()
+	entry, ok := dnsCache[host]
+	dnsCacheMutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addrs, entry.err
+	}
+
+	resolverMutex.RLock()
+	config, servers := resolverConfig, resolverServers
+	resolverMutex.RUnlock()
+
+	timeout, maxTTL, size := defaultResolverTimeout, time.Duration(0), 0
+	if config != nil {
+		if config.Timeout > 0 {
+			timeout = config.Timeout
+		}
+		maxTTL, size = config.CacheTTL, config.CacheSize
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	var err error
+	if len(servers) == 0 {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		ttl = dnsSystemCacheTTL
+	} else {
+		addrs, ttl, err = queryDNSServers(ctx, servers, host)
+	}
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var dnsErr *net.DNSError
+	if err != nil {
+		// Only cache answers, not timeouts or unreachable servers
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		addrs, ttl = nil, dnsNegativeCacheTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	sortAddrs(addrs)
+
+	if ttl > 0 && size > 0 {
+		dnsCacheMutex.Lock()
+		if _, exists := dnsCache[host]; !exists && len(dnsCache) >= size {
+			evictDNSCache(now, size)
+		}
+		dnsCache[host] = &dnsCacheEntry{addrs: addrs, err: err, expires: now.Add(ttl)}
+		dnsCacheMutex.Unlock()
+	}
+	return addrs, err
+}
+
+// sortAddrs moves IPv4 addresses first, keeping their order
+func sortAddrs(addrs []netip.Addr) {
+	sorted := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Is4() {
+			sorted = append(sorted, addr)
+		}
+	}
+	for _, addr := range addrs {
+		if !addr.Is4() {
+			sorted = append(sorted, addr)
+		}
+	}
+	copy(addrs, sorted)
+}
+
+// queryDNSServers asks each server in turn until one answers
+func queryDNSServers(ctx context.Context, servers []dnsServer, host string) ([]netip.Addr, time.Duration, error) {
+	var lastErr error
+	for _, server := range servers {
+		addrs, ttl, err := server.lookup(ctx, host)
+		if err == nil {
+			return addrs, ttl, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// lookup queries A and AAAA records in parallel. The TTL is the lowest of
+// the answers.
+func (s dnsServer) lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]result, len(qtypes))
+
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, ttl, err := s.query(ctx, host, qtype)
+			results[i] = result{addrs, ttl, err}
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	var lastErr error
+	answered := false
+	for _, r := range results {
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		answered = true
+		addrs = append(addrs, r.addrs...)
+		if len(r.addrs) > 0 && (ttl == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+	}
+	if !answered {
+		return nil, 0, lastErr
+	}
+	return addrs, ttl, nil
+}
+
+// query sends one question and returns the addresses in the answer. A name
+// that does not exist has no addresses.
+func (s dnsServer) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// DoH queries use ID 0 so responses can be cached by HTTP
+	var id uint16
+	if s.protocol != "https" {
+		id = uint16(rand.Uint32())
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, err
+	}
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions:   []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	raw, err := s.exchange(ctx, packed)
+	if err != nil {
+		return nil, 0, fmt.Errorf("dns server %s: %w", s.address, err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, 0, fmt.Errorf("dns server %s: %w", s.address, err)
+	}
+	if resp.ID != id || !resp.Response {
+		return nil, 0, fmt.Errorf("dns server %s: mismatched response", s.address)
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("dns server %s: %s", s.address, resp.RCode)
+	}
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	for _, answer := range resp.Answers {
+		var addr netip.Addr
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addr = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			addr = netip.AddrFrom16(body.AAAA)
+		default:
+			continue
+		}
+		addrs = append(addrs, addr)
+		if recordTTL := time.Duration(answer.Header.TTL) * time.Second; len(addrs) == 1 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// exchange sends a packed query and returns the packed response
+func (s dnsServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	switch s.protocol {
+	case "udp":
+		resp, err := exchangeUDP(ctx, s.address, query)
+		// Truncated answers are repeated over TCP
+		if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+			return s.exchangeStream(ctx, "tcp", query)
+		}
+		return resp, err
+	case "tcp", "tls":
+		return s.exchangeStream(ctx, s.protocol, query)
+	default:
+		return exchangeHTTPS(ctx, s.address, query)
+	}
+}
+
+// exchangeUDP sends a query in a single datagram
+func exchangeUDP(ctx context.Context, address string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// exchangeStream sends a length-prefixed query over TCP or TLS
+func (s dnsServer) exchangeStream(ctx context.Context, protocol string, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if protocol == "tls" {
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: s.serverName}}
+		conn, err = dialer.DialContext(ctx, "tcp", s.address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", s.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeHTTPS posts a query to a DNS-over-HTTPS endpoint
+func exchangeHTTPS(ctx context.Context, endpoint string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize))
+}
+
+// evictDNSCache makes room for a new entry, dropping expired entries first
+// and arbitrary ones if the cache is still full. Callers must hold
+// dnsCacheMutex.
+func evictDNSCache(now time.Time, size int) {
+	for host, entry := range dnsCache {
+		if now.After(entry.expires) {
+			delete(dnsCache, host)
+		}
+	}
+	for host := range dnsCache {
+		if len(dnsCache) < size {
+			break
+		}
+		delete(dnsCache, host)
+	}
+}
+
+// cleanupDNSCache removes expired DNS cache entries
+func cleanupDNSCache(logger *slog.Logger) {
+	now := time.Now()
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+
+	var cleaned int
+	for host, entry := range dnsCache {
+		if now.After(entry.expires) {
+			delete(dnsCache, host)
+			cleaned++
+		}
+	}
+
+	if cleaned > 0 {
+		logger.Debug("DNS cache cleanup completed",
+			"cleaned", cleaned,
+			"remaining", len(dnsCache))
+	}
+}
+
+// resolvingDialer dials host names with the addresses of the built-in
+// resolver, racing them as in RFC 8305 (Happy Eyeballs)
+type resolvingDialer struct {
+	net.Dialer
+}
+
+// dialResult is the outcome of one connection attempt
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var candidates []netip.Addr
+	for _, addr := range addrs {
+		if (strings.HasSuffix(network, "4") && !addr.Is4()) || (strings.HasSuffix(network, "6") && !addr.Is6()) {
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+	if len(candidates) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no suitable address", Name: host}}
+	}
+	return d.dialParallel(ctx, network, interleaveAddrs(candidates), port)
+}
+
+// dialParallel dials the addresses in order, starting the next one when an
+// attempt fails or dialAttemptDelay passes without an answer. The first
+// connection wins and the other attempts are cancelled.
+func (d *resolvingDialer) dialParallel(ctx context.Context, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered so attempts finishing after a return never block
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	delay := time.NewTimer(0)
+	defer delay.Stop()
+
+	var lastErr error
+	for next < len(addrs) || pending > 0 {
+		var start <-chan time.Time
+		if next < len(addrs) {
+			start = delay.C
+		}
+		select {
+		case <-start:
+			address := net.JoinHostPort(addrs[next].String(), port)
+			go func() {
+				conn, err := d.Dialer.DialContext(ctx, network, address)
+				results <- dialResult{conn, err}
+			}()
+			next++
+			pending++
+			delay.Reset(dialAttemptDelay)
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				closeLateConns(results, pending)
+				return result.conn, nil
+			}
+			lastErr = result.err
+			// Do not wait for the delay after a failure
+			delay.Reset(0)
+		case <-ctx.Done():
+			closeLateConns(results, pending)
+			if lastErr == nil {
+				lastErr = &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+			}
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// closeLateConns closes connections of attempts still pending once a dial
+// returned
+func closeLateConns(results <-chan dialResult, pending int) {
+	if pending == 0 {
+		return
+	}
+	go func() {
+		for ; pending > 0; pending-- {
+			if result := <-results; result.conn != nil {
+				result.conn.Close()
+			}
+		}
+	}()
+}
+
+// interleaveAddrs orders addresses for dialing, alternating between IPv6
+// and IPv4 starting with IPv6 as RFC 8305 recommends
+func interleaveAddrs(addrs []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	ordered := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
+
+func (d *resolvingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
@@ -2,19 +2,36 @@ package proxy
 
 import (
 	"log/slog"
+	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
+
+	"github.com/elazarl/goproxy"
 )
 
-// Global ad domains state
-var (
-	adDomainsMap   map[string]bool
-	adDomainsMutex sync.RWMutex
+// Rule name of route decisions blocking ad domains
+const ruleAdDomain = "ad_domain"
 
+// Clients may cache the rejection of an ad tunnel this long
+const adConnectMaxAge = "86400"
+
+// Global routing state
+var (
 	// Static file extensions map for O(1) lookup
 	staticExtMap   map[string]bool
 	staticExtMutex sync.RWMutex
+
+	// Direct domain matcher, replaced on config reload
+	directDomains      *domainMatcher
+	directDomainsMutex sync.RWMutex
+
+	// Ad blocking counters by kind of traffic
+	adBlockedRequests atomic.Uint64 // plain and MITM HTTP requests
+	adBlockedTunnels  atomic.Uint64 // CONNECT and transparent TLS tunnels
+	adBlockedQueries  atomic.Uint64 // DNS server queries
 )
 
 // RoutingConfig contains configuration for routing decisions
@@ -26,13 +43,6 @@ type RoutingConfig struct {
 	}
 }
 
-// SetAdDomainsMap updates the global ad domains map
-func SetAdDomainsMap(adMap map[string]bool) {
-	adDomainsMutex.Lock()
-	adDomainsMap = adMap
-	adDomainsMutex.Unlock()
-}
-
 // InitStaticExtensions initializes the static extensions map for O(1) lookup
 func InitStaticExtensions(extensions []string) {
 	staticExtMutex.Lock()
@@ -45,6 +55,53 @@ func InitStaticExtensions(extensions []string) {
 	}
 }
 
+// SetDirectDomains compiles the direct domain patterns used by IsCDNDomain.
+// Entries in the old substring format are migrated with a warning.
+func SetDirectDomains(domains []string, logger *slog.Logger) error {
+	matcher, err := compileDirectDomains(domains, logger)
+	if err != nil {
+		return err
+	}
+	installDirectDomains(matcher)
+	return nil
+}
+
+// compileDirectDomains compiles the direct domain patterns without
+// installing them
+func compileDirectDomains(domains []string, logger *slog.Logger) (*domainMatcher, error) {
+	domains, legacy := migrateDirectDomains(domains)
+	for _, entry := range legacy {
+		logger.Warn("direct_domains entry in the old substring format is matched as a keyword, replace it with a domain pattern",
+			"entry", entry.Entry,
+			"treated_as", entry.Keyword)
+	}
+	return newDomainMatcher(domains)
+}
+
+// installDirectDomains replaces the direct domain matcher
+func installDirectDomains(matcher *domainMatcher) {
+	directDomainsMutex.Lock()
+	directDomains = matcher
+	directDomainsMutex.Unlock()
+}
+
+// currentDirectDomains returns the direct domain matcher, compiling it from
+// config if SetDirectDomains was never called
+func currentDirectDomains(config *RoutingConfig, logger *slog.Logger) *domainMatcher {
+	directDomainsMutex.RLock()
+	matcher := directDomains
+	directDomainsMutex.RUnlock()
+
+	if matcher == nil && config != nil {
+		if err := SetDirectDomains(config.DirectDomains, logger); err != nil {
+			logger.Error("Invalid direct domains", "error", err)
+			return nil
+		}
+		return currentDirectDomains(nil, logger)
+	}
+	return matcher
+}
+
 // IsStaticFile checks if URL is a static file
 func IsStaticFile(urlStr string, config *RoutingConfig, logger *slog.Logger) bool {
 	// Parse URL to get path
@@ -98,59 +155,137 @@ func IsStaticFile(urlStr string, config *RoutingConfig, logger *slog.Logger) boo
 
 // IsCDNDomain checks if domain is a CDN domain
 func IsCDNDomain(host string, config *RoutingConfig, logger *slog.Logger) bool {
-	lowerHost := strings.ToLower(host)
+	lowerHost := strings.TrimSuffix(strings.ToLower(host), ".")
+	if h, _, err := net.SplitHostPort(lowerHost); err == nil {
+		lowerHost = h
+	}
 
-	if config != nil {
-		for _, cdn := range config.DirectDomains {
-			if strings.Contains(lowerHost, cdn) {
-				logger.Debug("Domain identified as CDN",
-					"host", host,
-					"pattern", cdn,
-					"action", "direct_connection")
-				return true
-			}
-		}
+	if pattern, ok := currentDirectDomains(config, logger).match(lowerHost); ok {
+		logger.Debug("Domain identified as CDN",
+			"host", host,
+			"pattern", pattern,
+			"action", "direct_connection")
+		return true
 	}
 
 	logger.Debug("Domain not a CDN", "host", host)
 	return false
 }
 
-// IsAdDomain checks if domain is in ad blocking list (optimized with map)
-func IsAdDomain(host string, config *RoutingConfig, logger *slog.Logger) bool {
-	if config == nil || !config.AdBlocking.Enabled || adDomainsMap == nil {
-		return false
+// AdBlockCounts returns the number of blocked HTTP requests, tunnels and DNS
+// queries since startup
+func AdBlockCounts() (requests, tunnels, queries uint64) {
+	return adBlockedRequests.Load(), adBlockedTunnels.Load(), adBlockedQueries.Load()
+}
+
+// countAdBlock counts a blocked request or tunnel
+func countAdBlock(rr *RouteRequest, match adMatch) {
+	if rr.Connect {
+		adBlockedTunnels.Add(1)
+	} else {
+		adBlockedRequests.Add(1)
 	}
+	recordAdStats(rr, match, adStatsBlock)
+}
 
-	lowerHost := strings.ToLower(host)
+// adConnectResponse rejects a CONNECT to an ad domain. Tunnels cannot be
+// answered with 204 like requests, so it is refused without dialing, with an
+// empty body and a Cache-Control header for clients that cache the answer.
+func adConnectResponse(r *http.Request) *http.Response {
+	resp := newProxyResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "")
+	resp.Header.Set("Cache-Control", "public, max-age="+adConnectMaxAge)
+	return resp
+}
 
-	// Use read lock for concurrent access
-	adDomainsMutex.RLock()
-	defer adDomainsMutex.RUnlock()
+// IsAdDomain checks if a host is blocked as a whole by the ad domains and
+// block lists, taking the allowlist into account. Client policies do not
+// apply.
+func IsAdDomain(host string, config *RoutingConfig, logger *slog.Logger) bool {
+	_, blocked := isAdRequest(&RouteRequest{Host: normalizeHost(host)}, config, logger)
+	return blocked
+}
 
-	// Check exact match first
-	if adDomainsMap[lowerHost] {
-		logger.Debug("Domain blocked (exact match)",
-			"host", host,
-			"action", "blocked",
-			"reason", "ad_domain")
-		return true
+// adMatch tells why a request is blocked as an ad
+type adMatch struct {
+	decision RouteDecision
+	domain   string // blocked domain or pattern, the host for URL filters
+	list     string // list of the filter, or the policy
+}
+
+// isAdRequest checks a request against the policy of its client, the
+// allowlist and the domain and URL filters of the block lists. Tunnels and
+// DNS queries are checked by host only. Blocked requests get the block
+// decision of the client's policy.
+func isAdRequest(rr *RouteRequest, config *RoutingConfig, logger *slog.Logger) (adMatch, bool) {
+	if config == nil || !config.AdBlocking.Enabled {
+		return adMatch{}, false
 	}
 
-	// Check if any parent domain is blocked
-	parts := strings.Split(lowerHost, ".")
-	for i := range parts {
-		domain := strings.Join(parts[i:], ".")
-		if adDomainsMap[domain] {
-			logger.Debug("Domain blocked (parent match)",
-				"host", host,
-				"blocked_parent", domain,
+	policies := loadAdPolicies()
+	policy := policies.policyFor(rr)
+	var policyName string
+	if policy != nil {
+		policyName = policy.name
+		if policy.disabled {
+			logger.Debug("Ad blocking disabled for client",
+				"host", rr.Host,
+				"ad_policy", policyName)
+			return adMatch{}, false
+		}
+	}
+	if pattern, ok := policies.allowed(policy, rr.Host); ok {
+		logger.Debug("Domain allowlisted",
+			"host", rr.Host,
+			"allowlist_pattern", pattern,
+			"ad_policy", policyName)
+		return adMatch{}, false
+	}
+	blocked := func(domain, list string) (adMatch, bool) {
+		return adMatch{decision: policies.blockDecision(policy), domain: domain, list: list}, true
+	}
+	if policy != nil {
+		if pattern, ok := policy.block.match(rr.Host); ok {
+			logger.Debug("Domain blocked",
+				"host", rr.Host,
+				"blocked_domain", pattern,
+				"ad_policy", policyName,
 				"action", "blocked",
-				"reason", "ad_domain")
-			return true
+				"reason", ruleAdDomain)
+			return blocked(pattern, "policy:"+policyName)
 		}
 	}
 
-	logger.Debug("Domain not in ad list", "host", host)
-	return false
+	filter := loadAdFilter()
+	if filter == nil {
+		return adMatch{}, false
+	}
+
+	if rr.Connect || rr.URL == "" {
+		if domain, list, ok := filter.blockedDomain(rr.Host); ok {
+			logger.Debug("Domain blocked",
+				"host", rr.Host,
+				"blocked_domain", domain,
+				"list", list,
+				"ad_policy", policyName,
+				"action", "blocked",
+				"reason", ruleAdDomain)
+			return blocked(domain, list)
+		}
+		logger.Debug("Domain not in ad list", "host", rr.Host)
+		return adMatch{}, false
+	}
+
+	thirdParty := isThirdParty(rr.Host, rr.Referer)
+	if domain, list, ok := filter.blocksRequest(rr.Host, rr.URL, thirdParty); ok {
+		logger.Debug("Request blocked",
+			"host", rr.Host,
+			"url", rr.URL,
+			"third_party", thirdParty,
+			"list", list,
+			"ad_policy", policyName,
+			"action", "blocked",
+			"reason", ruleAdDomain)
+		return blocked(domain, list)
+	}
+	return adMatch{}, false
 }
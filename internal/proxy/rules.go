@@ -0,0 +1,627 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Routing actions
+const (
+	ActionDirect   = "direct"
+	ActionUpstream = "upstream"
+	ActionBlock    = "block"
+	ActionReject   = "reject"
+)
+
+// Prefix of patterns that are regular expressions
+const regexPatternPrefix = "regex:"
+
+// RoutingRule is a single routing rule. All non-empty conditions must match;
+// any entry of a condition list may match.
+type RoutingRule struct {
+	Name       string
+	Hosts      []string // example.com, .example.com (suffix), *.example.com, regex:...
+	Paths      []string // /prefix, /api/*.json, regex:...
+	Extensions []string // .js, .css
+	Methods    []string
+	Ports      []int
+	ClientIPs  []string // IP or CIDR of the client
+	Users      []string // upstream account username from the credentials
+	UserAgents []string // case-insensitive substring or regex:...
+	Countries  []string // ISO country code of the resolved target, needs a country database
+	ASNs       []uint   // autonomous system number of the resolved target, needs an ASN database
+	Action     string   // direct, upstream, block or reject
+	Upstream   string   // named upstream for the upstream action
+	Status     int      // response status for the block action, default 204 or 403 for the page
+	Resolve    string   // local or remote resolution for the upstream action, default from the resolver
+
+	// BlockResponse is how the block action answers: status (default),
+	// page, gif, empty or reset
+	BlockResponse string
+}
+
+// RouteRequest describes a request or CONNECT tunnel to route
+type RouteRequest struct {
+	Host      string // lowercase, without port
+	Port      int
+	Path      string
+	URL       string
+	Method    string
+	ClientIP  netip.Addr
+	UserAgent string
+	Referer   string
+	Upstream  *UpstreamInfo // upstream from the client's credentials
+	Connect   bool          // only the target host and port are known
+
+	geo *geoLocation // resolved on first use by GeoIP conditions
+}
+
+// RouteDecision is the outcome of routing a request
+type RouteDecision struct {
+	Action   string
+	Rule     string        // name of the matched rule, or the built-in reason
+	Upstream *UpstreamInfo // upstream to use for ActionUpstream
+	Status   int           // response status for ActionBlock
+	Resolve  string        // ResolveLocal or ResolveRemote for ActionUpstream, empty for the default
+
+	// BlockResponse is how ActionBlock answers, one of the BlockResponse values
+	BlockResponse string
+}
+
+// stringMatcher matches a single condition value
+type stringMatcher func(string) bool
+
+// compiledRule is a routing rule prepared for fast evaluation
+type compiledRule struct {
+	rule       RoutingRule
+	name       string
+	hosts      []stringMatcher
+	paths      []stringMatcher
+	extensions map[string]bool
+	methods    map[string]bool
+	ports      map[int]bool
+	clientNets []netip.Prefix
+	users      map[string]bool
+	userAgents []stringMatcher
+	countries  map[string]bool
+	asns       map[uint]bool
+	decision   RouteDecision
+}
+
+// routeContextKey stores the route decision of a CONNECT in its request context
+type routeContextKey struct{}
+
+// Global routing rules state
+var (
+	routingRulesMutex sync.RWMutex
+	routingRules      []*compiledRule
+)
+
+// SetRoutingRules compiles and installs the routing rules. Named upstreams
+// can be referenced by rules with the upstream action. Rules with GeoIP
+// conditions need the databases loaded by SetGeoIPConfig. On error the
+// current rules stay in place.
+func SetRoutingRules(rules []RoutingRule, upstreams map[string]*UpstreamInfo) error {
+	hasCountryDB, hasASNDB := geoIPDatabases()
+	compiled, err := compileRoutingRules(rules, upstreams, hasCountryDB, hasASNDB)
+	if err != nil {
+		return err
+	}
+	installRoutingRules(compiled)
+	return nil
+}
+
+// compileRoutingRules validates the named upstreams and compiles the rules
+// without installing them. GeoIP conditions need the databases reported as
+// loaded.
+func compileRoutingRules(rules []RoutingRule, upstreams map[string]*UpstreamInfo, hasCountryDB, hasASNDB bool) ([]*compiledRule, error) {
+	for name, upstream := range upstreams {
+		if upstream.Type != "http" && upstream.Type != "socks5" {
+			return nil, fmt.Errorf("upstream %s: invalid type %q, must be http or socks5", name, upstream.Type)
+		}
+		if upstream.Host == "" || upstream.Port == "" {
+			return nil, fmt.Errorf("upstream %s: host and port are required", name)
+		}
+	}
+
+	compiled := make([]*compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		cr, err := compileRule(rule, upstreams, hasCountryDB, hasASNDB)
+		if err != nil {
+			name := rule.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			return nil, fmt.Errorf("routing rule %s: %w", name, err)
+		}
+		if cr.name == "" {
+			cr.name = "rule_" + strconv.Itoa(i+1)
+			cr.decision.Rule = cr.name
+		}
+		compiled = append(compiled, cr)
+	}
+	return compiled, nil
+}
+
+// installRoutingRules replaces the routing rules
+func installRoutingRules(compiled []*compiledRule) {
+	routingRulesMutex.Lock()
+	routingRules = compiled
+	routingRulesMutex.Unlock()
+}
+
+// compileRule validates a rule and compiles its conditions
+func compileRule(rule RoutingRule, upstreams map[string]*UpstreamInfo, hasCountryDB, hasASNDB bool) (*compiledRule, error) {
+	cr := &compiledRule{
+		rule: rule,
+		name: rule.Name,
+		decision: RouteDecision{
+			Action: strings.ToLower(rule.Action),
+			Rule:   rule.Name,
+		},
+	}
+
+	switch cr.decision.Action {
+	case ActionDirect, ActionReject:
+	case ActionUpstream:
+		if rule.Upstream != "" {
+			upstream, ok := upstreams[rule.Upstream]
+			if !ok {
+				return nil, fmt.Errorf("unknown upstream %q", rule.Upstream)
+			}
+			cr.decision.Upstream = upstream
+		}
+	case ActionBlock:
+		response, status, err := parseBlockResponse(rule.BlockResponse, rule.Status)
+		if err != nil {
+			return nil, err
+		}
+		cr.decision.BlockResponse, cr.decision.Status = response, status
+	case "":
+		return nil, fmt.Errorf("missing action")
+	default:
+		return nil, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	switch resolve := strings.ToLower(rule.Resolve); resolve {
+	case "":
+	case ResolveLocal, ResolveRemote:
+		if cr.decision.Action != ActionUpstream {
+			return nil, fmt.Errorf("resolve is only used with the upstream action")
+		}
+		cr.decision.Resolve = resolve
+	default:
+		return nil, fmt.Errorf("unknown resolve mode %q", rule.Resolve)
+	}
+
+	for _, pattern := range rule.Hosts {
+		m, err := compileHostPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		cr.hosts = append(cr.hosts, m)
+	}
+	for _, pattern := range rule.Paths {
+		m, err := compilePathPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		cr.paths = append(cr.paths, m)
+	}
+	for _, pattern := range rule.UserAgents {
+		m, err := compileUserAgentPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		cr.userAgents = append(cr.userAgents, m)
+	}
+
+	if len(rule.Extensions) > 0 {
+		cr.extensions = make(map[string]bool, len(rule.Extensions))
+		for _, ext := range rule.Extensions {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			cr.extensions[ext] = true
+		}
+	}
+	if len(rule.Methods) > 0 {
+		cr.methods = make(map[string]bool, len(rule.Methods))
+		for _, method := range rule.Methods {
+			cr.methods[strings.ToUpper(method)] = true
+		}
+	}
+	if len(rule.Ports) > 0 {
+		cr.ports = make(map[int]bool, len(rule.Ports))
+		for _, port := range rule.Ports {
+			cr.ports[port] = true
+		}
+	}
+	if len(rule.Users) > 0 {
+		cr.users = make(map[string]bool, len(rule.Users))
+		for _, user := range rule.Users {
+			cr.users[user] = true
+		}
+	}
+	for _, entry := range rule.ClientIPs {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		cr.clientNets = append(cr.clientNets, prefix)
+	}
+
+	if len(rule.Countries) > 0 {
+		if !hasCountryDB {
+			return nil, fmt.Errorf("countries condition needs geoip.country_database")
+		}
+		cr.countries = make(map[string]bool, len(rule.Countries))
+		for _, country := range rule.Countries {
+			if len(country) != 2 {
+				return nil, fmt.Errorf("invalid country code %q", country)
+			}
+			cr.countries[strings.ToUpper(country)] = true
+		}
+	}
+	if len(rule.ASNs) > 0 {
+		if !hasASNDB {
+			return nil, fmt.Errorf("asns condition needs geoip.asn_database")
+		}
+		cr.asns = make(map[uint]bool, len(rule.ASNs))
+		for _, asn := range rule.ASNs {
+			if asn == 0 {
+				return nil, fmt.Errorf("invalid ASN 0")
+			}
+			cr.asns[asn] = true
+		}
+	}
+
+	return cr, nil
+}
+
+// parsePrefix parses a CIDR, or a single IP as a full-length prefix
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP %q: %w", entry, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// compileRegexPattern compiles a regex: pattern, case-insensitive if requested
+func compileRegexPattern(pattern string, ignoreCase bool) (stringMatcher, error) {
+	expr := pattern[len(regexPatternPrefix):]
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", pattern, err)
+	}
+	return re.MatchString, nil
+}
+
+// wildcardExpr converts a pattern where * matches any characters to a regex
+func wildcardExpr(pattern string) string {
+	return "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+}
+
+// compileWildcardPattern compiles a pattern where * matches any characters
+func compileWildcardPattern(pattern string) stringMatcher {
+	return regexp.MustCompile(wildcardExpr(pattern)).MatchString
+}
+
+// compileHostPattern compiles an exact, suffix (.example.com), wildcard
+// (*.example.com) or regex host pattern
+func compileHostPattern(pattern string) (stringMatcher, error) {
+	pattern = strings.TrimSpace(pattern)
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		return compileRegexPattern(pattern, true)
+	}
+
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	switch {
+	case pattern == "":
+		return nil, fmt.Errorf("empty host pattern")
+	case strings.Contains(pattern, "*"):
+		// * matches any characters, including dots
+		return compileWildcardPattern(pattern), nil
+	case strings.HasPrefix(pattern, "."):
+		// Suffix on a label boundary, including the domain itself
+		domain := pattern[1:]
+		return func(host string) bool {
+			return host == domain || strings.HasSuffix(host, pattern)
+		}, nil
+	default:
+		return func(host string) bool { return host == pattern }, nil
+	}
+}
+
+// compilePathPattern compiles a path prefix, wildcard or regex pattern
+func compilePathPattern(pattern string) (stringMatcher, error) {
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		return compileRegexPattern(pattern, false)
+	}
+	if strings.Contains(pattern, "*") {
+		return compileWildcardPattern(pattern), nil
+	}
+	return func(p string) bool { return strings.HasPrefix(p, pattern) }, nil
+}
+
+// compileUserAgentPattern compiles a case-insensitive substring or regex pattern
+func compileUserAgentPattern(pattern string) (stringMatcher, error) {
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		return compileRegexPattern(pattern, true)
+	}
+	lower := strings.ToLower(pattern)
+	return func(ua string) bool { return strings.Contains(strings.ToLower(ua), lower) }, nil
+}
+
+// matchAny reports whether any matcher matches the value
+func matchAny(matchers []stringMatcher, value string) bool {
+	for _, m := range matchers {
+		if m(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether all conditions of the rule match the request.
+// Conditions on the path, extension or user agent never match a CONNECT.
+// GeoIP conditions are checked last since they may resolve the host.
+func (cr *compiledRule) matches(rr *RouteRequest, logger *slog.Logger) bool {
+	if len(cr.hosts) > 0 && !matchAny(cr.hosts, rr.Host) {
+		return false
+	}
+	if cr.ports != nil && !cr.ports[rr.Port] {
+		return false
+	}
+	if cr.methods != nil && !cr.methods[rr.Method] {
+		return false
+	}
+	if len(cr.clientNets) > 0 {
+		if !rr.ClientIP.IsValid() {
+			return false
+		}
+		found := false
+		for _, prefix := range cr.clientNets {
+			if prefix.Contains(rr.ClientIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if cr.users != nil && (rr.Upstream == nil || !cr.users[rr.Upstream.Username]) {
+		return false
+	}
+
+	if rr.Connect && (len(cr.paths) > 0 || cr.extensions != nil || len(cr.userAgents) > 0) {
+		return false
+	}
+	if len(cr.paths) > 0 && !matchAny(cr.paths, rr.Path) {
+		return false
+	}
+	if cr.extensions != nil && !cr.extensions[strings.ToLower(path.Ext(rr.Path))] {
+		return false
+	}
+	if len(cr.userAgents) > 0 && !matchAny(cr.userAgents, rr.UserAgent) {
+		return false
+	}
+
+	if cr.countries != nil || cr.asns != nil {
+		if rr.geo == nil {
+			loc := lookupGeoIP(rr.Host, logger)
+			rr.geo = &loc
+		}
+		if cr.countries != nil && !cr.countries[rr.geo.Country] {
+			return false
+		}
+		if cr.asns != nil && !cr.asns[rr.geo.ASN] {
+			return false
+		}
+	}
+	return true
+}
+
+// newRouteRequest describes an HTTP request, including requests inside MITM tunnels
+func newRouteRequest(r *http.Request, fullURL string, upstream *UpstreamInfo) *RouteRequest {
+	host := r.URL.Hostname()
+	port := r.URL.Port()
+	if host == "" {
+		host, port = splitHostPort(r.Host)
+	}
+
+	return &RouteRequest{
+		Host:      normalizeHost(host),
+		Port:      routePort(port, r.URL.Scheme),
+		Path:      r.URL.Path,
+		URL:       fullURL,
+		Method:    r.Method,
+		ClientIP:  remoteAddrIP(r.RemoteAddr),
+		UserAgent: r.Header.Get("User-Agent"),
+		Referer:   r.Header.Get("Referer"),
+		Upstream:  upstream,
+	}
+}
+
+// newConnectRouteRequest describes a CONNECT tunnel to host[:port]
+func newConnectRouteRequest(r *http.Request, target string, upstream *UpstreamInfo) *RouteRequest {
+	host, port := splitHostPort(target)
+	rr := &RouteRequest{
+		Host:     normalizeHost(host),
+		Port:     routePort(port, "https"),
+		Method:   http.MethodConnect,
+		Upstream: upstream,
+		Connect:  true,
+	}
+	if r != nil {
+		rr.ClientIP = remoteAddrIP(r.RemoteAddr)
+	}
+	return rr
+}
+
+// splitHostPort splits host[:port], tolerating a missing port
+func splitHostPort(hostport string) (string, string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.Trim(hostport, "[]"), ""
+	}
+	return host, port
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// routePort returns the numeric port, defaulting by scheme
+func routePort(port, scheme string) int {
+	if n, err := strconv.Atoi(port); err == nil {
+		return n
+	}
+	if scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// remoteAddrIP returns the client IP of a remote address
+func remoteAddrIP(remoteAddr string) netip.Addr {
+	addr, err := netip.ParseAddr(clientIP(remoteAddr))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// route decides how a request is handled. Denied IP literals are rejected
+// first. Configured rules are evaluated in order, followed by the destination
+// CIDR lists and the built-in ad blocking, static file, learned static route
+// and CDN checks; anything else goes to the client's upstream.
+func (s *Server) route(rr *RouteRequest) RouteDecision {
+	// Denied IP literals are refused before any rule
+	if isDeniedDestination(rr.Host) {
+		return RouteDecision{Action: ActionReject, Rule: "destination_deny"}
+	}
+
+	routingRulesMutex.RLock()
+	rules := routingRules
+	routingRulesMutex.RUnlock()
+
+	for _, rule := range rules {
+		if rule.matches(rr, s.logger) {
+			decision := rule.decision
+			if decision.Action == ActionUpstream && decision.Upstream == nil {
+				decision.Upstream = rr.Upstream
+			}
+			s.logger.Debug("Routing rule matched",
+				"rule", decision.Rule,
+				"action", decision.Action,
+				"host", rr.Host,
+				"port", rr.Port,
+				"path", rr.Path,
+				"method", rr.Method)
+			return decision
+		}
+	}
+
+	if action, ok := destinationAction(rr.Host, s.logger); ok {
+		switch action {
+		case ActionReject:
+			return RouteDecision{Action: ActionReject, Rule: "destination_deny"}
+		case ActionDirect:
+			return RouteDecision{Action: ActionDirect, Rule: "destination_direct"}
+		default:
+			return RouteDecision{Action: ActionUpstream, Rule: "destination_upstream", Upstream: rr.Upstream}
+		}
+	}
+
+	if match, ok := isAdRequest(rr, s.routingConfig, s.logger); ok {
+		countAdBlock(rr, match)
+		return match.decision
+	}
+	if !rr.Connect && IsStaticFile(rr.URL, s.routingConfig, s.logger) {
+		return RouteDecision{Action: ActionDirect, Rule: "static_file"}
+	}
+	if !rr.Connect && isLearnedStatic(rr, s.logger) {
+		return RouteDecision{Action: ActionDirect, Rule: "learned_static"}
+	}
+	if IsCDNDomain(rr.Host, s.routingConfig, s.logger) {
+		return RouteDecision{Action: ActionDirect, Rule: "cdn_domain"}
+	}
+	return RouteDecision{Action: ActionUpstream, Rule: "default", Upstream: rr.Upstream}
+}
+
+// routeResponse returns the response for block and reject decisions, nil otherwise
+func (s *Server) routeResponse(r *http.Request, decision RouteDecision) *http.Response {
+	switch decision.Action {
+	case ActionBlock:
+		s.logger.Debug("Blocking request",
+			"host", r.Host,
+			"method", r.Method,
+			"url", r.URL.String(),
+			"rule", decision.Rule,
+			"status", decision.Status,
+			"block_response", decision.BlockResponse)
+		return blockResponse(r, decision)
+	case ActionReject:
+		s.logger.Debug("Rejecting request",
+			"host", r.Host,
+			"method", r.Method,
+			"rule", decision.Rule)
+		return newProxyResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "Request rejected by proxy policy")
+	default:
+		return nil
+	}
+}
+
+// newProxyResponse builds a response the proxy answers itself. Responses to
+// rejected CONNECTs are written to the raw client connection, so the version
+// is set rather than left at 0.
+func newProxyResponse(r *http.Request, contentType string, status int, body string) *http.Response {
+	resp := goproxy.NewResponse(r, contentType, status, body)
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	return resp
+}
+
+// withRoute returns the request with a route decision attached to its context
+func withRoute(r *http.Request, decision RouteDecision) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeContextKey{}, decision))
+}
+
+// routeFromRequest returns the decision attached by withRoute, if any
+func routeFromRequest(r *http.Request) (RouteDecision, bool) {
+	if r == nil {
+		return RouteDecision{}, false
+	}
+	return routeFromContext(r.Context())
+}
+
+// routeFromContext returns the decision attached to a request context
+func routeFromContext(ctx context.Context) (RouteDecision, bool) {
+	decision, ok := ctx.Value(routeContextKey{}).(RouteDecision)
+	return decision, ok
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import "log/slog"
+
+// RuntimeConfig holds the settings replaced together on config reload
+type RuntimeConfig struct {
+	DirectDomains []string
+	Resolver      *ResolverConfig
+	GeoIP         *GeoIPConfig
+	Destinations  *DestinationConfig
+	RoutingRules  []RoutingRule
+	Upstreams     map[string]*UpstreamInfo // named upstreams for rules and client policies
+	MITMSelect    *MITMSelectConfig
+	ClientACL     *ClientACLConfig
+}
+
+// ApplyRuntimeConfig compiles every setting first and installs them only
+// when all are valid, so a bad reload leaves the current settings in place
+func ApplyRuntimeConfig(config *RuntimeConfig, logger *slog.Logger) error {
+	directDomains, err := compileDirectDomains(config.DirectDomains, logger)
+	if err != nil {
+		return err
+	}
+	resolverServers, err := compileResolverConfig(config.Resolver)
+	if err != nil {
+		return err
+	}
+	geoIP, err := loadGeoIPConfig(config.GeoIP)
+	if err != nil {
+		return err
+	}
+	destinations, err := compileDestinationConfig(config.Destinations)
+	if err != nil {
+		return err
+	}
+	// Rules are checked against the GeoIP databases about to be installed
+	rules, err := compileRoutingRules(config.RoutingRules, config.Upstreams,
+		geoIP.country != nil, geoIP.asn != nil)
+	if err != nil {
+		return err
+	}
+	mitmSelect, err := compileMITMSelect(config.MITMSelect)
+	if err != nil {
+		return err
+	}
+	acl, err := compileClientACL(config.ClientACL, config.Upstreams)
+	if err != nil {
+		return err
+	}
+
+	installDirectDomains(directDomains)
+	installResolverConfig(config.Resolver, resolverServers)
+	installGeoIPConfig(geoIP)
+	installDestinations(destinations)
+	installRoutingRules(rules)
+	installMITMSelect(mitmSelect)
+	installClientACL(acl)
+	return nil
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
@@ -16,6 +18,10 @@ import (
 	"time"
 
 	"github.com/elazarl/goproxy"
+	applog "github.com/hothuongtin/smartproxy/internal/logger"
+	"github.com/hothuongtin/smartproxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Constants
@@ -38,6 +44,10 @@ type Server struct {
 	// Global state
 	connectUpstreams sync.Map // map[string]*UpstreamInfo (keyed by remote addr)
 	targetUpstreams  sync.Map // map[string]*UpstreamInfo (keyed by target addr)
+
+	// MITM leaf certificates, set up with HTTPS interception
+	certs       *certCache
+	mitmConnect *goproxy.ConnectAction
 }
 
 // Config represents the server configuration
@@ -46,7 +56,10 @@ type Config struct {
 	HTTPSMitm  bool
 	CACert     string
 	CAKey      string
-	ListenAddr string
+	MITMCerts  MITMCertConfig
+	ListenAddr string           // used when Listeners is empty
+	Listeners  []ListenerConfig
+	DNSServer  *DNSServerConfig // nil disables the DNS server
 }
 
 // NewServer creates a new SmartProxy server
@@ -63,6 +76,7 @@ func NewServer(config *Config, routingConfig *RoutingConfig, transportConfig *Tr
 // Start starts the proxy server
 func (s *Server) Start() error {
 	s.proxyServer.Verbose = false // Disable verbose logging for performance
+	s.proxyServer.Logger = goproxyLogger{logger: s.logger}
 
 	// Create optimized transport for direct connections
 	s.directTransport = CreateOptimizedTransport(s.transportConfig)
@@ -73,6 +87,10 @@ func (s *Server) Start() error {
 
 	// Create Chrome-optimized transport
 	s.chromeTransport = CreateChromeOptimizedTransport(s.transportConfig, s.logger)
+
+	// Refuse denied destination addresses on direct connections
+	s.directTransport.DialContext = newDirectDialer(30 * time.Second).DialContext
+	s.chromeTransport.DialContext = newDirectDialer(30 * time.Second).DialContext
 	s.logger.Debug("Created Chrome-optimized transport",
 		"max_idle_conns", s.chromeTransport.MaxIdleConns,
 		"max_idle_conns_per_host", s.chromeTransport.MaxIdleConnsPerHost)
@@ -81,18 +99,21 @@ func (s *Server) Start() error {
 	// Clean up transports not used for 5 minutes, check every minute
 	InitTransportCacheCleanup(1*time.Minute, 5*time.Minute, s.logger)
 
+	// Serve SmartProxy's own endpoints to non-proxy requests
+	s.setupNonproxyHandler()
+
 	// Setup HTTPS handling
 	s.setupHTTPS()
 
 	// Setup authentication middleware
 	s.setupAuthentication()
 
-	// Setup ad blocking
-	s.setupAdBlocking()
-
 	// Setup response logging
 	s.setupResponseLogging()
 
+	// Setup request tracing
+	s.setupRequestTracing()
+
 	// Setup routing logic
 	s.setupRouting()
 
@@ -100,6 +121,23 @@ func (s *Server) Start() error {
 	return s.startHTTPServer()
 }
 
+// setupNonproxyHandler serves requests addressed to SmartProxy itself rather
+// than proxied, such as the PAC file. They need no proxy authentication.
+func (s *Server) setupNonproxyHandler() {
+	fallback := s.proxyServer.NonproxyHandler
+	s.proxyServer.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if script, config, modTime, ok := pacRequest(r); ok {
+			s.servePAC(w, r, script, config, modTime)
+			return
+		}
+		if stats, ok := adStatsRequest(r); ok {
+			s.serveAdStats(w, r, stats)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
 // setupHTTPS configures HTTPS handling
 func (s *Server) setupHTTPS() {
 	if s.config.HTTPSMitm {
@@ -117,8 +155,21 @@ func (s *Server) setupHTTPS() {
 			s.logger.Info("Using default goproxy CA certificate for HTTPS interception")
 			s.logger.Warn("Clients must trust the goproxy CA certificate to avoid TLS errors")
 		}
+		certs, err := newCertCache(goproxy.GoproxyCa, s.config.MITMCerts, s.logger)
+		if err != nil {
+			s.logger.Error("Invalid MITM certificate settings", "error", err)
+			os.Exit(1)
+		}
+		s.certs = certs
+		s.mitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: trackMITMHandshakes(certs.tlsConfig)}
+		s.logger.Info("Signing MITM certificates",
+			"key_type", certs.config.KeyType,
+			"validity", certs.config.Validity,
+			"cache_size", certs.config.CacheSize,
+			"wildcard", certs.config.Wildcard,
+			"cache_dir", certs.config.CacheDir)
 		// Add CONNECT handler with authentication for MITM
-		s.proxyServer.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		s.proxyServer.OnRequest().HandleConnectFunc(traceConnect(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
 			s.logger.Debug("HTTPS CONNECT request (MITM mode)", "host", host, "remote_addr", ctx.Req.RemoteAddr)
 
 			// Check for authentication
@@ -127,6 +178,21 @@ func (s *Server) setupHTTPS() {
 				return goproxy.RejectConnect, "No request context"
 			}
 
+			// Enforce rate and tunnel limits before parsing any credentials
+			if !s.limitConnect(ctx) {
+				return goproxy.RejectConnect, "Rate limit exceeded"
+			}
+
+			// Trusted client networks may connect without credentials
+			if upstream := clientPolicyUpstream(ctx.Req); upstream != nil {
+				ctx.UserData = upstream
+				s.logger.Debug("CONNECT accepted by client policy (MITM)",
+					"host", host,
+					"upstream_type", upstream.Type,
+					"upstream_host", upstream.Host)
+				return s.interceptOrTunnel(host, ctx, upstream)
+			}
+
 			auth := ctx.Req.Header.Get("Proxy-Authorization")
 			if auth == "" {
 				s.logger.Debug("No authentication for CONNECT (MITM)", "host", host)
@@ -138,7 +204,7 @@ func (s *Server) setupHTTPS() {
 
 			// Parse authentication
 			if !strings.HasPrefix(auth, "Basic ") {
-				s.logger.Debug("Invalid auth type for CONNECT (MITM)", "auth", auth[:min(10, len(auth))])
+				s.logger.Debug("Invalid auth type for CONNECT (MITM)", "auth_type", strings.Split(auth, " ")[0])
 				return goproxy.RejectConnect, "Invalid authentication"
 			}
 
@@ -155,20 +221,20 @@ func (s *Server) setupHTTPS() {
 			if err != nil {
 				s.logger.Debug("Failed to decode CONNECT auth (MITM)",
 					"error", err,
-					"base64", base64Auth[:min(20, len(base64Auth))])
+					"base64", applog.Secret(base64Auth))
 				return goproxy.RejectConnect, "Invalid authentication"
 			}
 
 			parts := strings.SplitN(string(credentials), ":", 2)
 			if len(parts) != 2 {
 				s.logger.Debug("Invalid CONNECT credential format (MITM)",
-					"decoded", string(credentials),
+					"decoded", applog.Secret(credentials),
 					"parts", len(parts))
 				return goproxy.RejectConnect, "Invalid authentication"
 			}
 
 			// Parse upstream from auth
-			upstream, err := ParseUpstreamFromAuth(parts[0], parts[1], s.logger)
+			upstream, err := parseUpstreamTraced(ctx.Req.Context(), parts[0], parts[1], s.logger)
 			if err != nil {
 				s.logger.Error("Failed to parse upstream from CONNECT auth (MITM)", "error", err)
 				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden,
@@ -177,6 +243,7 @@ func (s *Server) setupHTTPS() {
 			}
 
 			// Store upstream info for later use
+			upstream.CredentialID = credentialID(auth)
 			ctx.UserData = upstream
 			
 			s.logger.Debug("CONNECT authentication successful (MITM)",
@@ -184,9 +251,12 @@ func (s *Server) setupHTTPS() {
 				"upstream_type", upstream.Type,
 				"upstream_host", upstream.Host)
 
-			// Allow MITM after successful authentication
-			return goproxy.MitmConnect, host
-		})
+			// Intercept or tunnel after successful authentication
+			return s.interceptOrTunnel(host, ctx, upstream)
+		}))
+
+		// Tunnels not intercepted dial like in tunneling mode
+		s.setupConnectDial()
 	} else {
 		// No MITM - setup tunneling with upstream proxy support
 		s.setupHTTPSTunneling()
@@ -198,7 +268,7 @@ func (s *Server) setupHTTPSTunneling() {
 	s.logger.Info("HTTPS MITM disabled - tunneling HTTPS connections without interception")
 
 	// Add CONNECT handler for authentication
-	s.proxyServer.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	s.proxyServer.OnRequest().HandleConnectFunc(traceConnect(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
 		s.logger.Debug("HTTPS CONNECT request", "host", host, "remote_addr", ctx.Req.RemoteAddr)
 
 		// Check for authentication
@@ -207,6 +277,21 @@ func (s *Server) setupHTTPSTunneling() {
 			return goproxy.RejectConnect, "No request context"
 		}
 
+		// Enforce rate and tunnel limits before parsing any credentials
+		if !s.limitConnect(ctx) {
+			return goproxy.RejectConnect, "Rate limit exceeded"
+		}
+
+		// Trusted client networks may connect without credentials
+		if upstream := clientPolicyUpstream(ctx.Req); upstream != nil {
+			ctx.UserData = upstream
+			s.logger.Debug("CONNECT accepted by client policy",
+				"host", host,
+				"upstream_type", upstream.Type,
+				"upstream_host", upstream.Host)
+			return s.acceptConnect(host, ctx, upstream)
+		}
+
 		auth := ctx.Req.Header.Get("Proxy-Authorization")
 		if auth == "" {
 			s.logger.Debug("No authentication for CONNECT", "host", host)
@@ -218,7 +303,7 @@ func (s *Server) setupHTTPSTunneling() {
 
 		// Parse authentication
 		if !strings.HasPrefix(auth, "Basic ") {
-			s.logger.Debug("Invalid auth type for CONNECT", "auth", auth[:min(10, len(auth))])
+			s.logger.Debug("Invalid auth type for CONNECT", "auth_type", strings.Split(auth, " ")[0])
 			return goproxy.RejectConnect, "Invalid authentication"
 		}
 
@@ -233,27 +318,26 @@ func (s *Server) setupHTTPSTunneling() {
 
 		s.logger.Debug("CONNECT auth base64 (after cleanup)",
 			"length", len(base64Auth),
-			"first_20", base64Auth[:min(20, len(base64Auth))],
-			"last_20", base64Auth[max(0, len(base64Auth)-20):])
+			"base64", applog.Secret(base64Auth))
 
 		credentials, err := base64.StdEncoding.DecodeString(base64Auth)
 		if err != nil {
 			s.logger.Debug("Failed to decode CONNECT auth",
 				"error", err,
-				"base64", base64Auth)
+				"base64", applog.Secret(base64Auth))
 			return goproxy.RejectConnect, "Invalid authentication"
 		}
 
 		parts := strings.SplitN(string(credentials), ":", 2)
 		if len(parts) != 2 {
 			s.logger.Debug("Invalid CONNECT credential format",
-				"decoded", string(credentials),
+				"decoded", applog.Secret(credentials),
 				"parts", len(parts))
 			return goproxy.RejectConnect, "Invalid authentication"
 		}
 
 		// Parse upstream from auth
-		upstream, err := ParseUpstreamFromAuth(parts[0], parts[1], s.logger)
+		upstream, err := parseUpstreamTraced(ctx.Req.Context(), parts[0], parts[1], s.logger)
 		if err != nil {
 			s.logger.Error("Failed to parse upstream from CONNECT auth", "error", err)
 			ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden,
@@ -262,86 +346,163 @@ func (s *Server) setupHTTPSTunneling() {
 		}
 
 		// Store upstream info for later use
+		upstream.CredentialID = credentialID(auth)
 		ctx.UserData = upstream
-		// Store by target address for ConnectDial
-		targetKey := host
-		if !strings.Contains(host, ":") {
-			// Add default HTTPS port if not present
-			targetKey = host + ":443"
-		}
-		s.targetUpstreams.Store(targetKey, upstream)
-		// Clean up after some time to prevent memory leak
-		go func(key string) {
-			time.Sleep(5 * time.Minute)
-			s.targetUpstreams.Delete(key)
-		}(targetKey)
-
-		// Also store by remote address for backwards compatibility
-		if ctx.Req != nil {
-			s.connectUpstreams.Store(ctx.Req.RemoteAddr, upstream)
-			go func(addr string) {
-				time.Sleep(5 * time.Minute)
-				s.connectUpstreams.Delete(addr)
-			}(ctx.Req.RemoteAddr)
-		}
 
 		s.logger.Debug("CONNECT authentication successful",
 			"host", host,
 			"upstream_type", upstream.Type,
 			"upstream_host", upstream.Host)
+		return s.acceptConnect(host, ctx, upstream)
+	}))
 
-		// Allow the connection
-		return goproxy.OkConnect, host
-	})
-
-	// Set up custom dial function for HTTPS connections
-	s.proxyServer.ConnectDial = func(network, addr string) (net.Conn, error) {
-		s.logger.Debug("ConnectDial called", "network", network, "addr", addr)
+	s.setupConnectDial()
+	s.logger.Info("HTTPS tunneling configured with upstream proxy support")
+}
 
-		// Extract host for checking if it's a CDN or should use direct connection
-		host, _, err := net.SplitHostPort(addr)
+// setupConnectDial dials CONNECT tunnels directly or through the upstream
+// recorded for them
+func (s *Server) setupConnectDial() {
+	s.proxyServer.ConnectDialWithReq = traceConnectDial(func(req *http.Request, network, addr string) (net.Conn, error) {
+		conn, upstream, err := s.dialConnectTarget(req, network, addr)
 		if err != nil {
-			// addr might not have a port
-			host = addr
+			return nil, err
 		}
 
-		// Check if this should use direct connection
-		if IsCDNDomain(host, s.routingConfig, s.logger) {
-			s.logger.Debug("Using direct connection for CDN domain", "host", host)
-			return net.DialTimeout(network, addr, DefaultTimeout)
+		// Throttle the raw tunnel bytes of this client and upstream
+		if clientUpstream := upstreamFromRequest(req); clientUpstream != nil {
+			conn = throttleConn(conn, bandwidthLimiters(clientUpstream, upstream))
 		}
+		return conn, nil
+	})
+}
 
-		// Look up upstream info by target address
-		value, ok := s.targetUpstreams.Load(addr)
-		if !ok {
-			s.logger.Debug("No upstream found for target, using direct connection", "addr", addr)
-			return net.DialTimeout(network, addr, DefaultTimeout)
-		}
+// interceptOrTunnel intercepts an authenticated CONNECT in MITM mode unless
+// its host is excluded, not selected or bypassed after failed handshakes.
+// Tunnels are routed and dialed with the client's upstream as in tunneling
+// mode.
+func (s *Server) interceptOrTunnel(host string, ctx *goproxy.ProxyCtx, upstream *UpstreamInfo) (*goproxy.ConnectAction, string) {
+	if intercept, reason := shouldIntercept(host, remoteAddrIP(ctx.Req.RemoteAddr)); !intercept {
+		s.logger.Debug("Tunneling CONNECT without MITM",
+			"host", host,
+			"reason", reason)
+		return s.acceptConnect(host, ctx, upstream)
+	}
+	return s.mitmConnect, host
+}
 
-		upstream, ok := value.(*UpstreamInfo)
-		if !ok {
-			s.logger.Error("Invalid upstream info type", "addr", addr)
-			return net.DialTimeout(network, addr, DefaultTimeout)
-		}
+// acceptConnect routes an authenticated CONNECT by its target and records
+// the upstream for the tunnel dial
+func (s *Server) acceptConnect(host string, ctx *goproxy.ProxyCtx, upstream *UpstreamInfo) (*goproxy.ConnectAction, string) {
+	// Route the tunnel by its target; the dial reuses the decision
+	decision := s.route(newConnectRouteRequest(ctx.Req, host, upstream))
+	if decision.Action == ActionBlock && decision.BlockResponse == BlockResponseReset && resetClientConn(ctx.Req.Context()) {
+		s.logger.Debug("Resetting blocked CONNECT",
+			"host", host,
+			"remote_addr", ctx.Req.RemoteAddr,
+			"rule", decision.Rule)
+		return goproxy.RejectConnect, "Connection reset"
+	}
+	if decision.Rule == ruleAdDomain {
+		s.logger.Debug("Blocking CONNECT to ad domain",
+			"host", host,
+			"remote_addr", ctx.Req.RemoteAddr)
+		ctx.Resp = adConnectResponse(ctx.Req)
+		return goproxy.RejectConnect, "Blocked ad domain"
+	}
+	if resp := s.routeResponse(ctx.Req, decision); resp != nil {
+		ctx.Resp = resp
+		return goproxy.RejectConnect, "Blocked by routing rule"
+	}
+	ctx.Req = withRoute(withUpstream(ctx.Req, upstream), decision)
 
-		s.logger.Debug("Using upstream for HTTPS connection",
-			"upstream_type", upstream.Type,
-			"upstream_host", upstream.Host,
-			"target_addr", addr)
-
-		// Handle different upstream types
-		switch upstream.Type {
-		case "http":
-			return DialThroughHTTPProxy(network, addr, upstream.Host, upstream.Port, upstream.Username, upstream.Password, s.logger)
-		case "socks5":
-			return DialThroughSOCKS5Proxy(network, addr, upstream.Host, upstream.Port, upstream.Username, upstream.Password, s.logger)
-		default:
-			s.logger.Error("Unknown upstream type", "type", upstream.Type)
-			return net.DialTimeout(network, addr, DefaultTimeout)
+	// Store by target address for ConnectDial
+	targetKey := host
+	if !strings.Contains(host, ":") {
+		// Add default HTTPS port if not present
+		targetKey = host + ":443"
+	}
+	s.targetUpstreams.Store(targetKey, upstream)
+	// Clean up after some time to prevent memory leak
+	go func(key string) {
+		time.Sleep(5 * time.Minute)
+		s.targetUpstreams.Delete(key)
+	}(targetKey)
+
+	// Also store by remote address for backwards compatibility
+	if ctx.Req != nil {
+		s.connectUpstreams.Store(ctx.Req.RemoteAddr, upstream)
+		go func(addr string) {
+			time.Sleep(5 * time.Minute)
+			s.connectUpstreams.Delete(addr)
+		}(ctx.Req.RemoteAddr)
+	}
+
+	// Allow the connection
+	return goproxy.OkConnect, host
+}
+
+// dialConnectTarget dials the target of a CONNECT tunnel, directly or through
+// the client's upstream. The upstream used is returned, nil for direct dials.
+func (s *Server) dialConnectTarget(req *http.Request, network, addr string) (net.Conn, *UpstreamInfo, error) {
+	s.logger.Debug("ConnectDial called", "network", network, "addr", addr)
+
+	// Prefer the route decided on this CONNECT request, otherwise route
+	// with the upstream found by target address
+	decision, ok := routeFromRequest(req)
+	if !ok {
+		upstream := upstreamFromRequest(req)
+		if upstream == nil {
+			if value, found := s.targetUpstreams.Load(addr); found {
+				upstream, ok = value.(*UpstreamInfo)
+				if !ok {
+					s.logger.Error("Invalid upstream info type", "addr", addr)
+				}
+			}
 		}
+		decision = s.route(newConnectRouteRequest(req, addr, upstream))
 	}
 
-	s.logger.Info("HTTPS tunneling configured with upstream proxy support")
+	switch decision.Action {
+	case ActionDirect:
+		s.logger.Debug("Using direct connection", "addr", addr, "rule", decision.Rule)
+		conn, err := newDirectDialer(DefaultTimeout).Dial(network, addr)
+		return conn, nil, err
+	case ActionBlock, ActionReject:
+		return nil, nil, fmt.Errorf("connection to %s blocked by routing rule %s", addr, decision.Rule)
+	}
+
+	upstream := decision.Upstream
+	if upstream == nil {
+		s.logger.Debug("No upstream found for target, using direct connection", "addr", addr)
+		conn, err := newDirectDialer(DefaultTimeout).Dial(network, addr)
+		return conn, nil, err
+	}
+
+	// Resolve the target locally if its route asks for it
+	target, err := upstreamTarget(req.Context(), decision, addr)
+	if err != nil {
+		return nil, upstream, err
+	}
+
+	s.logger.Debug("Using upstream for HTTPS connection",
+		"upstream_type", upstream.Type,
+		"upstream_host", upstream.Host,
+		"target_addr", target)
+
+	// Handle different upstream types
+	var conn net.Conn
+	switch upstream.Type {
+	case "http":
+		conn, err = DialThroughHTTPProxy(network, target, upstream.Host, upstream.Port, upstream.Username, upstream.Password, upstream.Named, s.logger)
+	case "socks5":
+		conn, err = DialThroughSOCKS5Proxy(network, target, upstream.Host, upstream.Port, upstream.Username, upstream.Password, upstream.Named, s.logger)
+	default:
+		s.logger.Error("Unknown upstream type", "type", upstream.Type)
+		conn, err = newDirectDialer(DefaultTimeout).Dial(network, addr)
+		return conn, nil, err
+	}
+	return conn, upstream, err
 }
 
 // setupAuthentication configures authentication middleware for non-CONNECT requests
@@ -349,6 +510,7 @@ func (s *Server) setupAuthentication() {
 	s.proxyServer.OnRequest().DoFunc(
 		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 			startTime := time.Now()
+			r, _ = startRequestSpan(r)
 			s.logger.Debug("Incoming request",
 				"method", r.Method,
 				"url", r.URL.String(),
@@ -356,12 +518,29 @@ func (s *Server) setupAuthentication() {
 				"remote_addr", r.RemoteAddr,
 				"user_agent", r.Header.Get("User-Agent"))
 
+			// Enforce request rate limits before parsing any credentials
+			if resp := s.checkRequestRate(r, ctx); resp != nil {
+				return r, resp
+			}
+
 			// For MITM requests, check if we already have upstream info from CONNECT
 			if s.config.HTTPSMitm && ctx.UserData != nil {
 				// Already authenticated during CONNECT phase
 				s.logger.Debug("Using upstream from CONNECT phase (MITM)",
 					"method", r.Method,
 					"url", r.URL.String())
+				// The client accepted the certificate of the intercepted host
+				recordMITMSuccess(remoteAddrIP(r.RemoteAddr), r.URL.Hostname())
+				return r, nil
+			}
+
+			// Trusted client networks may connect without credentials
+			if upstream := clientPolicyUpstream(r); upstream != nil {
+				ctx.UserData = upstream
+				s.logger.Debug("Request accepted by client policy",
+					"remote_addr", r.RemoteAddr,
+					"upstream_type", upstream.Type,
+					"upstream_host", upstream.Host)
 				return r, nil
 			}
 
@@ -414,7 +593,7 @@ func (s *Server) setupAuthentication() {
 			password := parts[1]
 
 			// Parse upstream from auth
-			upstream, err := ParseUpstreamFromAuth(username, password, s.logger)
+			upstream, err := parseUpstreamTraced(r.Context(), username, password, s.logger)
 			if err != nil {
 				s.logger.Error("Failed to parse upstream from auth", "error", err)
 				return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden,
@@ -422,6 +601,7 @@ func (s *Server) setupAuthentication() {
 			}
 
 			// Store upstream info in context for later use
+			upstream.CredentialID = credentialID(auth)
 			ctx.UserData = upstream
 
 			// Remove Proxy-Authorization header before forwarding
@@ -437,24 +617,6 @@ func (s *Server) setupAuthentication() {
 		})
 }
 
-// setupAdBlocking configures ad blocking functionality
-func (s *Server) setupAdBlocking() {
-	if s.routingConfig.AdBlocking.Enabled {
-		s.proxyServer.OnRequest().DoFunc(
-			func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-				if IsAdDomain(r.Host, s.routingConfig, s.logger) {
-					s.logger.Debug("Blocking ad domain request",
-						"host", r.Host,
-						"method", r.Method,
-						"url", r.URL.String())
-					// Return minimal blocking response
-					return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusNoContent, "")
-				}
-				return r, nil
-			})
-	}
-}
-
 // setupResponseLogging configures response logging in debug mode
 func (s *Server) setupResponseLogging() {
 	if s.logger.Enabled(nil, slog.LevelDebug) {
@@ -514,10 +676,27 @@ func (s *Server) setupMITMRouting() {
 			}
 			
 			// Determine which transport to use
-			if IsStaticFile(fullURL, s.routingConfig, s.logger) || IsCDNDomain(r.Host, s.routingConfig, s.logger) {
-				// Use direct connection for static files and CDNs
+			clientUpstream, _ := ctx.UserData.(*UpstreamInfo)
+			_, routeSpan := tracing.Tracer().Start(r.Context(), "proxy.route")
+			rr := newRouteRequest(r, fullURL, clientUpstream)
+			decision := s.route(rr)
+			isDirect := decision.Action == ActionDirect
+			routeSpan.SetAttributes(
+				attribute.String("proxy.route.action", decision.Action),
+				attribute.String("proxy.route.rule", decision.Rule),
+				attribute.Bool("proxy.route.direct", isDirect),
+				attribute.Bool("proxy.chrome", isChrome))
+			routeSpan.End()
+
+			// Blocked and rejected requests are answered by the proxy
+			if resp := s.routeResponse(r, decision); resp != nil {
+				return r, resp
+			}
+
+			if isDirect {
+				// Use direct connection for direct routes
 				s.logger.Debug("Using direct connection",
-					"reason", "static_file_or_cdn",
+					"reason", decision.Rule,
 					"url", fullURL,
 					"is_chrome", isChrome,
 					"duration", time.Since(startTime))
@@ -532,12 +711,19 @@ func (s *Server) setupMITMRouting() {
 				}
 
 				ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
-					return transport.RoundTrip(req)
+					resp, err := tracedRoundTrip(req, "direct", transport)
+					if errors.Is(err, errDestinationDenied) {
+						return destinationDeniedResponse(req, s.logger), nil
+					}
+					if err == nil {
+						resp.Body = throttleBody(resp.Body, bandwidthLimiters(clientUpstream, nil))
+					}
+					return resp, err
 				})
 			} else {
-				// Get upstream from context
-				upstream, ok := ctx.UserData.(*UpstreamInfo)
-				if !ok || upstream == nil {
+				// Use the upstream chosen by routing, the client's own by default
+				upstream := decision.Upstream
+				if upstream == nil {
 					s.logger.Error("No upstream info in context")
 					return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusInternalServerError, "No upstream configured")
 				}
@@ -549,7 +735,10 @@ func (s *Server) setupMITMRouting() {
 					"url", fullURL)
 
 				// Get or create transport for this upstream
+				_, transportSpan := tracing.Tracer().Start(r.Context(), "proxy.transport",
+					trace.WithAttributes(attribute.String("proxy.upstream.type", upstream.Type)))
 				upstreamTransport, err := GetUpstreamTransport(upstream, s.transportConfig, s.logger)
+				endSpan(transportSpan, err)
 				if err != nil {
 					s.logger.Error("Failed to get upstream transport", "error", err)
 					return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, "Upstream connection failed")
@@ -558,16 +747,22 @@ func (s *Server) setupMITMRouting() {
 				// Use upstream proxy for other requests
 				ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
 					respStart := time.Now()
-					resp, err := upstreamTransport.RoundTrip(req)
+					resp, err := tracedRoundTrip(withRoute(req, decision), "upstream", upstreamTransport)
 
 					if err != nil {
 						s.logger.Debug("Upstream request failed",
 							"error", err,
 							"duration", time.Since(respStart))
 					} else {
+						resp.Body = throttleBody(resp.Body, bandwidthLimiters(clientUpstream, upstream))
 						s.logger.Debug("Upstream request completed",
 							"status", resp.StatusCode,
 							"duration", time.Since(respStart))
+
+						// Remember static content served by the default upstream route
+						if decision.Rule == "default" {
+							learnStaticRoute(rr, resp, s.logger)
+						}
 					}
 
 					return resp, err
@@ -610,11 +805,27 @@ func (s *Server) setupNonMITMRouting() {
 				optimizeChromeHeaders(r, s.logger)
 			}
 			
-			// Check if it's a static file or CDN
-			if IsStaticFile(fullURL, s.routingConfig, s.logger) || IsCDNDomain(r.Host, s.routingConfig, s.logger) {
+			// Route the request
+			clientUpstream, _ := ctx.UserData.(*UpstreamInfo)
+			_, routeSpan := tracing.Tracer().Start(r.Context(), "proxy.route")
+			decision := s.route(newRouteRequest(r, fullURL, clientUpstream))
+			isDirect := decision.Action == ActionDirect
+			routeSpan.SetAttributes(
+				attribute.String("proxy.route.action", decision.Action),
+				attribute.String("proxy.route.rule", decision.Rule),
+				attribute.Bool("proxy.route.direct", isDirect),
+				attribute.Bool("proxy.chrome", isChrome))
+			routeSpan.End()
+
+			// Blocked and rejected requests are answered by the proxy
+			if resp := s.routeResponse(r, decision); resp != nil {
+				return r, resp
+			}
+
+			if isDirect {
 				// Use direct connection
 				s.logger.Debug("Using direct connection (non-MITM)",
-					"reason", "static_file_or_cdn",
+					"reason", decision.Rule,
 					"url", fullURL,
 					"is_chrome", isChrome,
 					"duration", time.Since(startTime))
@@ -630,13 +841,17 @@ func (s *Server) setupNonMITMRouting() {
 				
 				ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
 					respStart := time.Now()
-					resp, err := transport.RoundTrip(req)
+					resp, err := tracedRoundTrip(req, "direct", transport)
+					if errors.Is(err, errDestinationDenied) {
+						return destinationDeniedResponse(req, s.logger), nil
+					}
 
 					if err != nil {
 						s.logger.Debug("Direct request failed",
 							"error", err,
 							"duration", time.Since(respStart))
 					} else {
+						resp.Body = throttleBody(resp.Body, bandwidthLimiters(clientUpstream, nil))
 						s.logger.Debug("Direct request completed",
 							"status", resp.StatusCode,
 							"duration", time.Since(respStart))
@@ -645,9 +860,9 @@ func (s *Server) setupNonMITMRouting() {
 					return resp, err
 				})
 			} else {
-				// Get upstream from context
-				upstream, ok := ctx.UserData.(*UpstreamInfo)
-				if !ok || upstream == nil {
+				// Use the upstream chosen by routing, the client's own by default
+				upstream := decision.Upstream
+				if upstream == nil {
 					s.logger.Error("No upstream info in context (non-MITM)")
 					return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusInternalServerError, "No upstream configured")
 				}
@@ -659,7 +874,10 @@ func (s *Server) setupNonMITMRouting() {
 					"url", fullURL)
 
 				// Get or create transport for this upstream
+				_, transportSpan := tracing.Tracer().Start(r.Context(), "proxy.transport",
+					trace.WithAttributes(attribute.String("proxy.upstream.type", upstream.Type)))
 				upstreamTransport, err := GetUpstreamTransport(upstream, s.transportConfig, s.logger)
+				endSpan(transportSpan, err)
 				if err != nil {
 					s.logger.Error("Failed to get upstream transport", "error", err)
 					return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, "Upstream connection failed")
@@ -668,13 +886,14 @@ func (s *Server) setupNonMITMRouting() {
 				// Use upstream proxy
 				ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
 					respStart := time.Now()
-					resp, err := upstreamTransport.RoundTrip(req)
+					resp, err := tracedRoundTrip(withRoute(req, decision), "upstream", upstreamTransport)
 
 					if err != nil {
 						s.logger.Debug("Upstream request failed (non-MITM)",
 							"error", err,
 							"duration", time.Since(respStart))
 					} else {
+						resp.Body = throttleBody(resp.Body, bandwidthLimiters(clientUpstream, upstream))
 						s.logger.Debug("Upstream request completed (non-MITM)",
 							"status", resp.StatusCode,
 							"duration", time.Since(respStart))
@@ -736,21 +955,64 @@ func optimizeChromeHeaders(r *http.Request, logger *slog.Logger) {
 	}
 }
 
-// startHTTPServer creates and starts the HTTP server
+// startHTTPServer creates and starts an HTTP server for each listener
 func (s *Server) startHTTPServer() error {
-	// Create HTTP server with optimized settings
-	server := &http.Server{
-		Addr:    s.config.ListenAddr,
-		Handler: s.proxyServer,
-
-		// Timeouts to prevent slow clients from holding connections
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
-
-		// Buffer sizes
-		ReadHeaderTimeout: 10 * time.Second,
-		MaxHeaderBytes:    1 << 20, // 1MB
+	listenerConfigs := s.config.Listeners
+	if len(listenerConfigs) == 0 {
+		listenerConfigs = []ListenerConfig{{Address: s.config.ListenAddr}}
+	}
+
+	// Open every listener before serving so a bad address fails startup
+	var servers []*http.Server
+	var listeners []net.Listener
+	for i := range listenerConfigs {
+		lc := &listenerConfigs[i]
+		listener, err := s.listen(lc)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			s.logger.Error("Server error", "error", err)
+			return err
+		}
+
+		// Transparent listeners receive origin-form requests
+		var handler http.Handler = s.proxyServer
+		if lc.Transparent {
+			handler = http.HandlerFunc(s.serveTransparentHTTP)
+		}
+
+		// Create HTTP server with optimized settings
+		servers = append(servers, &http.Server{
+			Handler: handler,
+
+			// Timeouts to prevent slow clients from holding connections
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  120 * time.Second,
+
+			// Buffer sizes
+			ReadHeaderTimeout: 10 * time.Second,
+			MaxHeaderBytes:    1 << 20, // 1MB
+
+			// Expose the client connection and its listener to handlers
+			ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+				return context.WithValue(connContext(ctx, conn), listenerContextKey{}, lc)
+			},
+		})
+		listeners = append(listeners, listener)
+	}
+
+	var dnsClosers []io.Closer
+	if s.config.DNSServer != nil {
+		var err error
+		if dnsClosers, err = s.startDNSServer(); err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			s.logger.Error("Server error", "error", err)
+			return err
+		}
 	}
 
 	// Setup graceful shutdown
@@ -761,25 +1023,60 @@ func (s *Server) startHTTPServer() error {
 		<-sigChan
 		s.logger.Info("Shutting down proxy server...")
 
+		if s.routingConfig.AdBlocking.Enabled {
+			requests, tunnels, queries := AdBlockCounts()
+			s.logger.Info("Ad blocking summary",
+				"blocked_requests", requests,
+				"blocked_tunnels", tunnels,
+				"blocked_dns_queries", queries)
+		}
+		SaveAdStats()
+
+		if s.certs != nil {
+			hits, loaded, generated, mean, longest := s.certs.counts()
+			s.logger.Info("MITM certificate summary",
+				"cache_hits", hits,
+				"loaded", loaded,
+				"generated", generated,
+				"mean_generation_time", mean,
+				"max_generation_time", longest)
+		}
+
 		// Stop transport cache cleanup
 		StopTransportCacheCleanup()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
-		if err := server.Shutdown(ctx); err != nil {
-			s.logger.Error("Server shutdown error", "error", err)
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				s.logger.Error("Server shutdown error", "error", err)
+			}
+		}
+		for _, closer := range dnsClosers {
+			closer.Close()
 		}
 	}()
 
-	// Start server
-	s.logger.Info("Starting high-performance proxy server",
-		"address", s.config.ListenAddr,
-		"mode", "smart_proxy_auth")
+	// Start servers
+	errs := make(chan error, len(servers))
+	for i, server := range servers {
+		s.logger.Info("Starting high-performance proxy server",
+			"address", listenerConfigs[i].Address,
+			"tls", listenerConfigs[i].TLSCert != "",
+			"skip_auth", listenerConfigs[i].SkipAuth,
+			"transparent", listenerConfigs[i].Transparent,
+			"mode", "smart_proxy_auth")
+		go func(server *http.Server, listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(server, listeners[i])
+	}
 
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		s.logger.Error("Server error", "error", err)
-		return err
+	for range servers {
+		if err := <-errs; err != http.ErrServerClosed {
+			s.logger.Error("Server error", "error", err)
+			return err
+		}
 	}
 
 	s.logger.Info("Server gracefully stopped")
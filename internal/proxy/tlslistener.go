@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the files of a TLS listener are checked for changes
+const tlsReloadInterval = 10 * time.Second
+
+// tlsFileState identifies a version of a file
+type tlsFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// tlsReloader serves the TLS configuration of a listener and reloads the
+// certificate, key and client CA when their files change
+type tlsReloader struct {
+	lc     *ListenerConfig
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	config  *tls.Config
+	files   map[string]tlsFileState
+	checked time.Time
+}
+
+// newTLSReloader loads the TLS files of a listener
+func newTLSReloader(lc *ListenerConfig, logger *slog.Logger) (*tlsReloader, error) {
+	r := &tlsReloader{lc: lc, logger: logger}
+	files, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.files = files
+	r.checked = time.Now()
+	return r, nil
+}
+
+// paths returns the files the TLS configuration is built from
+func (r *tlsReloader) paths() []string {
+	paths := []string{r.lc.TLSCert, r.lc.TLSKey}
+	if r.lc.ClientCA != "" {
+		paths = append(paths, r.lc.ClientCA)
+	}
+	return paths
+}
+
+// stat returns the current version of each file
+func (r *tlsReloader) stat() (map[string]tlsFileState, error) {
+	files := make(map[string]tlsFileState)
+	for _, path := range r.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		files[path] = tlsFileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	return files, nil
+}
+
+// load builds the TLS configuration from the current files
+func (r *tlsReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.lc.TLSCert, r.lc.TLSKey)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.lc.ClientCA != "" {
+		pem, err := os.ReadFile(r.lc.ClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in client CA %s", r.lc.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.lc.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	r.config = config
+	return nil
+}
+
+// changed reports whether any file differs from the last seen version
+func (r *tlsReloader) changed(files map[string]tlsFileState) bool {
+	for path, state := range files {
+		seen := r.files[path]
+		if !state.modTime.Equal(seen.modTime) || state.size != seen.size {
+			return true
+		}
+	}
+	return false
+}
+
+// getConfigForClient is used as tls.Config.GetConfigForClient
+func (r *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= tlsReloadInterval {
+		r.checked = time.Now()
+		// Missing files are skipped while they are being replaced. A file that
+		// fails to load is retried only after it changes again.
+		if files, err := r.stat(); err == nil && r.changed(files) {
+			r.files = files
+			if err := r.load(); err != nil {
+				r.logger.Error("Failed to reload TLS files, keeping current certificate",
+					"listener", r.lc.Address,
+					"error", err)
+			} else {
+				r.logger.Info("Reloaded TLS certificate", "listener", r.lc.Address)
+			}
+		}
+	}
+	return r.config, nil
+}
+
+// peerCertificate returns the verified client certificate of the TLS
+// connection a request arrived on, if any
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	var conn net.Conn
+	switch tracked := ctx.Value(connContextKey{}).(type) {
+	case *trackedConn:
+		conn = tracked.Conn
+	case *trackedHalfCloseConn:
+		conn = tracked.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// clientCertUpstream returns the upstream profile mapped to the verified
+// client certificate of a request, matched by subject common name or full
+// subject
+func clientCertUpstream(ctx context.Context, lc *ListenerConfig) *UpstreamInfo {
+	if len(lc.ClientUpstreams) == 0 {
+		return nil
+	}
+	cert := peerCertificate(ctx)
+	if cert == nil {
+		return nil
+	}
+
+	subject := cert.Subject.CommonName
+	profile, ok := lc.ClientUpstreams[subject]
+	if !ok {
+		subject = cert.Subject.String()
+		if profile, ok = lc.ClientUpstreams[subject]; !ok {
+			return nil
+		}
+	}
+
+	// Identify the client by its certificate for per-identity limits
+	upstream := *profile
+	upstream.CredentialID = credentialID("cert:" + subject)
+	return &upstream
+}
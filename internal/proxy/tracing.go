@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+
+	"github.com/elazarl/goproxy"
+	"github.com/hothuongtin/smartproxy/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestSpanKey keeps the request span reachable from derived contexts
+type requestSpanKey struct{}
+
+// requestSpanFromContext returns the request span started by startRequestSpan
+func requestSpanFromContext(ctx context.Context) trace.Span {
+	if span, ok := ctx.Value(requestSpanKey{}).(trace.Span); ok {
+		return span
+	}
+	return trace.SpanFromContext(ctx)
+}
+
+// startRequestSpan starts the root span for a proxied request, continuing
+// the trace from an incoming traceparent header when present
+func startRequestSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, "proxy.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.Host),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", r.RemoteAddr),
+		))
+	ctx = context.WithValue(ctx, requestSpanKey{}, span)
+	return r.WithContext(ctx), span
+}
+
+// endSpan records an error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// parseUpstreamTraced runs ParseUpstreamFromAuth inside an authentication span
+func parseUpstreamTraced(ctx context.Context, username, password string, logger *slog.Logger) (*UpstreamInfo, error) {
+	_, span := tracing.Tracer().Start(ctx, "proxy.authenticate")
+	upstream, err := ParseUpstreamFromAuth(username, password, logger)
+	if err == nil {
+		span.SetAttributes(attribute.String("proxy.upstream.type", upstream.Type))
+	}
+	endSpan(span, err)
+	return upstream, err
+}
+
+// tracedRoundTrip performs the round trip inside a client span, recording
+// connection, TLS handshake and first byte timings as span events
+func tracedRoundTrip(req *http.Request, route string, transport http.RoundTripper) (*http.Response, error) {
+	requestSpan := requestSpanFromContext(req.Context())
+	ctx, span := tracing.Tracer().Start(req.Context(), "proxy.round_trip",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("proxy.route", route)))
+	if !span.IsRecording() {
+		span.End()
+		return transport.RoundTrip(req)
+	}
+
+	clientTrace := &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			span.AddEvent("get_conn", trace.WithAttributes(attribute.String("host_port", hostPort)))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.AddEvent("got_conn", trace.WithAttributes(attribute.Bool("reused", info.Reused)))
+		},
+		ConnectStart: func(network, addr string) {
+			span.AddEvent("dial_start", trace.WithAttributes(attribute.String("addr", addr)))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			span.AddEvent("dial_done", trace.WithAttributes(attribute.String("addr", addr), attribute.Bool("error", err != nil)))
+		},
+		TLSHandshakeStart: func() {
+			span.AddEvent("tls_handshake_start")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			span.AddEvent("tls_handshake_done", trace.WithAttributes(attribute.Bool("error", err != nil)))
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("first_response_byte")
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, clientTrace))
+
+	// Continue the trace at the origin
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	} else {
+		// The request span will not see a response, so close it here
+		endSpan(requestSpan, err)
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// setupRequestTracing ends request spans once the response is known
+func (s *Server) setupRequestTracing() {
+	s.proxyServer.OnResponse().DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil || resp.Request == nil {
+				return resp
+			}
+			span := requestSpanFromContext(resp.Request.Context())
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+			if resp.StatusCode >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+			span.End()
+			return resp
+		})
+}
+
+// traceConnect wraps a CONNECT handler in a span. Accepted tunnels keep the
+// span open so the upstream dial can be recorded under it.
+func traceConnect(handler func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string)) func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if ctx.Req == nil {
+			return handler(host, ctx)
+		}
+
+		spanCtx := otel.GetTextMapPropagator().Extract(ctx.Req.Context(), propagation.HeaderCarrier(ctx.Req.Header))
+		spanCtx, span := tracing.Tracer().Start(spanCtx, "proxy.connect",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("server.address", host),
+				attribute.String("client.address", ctx.Req.RemoteAddr),
+			))
+		ctx.Req = ctx.Req.WithContext(spanCtx)
+
+		action, result := handler(host, ctx)
+		if action == nil {
+			span.End()
+			return action, result
+		}
+
+		switch action.Action {
+		case goproxy.ConnectAccept:
+			span.SetAttributes(attribute.String("proxy.connect.action", "tunnel"))
+		case goproxy.ConnectReject:
+			span.SetAttributes(attribute.String("proxy.connect.action", "reject"))
+			span.SetStatus(codes.Error, result)
+			span.End()
+		default:
+			span.SetAttributes(attribute.String("proxy.connect.action", "mitm"))
+			span.End()
+		}
+		return action, result
+	}
+}
+
+// traceConnectDial wraps a CONNECT dial function in a span and closes the
+// CONNECT span once the tunnel is established or has failed
+func traceConnectDial(dial func(req *http.Request, network, addr string) (net.Conn, error)) func(req *http.Request, network, addr string) (net.Conn, error) {
+	return func(req *http.Request, network, addr string) (net.Conn, error) {
+		if req == nil {
+			return dial(req, network, addr)
+		}
+
+		connectSpan := trace.SpanFromContext(req.Context())
+		_, span := tracing.Tracer().Start(req.Context(), "proxy.dial",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("server.address", addr)))
+
+		conn, err := dial(req, network, addr)
+		endSpan(span, err)
+		endSpan(connectSpan, err)
+		return conn, err
+	}
+}
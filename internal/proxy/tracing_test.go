@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/hothuongtin/smartproxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Incoming trace context sent by test clients
+const (
+	testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID    = "00f067aa0ba902b7"
+)
+
+// tracedTestProxy is a SmartProxy server exporting spans to memory, with a
+// plain HTTP proxy as the client's upstream
+type tracedTestProxy struct {
+	addr     string
+	auth     string // Proxy-Authorization selecting the upstream
+	exporter *tracetest.InMemoryExporter
+}
+
+// startTracedProxy starts SmartProxy with tracing of every request
+func startTracedProxy(t *testing.T, mitm bool) *tracedTestProxy {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := tracing.Setup(context.Background(), &tracing.Config{Enabled: true, SampleRatio: 1}, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(context.Background()) })
+
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	t.Cleanup(upstream.Close)
+
+	// Take a free port for the server, which listens by address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	transport := &TransportConfig{MaxIdleConns: 10, MaxIdleConnsPerHost: 10, IdleConnTimeout: 10, TLSHandshakeTimeout: 5, ExpectContinueTimeout: 1}
+	server := NewServer(&Config{ListenAddr: addr, HTTPSMitm: mitm}, &RoutingConfig{}, transport, logger)
+	go server.Start()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	password := base64.StdEncoding.EncodeToString([]byte(upstream.Listener.Addr().String()))
+	return &tracedTestProxy{
+		addr:     addr,
+		auth:     "Basic " + base64.StdEncoding.EncodeToString([]byte("http:"+password)),
+		exporter: exporter,
+	}
+}
+
+// spans returns the ended spans by name once all names were exported
+func (p *tracedTestProxy) spans(t *testing.T, names ...string) map[string]tracetest.SpanStub {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		byName := make(map[string]tracetest.SpanStub)
+		for _, span := range p.exporter.GetSpans() {
+			byName[span.Name] = span
+		}
+		missing := ""
+		for _, name := range names {
+			if _, ok := byName[name]; !ok {
+				missing = name
+			}
+		}
+		if missing == "" {
+			return byName
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("span %s not exported, got %v", missing, spanNames(p.exporter.GetSpans()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}
+
+// connect opens a CONNECT tunnel to host through the proxy
+func (p *tracedTestProxy) connect(t *testing.T, host string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req := "CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: " + p.auth + "\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+	return conn
+}
+
+// checkTrace fails unless every span belongs to the incoming trace
+func checkTrace(t *testing.T, spans map[string]tracetest.SpanStub, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if got := spans[name].SpanContext.TraceID().String(); got != testTraceID {
+			t.Errorf("%s trace ID = %s, want %s", name, got, testTraceID)
+		}
+	}
+}
+
+// checkChild fails unless child was started under parent
+func checkChild(t *testing.T, spans map[string]tracetest.SpanStub, parent, child string) {
+	t.Helper()
+	if spans[child].Parent.SpanID() != spans[parent].SpanContext.SpanID() {
+		t.Errorf("%s is not a child of %s", child, parent)
+	}
+}
+
+func TestTracingProxiedRequest(t *testing.T) {
+	p := startTracedProxy(t, false)
+	received := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, origin.URL+"/page", nil)
+	req.Header.Set("traceparent", testTraceParent)
+	req.Header.Set("Proxy-Authorization", p.auth)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: p.addr})}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	spans := p.spans(t, "proxy.request", "proxy.authenticate", "proxy.route", "proxy.transport", "proxy.round_trip")
+	checkTrace(t, spans, "proxy.request", "proxy.authenticate", "proxy.route", "proxy.transport", "proxy.round_trip")
+	if got := spans["proxy.request"].Parent.SpanID().String(); got != testParentID {
+		t.Errorf("proxy.request parent = %s, want %s", got, testParentID)
+	}
+	for _, name := range []string{"proxy.authenticate", "proxy.route", "proxy.transport", "proxy.round_trip"} {
+		checkChild(t, spans, "proxy.request", name)
+	}
+	if got := spans["proxy.request"].SpanKind; got != trace.SpanKindServer {
+		t.Errorf("proxy.request kind = %v, want server", got)
+	}
+
+	// The origin continues the trace under the round trip span
+	want := "00-" + testTraceID + "-" + spans["proxy.round_trip"].SpanContext.SpanID().String() + "-01"
+	if got := <-received; got != want {
+		t.Errorf("origin traceparent = %q, want %q", got, want)
+	}
+}
+
+func TestTracingTunnel(t *testing.T) {
+	p := startTracedProxy(t, false)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	p.connect(t, origin.Listener.Addr().String())
+
+	spans := p.spans(t, "proxy.connect", "proxy.authenticate", "proxy.dial")
+	checkChild(t, spans, "proxy.connect", "proxy.authenticate")
+	checkChild(t, spans, "proxy.connect", "proxy.dial")
+	if spans["proxy.dial"].SpanContext.TraceID() != spans["proxy.connect"].SpanContext.TraceID() {
+		t.Error("proxy.dial is not in the trace of proxy.connect")
+	}
+}
+
+func TestTracingMITMContinuesTrace(t *testing.T) {
+	p := startTracedProxy(t, true)
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	origin.Config.ErrorLog = log.New(io.Discard, "", 0) // the refused handshake
+	origin.StartTLS()
+	defer origin.Close()
+	host := origin.Listener.Addr().String()
+
+	conn := p.connect(t, host)
+	roots := x509.NewCertPool()
+	ca, err := x509.ParseCertificate(goproxy.GoproxyCa.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots.AddCert(ca)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: roots})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("MITM handshake: %v", err)
+	}
+
+	// SmartProxy does not trust the origin's test certificate, so the round
+	// trip fails and goproxy closes the tunnel. The spans are recorded
+	// either way.
+	req, _ := http.NewRequest(http.MethodGet, "https://"+host+"/page", nil)
+	req.Header.Set("traceparent", testTraceParent)
+	if err := req.Write(tlsConn); err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, tlsConn)
+
+	spans := p.spans(t, "proxy.connect", "proxy.request", "proxy.route", "proxy.round_trip")
+	if got := spans["proxy.connect"].Attributes; !hasAttribute(got, "proxy.connect.action", "mitm") {
+		t.Errorf("proxy.connect attributes = %v, want mitm action", got)
+	}
+	checkTrace(t, spans, "proxy.request", "proxy.route", "proxy.round_trip")
+	if got := spans["proxy.request"].Parent.SpanID().String(); got != testParentID {
+		t.Errorf("proxy.request parent = %s, want %s", got, testParentID)
+	}
+	checkChild(t, spans, "proxy.request", "proxy.round_trip")
+}
+
+// hasAttribute reports whether a span attribute has the string value
+func hasAttribute(attrs []attribute.KeyValue, key, value string) bool {
+	for _, attr := range attrs {
+		if string(attr.Key) == key && attr.Value.AsString() == value {
+			return true
+		}
+	}
+	return false
+}
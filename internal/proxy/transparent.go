@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Time a transparent client has to send the TLS ClientHello or HTTP request
+const transparentSniffTimeout = 10 * time.Second
+
+// First byte of a TLS handshake record
+const tlsRecordTypeHandshake = 0x16
+
+// Port of sniffed TLS connections without an original destination
+const transparentTLSPort = 443
+
+// errClientHelloRead aborts the sniffing handshake once the SNI is known
+var errClientHelloRead = errors.New("client hello read")
+
+// transparentConn is a connection redirected to a transparent listener.
+// Bytes read while sniffing its destination are replayed by Read.
+type transparentConn struct {
+	net.Conn
+	reader  io.Reader
+	origDst netip.AddrPort // invalid if the connection was not redirected
+}
+
+func (c *transparentConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// transparentListener accepts connections redirected by iptables or
+// nftables. TLS connections are tunneled by their SNI; HTTP connections are
+// returned by Accept and served as proxy requests by their Host header.
+type transparentListener struct {
+	net.Listener
+	server *Server
+	lc     *ListenerConfig
+	conns  chan net.Conn
+	done   chan struct{}
+	err    error // set before done is closed
+}
+
+// newTransparentListener starts sniffing the connections of a listener
+func (s *Server) newTransparentListener(listener net.Listener, lc *ListenerConfig) *transparentListener {
+	l := &transparentListener{
+		Listener: listener,
+		server:   s,
+		lc:       lc,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *transparentListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// acceptLoop sniffs each accepted connection in its own goroutine so a slow
+// client cannot hold up others
+func (l *transparentListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.err = err
+				close(l.done)
+				return
+			}
+			l.server.logger.Warn("Transparent listener accept error", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go l.sniff(conn)
+	}
+}
+
+// sniff finds the destination of a connection and dispatches it by protocol.
+// Without an original destination, e.g. when NAT happened on another host,
+// only the sniffed SNI or Host header is used.
+func (l *transparentListener) sniff(conn net.Conn) {
+	origDst, err := originalDestination(conn)
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); err == nil && ok &&
+		origDst == netip.AddrPortFrom(local.AddrPort().Addr().Unmap(), local.AddrPort().Port()) {
+		err = errors.New("connection was not redirected")
+	}
+	if err != nil {
+		l.server.logger.Debug("No original destination for transparent connection",
+			"remote_addr", conn.RemoteAddr().String(),
+			"error", err)
+		origDst = netip.AddrPort{}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(transparentSniffTimeout))
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if first[0] != tlsRecordTypeHandshake {
+		conn.SetReadDeadline(time.Time{})
+		tc := &transparentConn{Conn: conn, reader: reader, origDst: origDst}
+		select {
+		case l.conns <- tc:
+		case <-l.done:
+			conn.Close()
+		}
+		return
+	}
+
+	var hello bytes.Buffer
+	serverName := sniffServerName(conn, io.TeeReader(reader, &hello))
+	conn.SetReadDeadline(time.Time{})
+	tc := &transparentConn{Conn: conn, reader: io.MultiReader(&hello, reader), origDst: origDst}
+	l.server.tunnelTransparent(tc, l.lc, serverName)
+}
+
+// sniffConn feeds a TLS ClientHello to a handshake that never answers
+type sniffConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c sniffConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c sniffConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c sniffConn) Close() error                { return nil }
+
+// sniffServerName reads a TLS ClientHello and returns its SNI, empty if the
+// client sent none
+func sniffServerName(conn net.Conn, reader io.Reader) string {
+	var serverName string
+	tls.Server(sniffConn{Conn: conn, reader: reader}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	return serverName
+}
+
+// tunnelTransparent routes a redirected TLS connection by its SNI, or its
+// original destination without one, and tunnels it like a CONNECT
+func (s *Server) tunnelTransparent(conn *transparentConn, lc *ListenerConfig, serverName string) {
+	tracked := &trackedConn{Conn: conn}
+	defer tracked.Close()
+
+	host, port := serverName, transparentTLSPort
+	if conn.origDst.IsValid() {
+		port = int(conn.origDst.Port())
+		if host == "" {
+			host = conn.origDst.Addr().String()
+		}
+	}
+	if host == "" {
+		s.logger.Debug("Transparent TLS connection without SNI or original destination",
+			"remote_addr", conn.RemoteAddr().String())
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	// Describe the tunnel as a CONNECT so client policies, rate limits and
+	// routing apply as for proxy clients
+	ctx := context.WithValue(connContext(context.Background(), tracked), listenerContextKey{}, lc)
+	req := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}).WithContext(ctx)
+
+	if !s.limitConnect(&goproxy.ProxyCtx{Req: req}) {
+		return
+	}
+	upstream := clientPolicyUpstream(req)
+	if upstream == nil {
+		s.logger.Debug("No upstream for transparent client", "remote_addr", req.RemoteAddr)
+		return
+	}
+
+	decision := s.route(newConnectRouteRequest(req, target, upstream))
+	s.logger.Debug("Transparent TLS connection",
+		"remote_addr", req.RemoteAddr,
+		"server_name", serverName,
+		"original_dst", conn.origDst.String(),
+		"action", decision.Action,
+		"rule", decision.Rule)
+
+	var remote net.Conn
+	var via *UpstreamInfo
+	var err error
+	switch decision.Action {
+	case ActionBlock, ActionReject:
+		if decision.BlockResponse == BlockResponseReset {
+			resetConn(tracked)
+		}
+		return
+	case ActionDirect:
+		// Connect where the client was going rather than resolving again
+		addr := target
+		if conn.origDst.IsValid() {
+			addr = conn.origDst.String()
+		}
+		remote, err = newDirectDialer(DefaultTimeout).Dial("tcp", addr)
+	default:
+		remote, via, err = s.dialConnectTarget(withRoute(withUpstream(req, upstream), decision), "tcp", target)
+	}
+	if err != nil {
+		s.logger.Debug("Transparent dial failed", "target", target, "error", err)
+		return
+	}
+	// Closing the throttled connection releases its bandwidth limiters
+	remote = throttleConn(remote, bandwidthLimiters(upstream, via))
+	defer remote.Close()
+	pipeConns(tracked, remote)
+}
+
+// pipeConns copies between two connections until both directions finish
+func pipeConns(client, remote net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(remote, client)
+		closeWrite(remote)
+		close(done)
+	}()
+	io.Copy(client, remote)
+	closeWrite(client)
+	<-done
+}
+
+// closeWrite half-closes a connection if supported, otherwise closes it
+func closeWrite(conn net.Conn) {
+	if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+		hc.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// originalDestinationFromContext returns the original destination of a
+// request on a transparent listener
+func originalDestinationFromContext(ctx context.Context) netip.AddrPort {
+	var conn net.Conn
+	switch tracked := ctx.Value(connContextKey{}).(type) {
+	case *trackedConn:
+		conn = tracked.Conn
+	case *trackedHalfCloseConn:
+		conn = tracked.Conn
+	}
+	if tc, ok := conn.(*transparentConn); ok {
+		return tc.origDst
+	}
+	return netip.AddrPort{}
+}
+
+// serveTransparentHTTP turns the origin-form requests of a transparent
+// listener into proxy requests for their Host, or original destination
+func (s *Server) serveTransparentHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if host == "" {
+		if origDst := originalDestinationFromContext(r.Context()); origDst.IsValid() {
+			host = origDst.String()
+		}
+	}
+	if host == "" {
+		http.Error(w, "Missing Host header", http.StatusBadRequest)
+		return
+	}
+	// A request for the listener itself would loop back to it
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && host == local.String() {
+		http.Error(w, "Request addressed to the transparent listener", http.StatusBadRequest)
+		return
+	}
+
+	r.URL.Scheme = "http"
+	r.URL.Host = host
+	s.proxyServer.ServeHTTP(w, r)
+}
@@ -157,12 +157,11 @@ func CreateOptimizedTransport(config *TransportConfig) *http.Transport {
 		ReadBufferSize:  config.ReadBufferSize,
 		WriteBufferSize: config.WriteBufferSize,
 
-		// Connection settings
-		DialContext: (&net.Dialer{
+		// Connection settings, resolving with the built-in resolver
+		DialContext: (&resolvingDialer{Dialer: net.Dialer{
 			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
+		}}).DialContext,
 
 		// TLS settings
 		TLSClientConfig: &tls.Config{
@@ -215,12 +214,11 @@ func CreateChromeOptimizedTransport(config *TransportConfig, logger *slog.Logger
 		ReadBufferSize:  chromeConfig.ReadBufferSize,
 		WriteBufferSize: chromeConfig.WriteBufferSize,
 
-		// Connection settings
-		DialContext: (&net.Dialer{
+		// Connection settings, resolving with the built-in resolver
+		DialContext: (&resolvingDialer{Dialer: net.Dialer{
 			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
+		}}).DialContext,
 
 		// TLS settings
 		TLSClientConfig: &tls.Config{
@@ -241,8 +239,9 @@ func CreateChromeOptimizedTransport(config *TransportConfig, logger *slog.Logger
 	return transport
 }
 
-// CreateHTTPProxyTransport creates transport for upstream HTTP proxy
-func CreateHTTPProxyTransport(proxyURL string, username, password string, config *TransportConfig, logger *slog.Logger) (*http.Transport, error) {
+// CreateHTTPProxyTransport creates transport for upstream HTTP proxy. The
+// proxy address is checked against the destination deny list unless named.
+func CreateHTTPProxyTransport(proxyURL string, username, password string, named bool, config *TransportConfig, logger *slog.Logger) (*http.Transport, error) {
 	logger.Debug("Creating HTTP proxy transport",
 		"proxy_url", proxyURL,
 		"has_auth", username != "")
@@ -261,6 +260,7 @@ func CreateHTTPProxyTransport(proxyURL string, username, password string, config
 
 	transport := CreateOptimizedTransport(config)
 	transport.Proxy = http.ProxyURL(parsedURL)
+	transport.DialContext = upstreamProxyDialer(named).DialContext
 
 	logger.Debug("HTTP proxy transport created successfully",
 		"proxy_host", parsedURL.Host)
@@ -268,8 +268,9 @@ func CreateHTTPProxyTransport(proxyURL string, username, password string, config
 	return transport, nil
 }
 
-// CreateSOCKS5ProxyTransport creates transport for upstream SOCKS5 proxy
-func CreateSOCKS5ProxyTransport(proxyAddr string, username, password string, config *TransportConfig, logger *slog.Logger) (*http.Transport, error) {
+// CreateSOCKS5ProxyTransport creates transport for upstream SOCKS5 proxy. The
+// proxy address is checked against the destination deny list unless named.
+func CreateSOCKS5ProxyTransport(proxyAddr string, username, password string, named bool, config *TransportConfig, logger *slog.Logger) (*http.Transport, error) {
 	logger.Debug("Creating SOCKS5 proxy transport",
 		"proxy_addr", proxyAddr,
 		"has_auth", username != "")
@@ -294,7 +295,7 @@ func CreateSOCKS5ProxyTransport(proxyAddr string, username, password string, con
 		logger.Debug("Extracted SOCKS5 host", "host", proxyAddr)
 	}
 
-	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, upstreamProxyDialer(named))
 	if err != nil {
 		logger.Debug("Failed to create SOCKS5 dialer", "error", err)
 		return nil, err
@@ -302,11 +303,17 @@ func CreateSOCKS5ProxyTransport(proxyAddr string, username, password string, con
 
 	transport := CreateOptimizedTransport(config)
 	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Resolve the target locally if its route asks for it
+		decision, _ := routeFromContext(ctx)
+		target, err := upstreamTarget(ctx, decision, addr)
+		if err != nil {
+			return nil, err
+		}
 		logger.Debug("SOCKS5 dialing",
 			"network", network,
-			"addr", addr,
+			"addr", target,
 			"via", proxyAddr)
-		return dialer.Dial(network, addr)
+		return dialer.Dial(network, target)
 	}
 
 	logger.Debug("SOCKS5 proxy transport created successfully",
@@ -315,8 +322,9 @@ func CreateSOCKS5ProxyTransport(proxyAddr string, username, password string, con
 	return transport, nil
 }
 
-// DialThroughHTTPProxy dials through an HTTP proxy using CONNECT method
-func DialThroughHTTPProxy(network, targetAddr string, proxyHost, proxyPort, username, password string, logger *slog.Logger) (net.Conn, error) {
+// DialThroughHTTPProxy dials through an HTTP proxy using CONNECT method. The
+// proxy address is checked against the destination deny list unless named.
+func DialThroughHTTPProxy(network, targetAddr string, proxyHost, proxyPort, username, password string, named bool, logger *slog.Logger) (net.Conn, error) {
 	proxyAddr := net.JoinHostPort(proxyHost, proxyPort)
 
 	logger.Debug("Dialing through HTTP proxy",
@@ -325,7 +333,7 @@ func DialThroughHTTPProxy(network, targetAddr string, proxyHost, proxyPort, user
 		"has_auth", username != "")
 
 	// Connect to proxy
-	conn, err := net.DialTimeout("tcp", proxyAddr, DefaultTimeout)
+	conn, err := upstreamProxyDialer(named).Dial("tcp", proxyAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to proxy: %w", err)
 	}
@@ -366,8 +374,9 @@ func DialThroughHTTPProxy(network, targetAddr string, proxyHost, proxyPort, user
 	return conn, nil
 }
 
-// DialThroughSOCKS5Proxy dials through a SOCKS5 proxy
-func DialThroughSOCKS5Proxy(network, targetAddr string, proxyHost, proxyPort, username, password string, logger *slog.Logger) (net.Conn, error) {
+// DialThroughSOCKS5Proxy dials through a SOCKS5 proxy. The proxy address is
+// checked against the destination deny list unless named.
+func DialThroughSOCKS5Proxy(network, targetAddr string, proxyHost, proxyPort, username, password string, named bool, logger *slog.Logger) (net.Conn, error) {
 	proxyAddr := net.JoinHostPort(proxyHost, proxyPort)
 
 	logger.Debug("Dialing through SOCKS5 proxy",
@@ -383,7 +392,7 @@ func DialThroughSOCKS5Proxy(network, targetAddr string, proxyHost, proxyPort, us
 		}
 	}
 
-	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, upstreamProxyDialer(named))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
 	}
@@ -423,6 +432,10 @@ func runCacheCleanup(interval time.Duration, maxAge time.Duration, logger *slog.
 		select {
 		case <-ticker.C:
 			cleanupTransportCache(maxAge, logger)
+			cleanupBandwidthLimiters(maxAge, logger)
+			cleanupRateLimiters(maxAge, logger)
+			cleanupLearnedRoutes(logger)
+			cleanupDNSCache(logger)
 		case <-cacheCleanupStop:
 			logger.Debug("Transport cache cleanup stopped")
 			return
@@ -468,10 +481,19 @@ func cleanupTransportCache(maxAge time.Duration, logger *slog.Logger) {
 	}
 }
 
+// upstreamKey returns the key identifying an upstream, as type:host:port
+func upstreamKey(upstream *UpstreamInfo) string {
+	return fmt.Sprintf("%s:%s:%s", upstream.Type, upstream.Host, upstream.Port)
+}
+
 // GetUpstreamTransport gets or creates transport for the given upstream
 func GetUpstreamTransport(upstream *UpstreamInfo, config *TransportConfig, logger *slog.Logger) (*http.Transport, error) {
-	// Create cache key
-	cacheKey := fmt.Sprintf("%s:%s:%s", upstream.Type, upstream.Host, upstream.Port)
+	// Create cache key, keeping named upstreams apart from client-supplied
+	// ones with the same address
+	cacheKey := upstreamKey(upstream)
+	if upstream.Named {
+		cacheKey += ":named"
+	}
 
 	// Check cache first
 	if cached, ok := upstreamCache.Load(cacheKey); ok {
@@ -503,6 +525,7 @@ func GetUpstreamTransport(upstream *UpstreamInfo, config *TransportConfig, logge
 			proxyURL,
 			upstream.Username,
 			upstream.Password,
+			upstream.Named,
 			config,
 			logger,
 		)
@@ -511,6 +534,7 @@ func GetUpstreamTransport(upstream *UpstreamInfo, config *TransportConfig, logge
 			proxyURL,
 			upstream.Username,
 			upstream.Password,
+			upstream.Named,
 			config,
 			logger,
 		)
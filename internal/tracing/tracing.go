@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name used for all SmartProxy spans
+const TracerName = "github.com/hothuongtin/smartproxy"
+
+// Config represents tracing configuration
+type Config struct {
+	Enabled     bool
+	Endpoint    string // OTLP/HTTP collector host:port
+	URLPath     string // defaults to /v1/traces
+	Insecure    bool   // plain HTTP to the collector
+	Headers     map[string]string
+	ServiceName string
+	SampleRatio float64 // 0 samples nothing, 1 samples every trace
+}
+
+// ShutdownFunc flushes pending spans and stops the exporter
+type ShutdownFunc func(ctx context.Context) error
+
+// Setup installs the global tracer provider and W3C trace context propagator.
+// A nil exporter sends spans via OTLP/HTTP to the configured endpoint; tests
+// can pass an in-memory exporter instead.
+func Setup(ctx context.Context, config *Config, exporter sdktrace.SpanExporter) (ShutdownFunc, error) {
+	// Always honor incoming traceparent headers, even when not exporting
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if config == nil || !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// Exporters passed in directly are synchronous so tests see spans at once
+	var spanProcessor sdktrace.TracerProviderOption
+	if exporter != nil {
+		spanProcessor = sdktrace.WithSyncer(exporter)
+	} else {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+		if config.URLPath != "" {
+			opts = append(opts, otlptracehttp.WithURLPath(config.URLPath))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(config.Headers))
+		}
+
+		var err error
+		exporter, err = otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		spanProcessor = sdktrace.WithBatcher(exporter)
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "smartproxy"
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		spanProcessor,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the SmartProxy tracer from the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}